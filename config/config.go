@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/millken/httpctl/log"
 	"github.com/pkg/errors"
@@ -19,16 +20,464 @@ var (
 type (
 	Http struct {
 		Listen string `yaml:"listen" json:"listen"`
+		// Listens are further addresses served alongside Listen
+		Listens []string `yaml:"listens" json:"listens"`
+	}
+	Mitm struct {
+		Enable          bool     `yaml:"enable" json:"enable"`
+		WildcardDomains []string `yaml:"wildcardDomains" json:"wildcardDomains"`
 	}
 	Https struct {
 		Listen   string `yaml:"listen" json:"listen"`
 		KeyFile  string `yaml:"keyFile" json:"keyFile"`
 		CertFile string `yaml:"certFile" json:"certFile"`
+		Mitm     Mitm   `yaml:"mitm" json:"mitm"`
+	}
+	Mux struct {
+		// Listen serves plaintext and TLS, with the Https certificate, on
+		// one address, empty disables it
+		Listen string `yaml:"listen" json:"listen"`
+	}
+	ProxyProtocol struct {
+		Enable       bool     `yaml:"enable" json:"enable"`
+		TrustedPeers []string `yaml:"trustedPeers" json:"trustedPeers"`
+	}
+	Forwarded struct {
+		Enable       bool     `yaml:"enable" json:"enable"`
+		TrustedPeers []string `yaml:"trustedPeers" json:"trustedPeers"`
+	}
+	ClientACL struct {
+		Allow []string `yaml:"allow" json:"allow"`
+		Deny  []string `yaml:"deny" json:"deny"`
+	}
+	HeaderFilter struct {
+		Allow []string `yaml:"allow" json:"allow"`
+		Deny  []string `yaml:"deny" json:"deny"`
+	}
+	FaultRule struct {
+		Name        string        `yaml:"name" json:"name"`
+		Host        string        `yaml:"host" json:"host"`
+		Path        string        `yaml:"path" json:"path"`
+		Probability float64       `yaml:"probability" json:"probability"`
+		Delay       time.Duration `yaml:"delay" json:"delay"`
+		Status      int           `yaml:"status" json:"status"`
+		Drop        bool          `yaml:"drop" json:"drop"`
+	}
+	MirrorRule struct {
+		Name string `yaml:"name" json:"name"`
+		Host string `yaml:"host" json:"host"`
+		Path string `yaml:"path" json:"path"`
+		// Methods mirrored, any when empty
+		Methods []string `yaml:"methods" json:"methods"`
+	}
+	Mirror struct {
+		// Upstream is the host[:port] or URL of the shadow, empty disables
+		// mirroring
+		Upstream string `yaml:"upstream" json:"upstream"`
+		// Probability of a matching request being mirrored, 0 to 1
+		Probability float64 `yaml:"probability" json:"probability"`
+		// Rules mirror requests matching one of them, all when empty
+		Rules []MirrorRule `yaml:"rules" json:"rules"`
+		// MaxBodyBytes, 1MB by default, larger bodies and those of unknown
+		// length aren't mirrored
+		MaxBodyBytes int64 `yaml:"maxBodyBytes" json:"maxBodyBytes"`
+		// Timeout of a shadow request, 5s by default
+		Timeout time.Duration `yaml:"timeout" json:"timeout"`
+		// MaxConcurrent shadow requests, 100 by default, requests beyond
+		// aren't mirrored
+		MaxConcurrent int `yaml:"maxConcurrent" json:"maxConcurrent"`
+	}
+	StaticRoute struct {
+		Name    string            `yaml:"name" json:"name"`
+		Host    string            `yaml:"host" json:"host"`
+		Path    string            `yaml:"path" json:"path"`
+		Status  int               `yaml:"status" json:"status"`
+		Headers map[string]string `yaml:"headers" json:"headers"`
+		Body    string            `yaml:"body" json:"body"`
+		File    string            `yaml:"file" json:"file"`
+	}
+	ResponseDelayRule struct {
+		Name           string        `yaml:"name" json:"name"`
+		Host           string        `yaml:"host" json:"host"`
+		Path           string        `yaml:"path" json:"path"`
+		Latency        time.Duration `yaml:"latency" json:"latency"`
+		BytesPerSecond int64         `yaml:"bytesPerSecond" json:"bytesPerSecond"`
+	}
+	ResponseDelay struct {
+		// Latency holds upstream responses back before their first byte
+		Latency time.Duration `yaml:"latency" json:"latency"`
+		// BytesPerSecond throttles the bodies sent to clients, 0 doesn't
+		BytesPerSecond int64 `yaml:"bytesPerSecond" json:"bytesPerSecond"`
+		// Rules override both for matching requests, the first one wins
+		Rules []ResponseDelayRule `yaml:"rules" json:"rules"`
+	}
+	TimeoutRule struct {
+		Name    string        `yaml:"name" json:"name"`
+		Host    string        `yaml:"host" json:"host"`
+		Path    string        `yaml:"path" json:"path"`
+		Timeout time.Duration `yaml:"timeout" json:"timeout"`
+	}
+	ErrorPage struct {
+		Enable   bool   `yaml:"enable" json:"enable"`
+		Template string `yaml:"template" json:"template"`
+	}
+	BufferPoolRule struct {
+		ContentType string `yaml:"contentType" json:"contentType"`
+		Size        int    `yaml:"size" json:"size"`
+	}
+	BlockedResponse struct {
+		Status      int    `yaml:"status" json:"status"`
+		ContentType string `yaml:"contentType" json:"contentType"`
+		Body        string `yaml:"body" json:"body"`
+	}
+	PAC struct {
+		Enable bool `yaml:"enable" json:"enable"`
+		// Host and Path the PAC file is served at, any host and /proxy.pac
+		// by default
+		Host string `yaml:"host" json:"host"`
+		Path string `yaml:"path" json:"path"`
+		// Proxy is the address clients are directed to, the one they
+		// fetched the PAC file from by default
+		Proxy string `yaml:"proxy" json:"proxy"`
+		// Include are the shExpMatch host patterns sent through the proxy,
+		// all by default, Exclude go direct
+		Include []string `yaml:"include" json:"include"`
+		Exclude []string `yaml:"exclude" json:"exclude"`
+	}
+	CookieRewrite struct {
+		Secure   bool `yaml:"secure" json:"secure"`
+		HttpOnly bool `yaml:"httpOnly" json:"httpOnly"`
+		// SameSite replaces the SameSite attribute when set, e.g. "Lax"
+		SameSite string `yaml:"sameSite" json:"sameSite"`
+	}
+	// SetCookie is injected into responses matching Host, Path prefix,
+	// ContentType prefix and Status, empty conditions match any
+	SetCookie struct {
+		Host        string `yaml:"host" json:"host"`
+		Path        string `yaml:"path" json:"path"`
+		ContentType string `yaml:"contentType" json:"contentType"`
+		Status      []int  `yaml:"status" json:"status"`
+		Name        string `yaml:"name" json:"name"`
+		Value       string `yaml:"value" json:"value"`
+		Domain      string `yaml:"domain" json:"domain"`
+		CookiePath  string `yaml:"cookiePath" json:"cookiePath"`
+		// MaxAge in seconds, 0 is a session cookie
+		MaxAge   int    `yaml:"maxAge" json:"maxAge"`
+		Secure   bool   `yaml:"secure" json:"secure"`
+		HttpOnly bool   `yaml:"httpOnly" json:"httpOnly"`
+		SameSite string `yaml:"sameSite" json:"sameSite"`
+	}
+	SSRFProtection struct {
+		Enable bool `yaml:"enable" json:"enable"`
+		// Ranges upstreams may not resolve to, private, loopback,
+		// link-local and metadata ranges by default
+		Ranges []string `yaml:"ranges" json:"ranges"`
+		// Allow exempts CIDRs within the blocked ranges
+		Allow []string `yaml:"allow" json:"allow"`
+	}
+	RefererPolicy struct {
+		// Mode "strip" removes the Referer, "origin" cuts it to its scheme
+		// and host, "rewrite" replaces it with Value. Empty forwards it.
+		Mode  string `yaml:"mode" json:"mode"`
+		Value string `yaml:"value" json:"value"`
+	}
+	PathNormalization struct {
+		// Enable removes dot segments and repeated slashes from outbound
+		// request paths
+		Enable bool `yaml:"enable" json:"enable"`
+		// DecodeUnreserved also decodes percent-encoded letters, digits
+		// and "-._~", so encoded dot segments are removed too
+		DecodeUnreserved bool `yaml:"decodeUnreserved" json:"decodeUnreserved"`
+	}
+	CORS struct {
+		Enable bool `yaml:"enable" json:"enable"`
+		// Origins allowed to make cross-origin requests, "*" allows any
+		Origins []string `yaml:"origins" json:"origins"`
+		// Methods and Headers allowed in preflights, any when empty
+		Methods []string `yaml:"methods" json:"methods"`
+		Headers []string `yaml:"headers" json:"headers"`
+		// ExposeHeaders are readable by scripts in actual responses
+		ExposeHeaders []string `yaml:"exposeHeaders" json:"exposeHeaders"`
+		// Credentials allows cookies and authorization, the origin is then
+		// echoed instead of "*", which can't be combined with it
+		Credentials bool `yaml:"credentials" json:"credentials"`
+		// MaxAge lets browsers cache preflight answers
+		MaxAge time.Duration `yaml:"maxAge" json:"maxAge"`
+	}
+	UpstreamMetrics struct {
+		Enable bool `yaml:"enable" json:"enable"`
+		// MaxSeries caps the host, ip and code combinations counted apart,
+		// 1000 by default, others are counted as host and ip "other"
+		MaxSeries int `yaml:"maxSeries" json:"maxSeries"`
+	}
+	DebugCapture struct {
+		// TrustedPeers are the CIDRs of the clients allowed to ask for a
+		// capture, none disables it
+		TrustedPeers []string `yaml:"trustedPeers" json:"trustedPeers"`
+		// MaxBodyBytes of the decoded response body are logged, 64KiB by
+		// default
+		MaxBodyBytes int64 `yaml:"maxBodyBytes" json:"maxBodyBytes"`
+	}
+	Recompress struct {
+		// Enable encodes gzip and br bodies again, they are sent decoded
+		// otherwise
+		Enable bool `yaml:"enable" json:"enable"`
+		// GzipLevel from 1, fastest, to 9, smallest, 6 by default
+		GzipLevel int `yaml:"gzipLevel" json:"gzipLevel"`
+		// BrotliLevel from 1, fastest, to 11, smallest, 5 by default
+		BrotliLevel int `yaml:"brotliLevel" json:"brotliLevel"`
+	}
+	Prewarm struct {
+		// Hosts are the hot upstreams, host:port or https://host:port
+		Hosts []string `yaml:"hosts" json:"hosts"`
+		// Size is the number of connections kept warm per host, 1 by default
+		Size int `yaml:"size" json:"size"`
+		// Interval between prewarms, half the idle timeout by default
+		Interval time.Duration `yaml:"interval" json:"interval"`
+	}
+	RateLimit struct {
+		// RequestsPerSecond per client IP, 0 is unlimited
+		RequestsPerSecond float64 `yaml:"requestsPerSecond" json:"requestsPerSecond"`
+		// Burst is the number of requests above the rate a client may send
+		// at once, the rate rounded up by default
+		Burst int `yaml:"burst" json:"burst"`
+	}
+	StaleIfError struct {
+		Enable bool `yaml:"enable" json:"enable"`
+		// Window a response is served stale, a stale-if-error directive of
+		// the response overrides it
+		Window       time.Duration `yaml:"window" json:"window"`
+		MaxEntries   int           `yaml:"maxEntries" json:"maxEntries"`
+		MaxBodyBytes int64         `yaml:"maxBodyBytes" json:"maxBodyBytes"`
+	}
+	UpstreamSelection struct {
+		// Mode "latency" prefers the address with the lowest recent latency,
+		// "weighted" picks the first address by its weight, the resolver
+		// order is kept otherwise
+		Mode string `yaml:"mode" json:"mode"`
+		// Decay weighs the latest sample in the moving average, 0.3 by default
+		Decay float64 `yaml:"decay" json:"decay"`
+		// ProbeEvery selections a slower address is tried first, 10 by default
+		ProbeEvery int `yaml:"probeEvery" json:"probeEvery"`
+		// RetryAfter an address failed it is healthy again, 10s by default
+		RetryAfter time.Duration `yaml:"retryAfter" json:"retryAfter"`
+		// Weights of the addresses, ip or ip:port, in mode "weighted", 1 by
+		// default and 0 only for failover
+		Weights map[string]int `yaml:"weights" json:"weights"`
+		// CanaryPercent of the requests go to the Canary addresses in mode
+		// "weighted", the others get the rest
+		Canary        []string `yaml:"canary" json:"canary"`
+		CanaryPercent float64  `yaml:"canaryPercent" json:"canaryPercent"`
+	}
+	Proxy struct {
+		ProxyProtocol        ProxyProtocol `yaml:"proxyProtocol" json:"proxyProtocol"`
+		AllowedMethods       []string      `yaml:"allowedMethods" json:"allowedMethods"`
+		MaxDecompressedBytes int64         `yaml:"maxDecompressedBytes" json:"maxDecompressedBytes"`
+		// MaxDecompressionRatio truncates bodies decoding to more than that
+		// many times their encoded size, 0 is unlimited
+		MaxDecompressionRatio float64      `yaml:"maxDecompressionRatio" json:"maxDecompressionRatio"`
+		TLSSessionCacheSize   int          `yaml:"tlsSessionCacheSize" json:"tlsSessionCacheSize"`
+		UpstreamAddrHeader    bool         `yaml:"upstreamAddrHeader" json:"upstreamAddrHeader"`
+		DefaultPort           int          `yaml:"defaultPort" json:"defaultPort"`
+		ResponseHeaders       HeaderFilter `yaml:"responseHeaders" json:"responseHeaders"`
+		DisableKeepAlives     bool         `yaml:"disableKeepAlives" json:"disableKeepAlives"`
+		// MaxConcurrentRequests limits the requests served at once, 0 is unlimited
+		MaxConcurrentRequests int `yaml:"maxConcurrentRequests" json:"maxConcurrentRequests"`
+		// MaxConnsPerIP closes the connections a client IP opens beyond
+		// that many at once, 0 is unlimited
+		MaxConnsPerIP int `yaml:"maxConnsPerIP" json:"maxConnsPerIP"`
+		// SniffContentType corrects the content type handlers see from the
+		// decoded body, "missing" only when the upstream sent none,
+		// "generic" also over text/plain and application/octet-stream,
+		// "always" whenever the sniffed type differs. Empty disables it.
+		SniffContentType string `yaml:"sniffContentType" json:"sniffContentType"`
+		// StrictDecompressionStatus answers responses whose body fails to
+		// decompress with that status, such as 502 or 599, instead of the
+		// corrupt body, 0 relays them. Streamed bodies are always relayed.
+		StrictDecompressionStatus int `yaml:"strictDecompressionStatus" json:"strictDecompressionStatus"`
+		// Recompress encodes the bodies the proxy modified like their
+		// upstream response was
+		Recompress Recompress `yaml:"recompress" json:"recompress"`
+		// UpstreamNextProtos are the ALPN protocols offered upstream
+		UpstreamNextProtos []string `yaml:"upstreamNextProtos" json:"upstreamNextProtos"`
+		// Blocked replaces the response of a body blocked by a scanner
+		Blocked BlockedResponse `yaml:"blocked" json:"blocked"`
+		// Faults inject delays, errors or drops into matching requests
+		Faults []FaultRule `yaml:"faults" json:"faults"`
+		// ResponseDelay slows upstream responses down to simulate slow
+		// backends, faults delay requests before they are proxied
+		ResponseDelay ResponseDelay `yaml:"responseDelay" json:"responseDelay"`
+		// Mirror replays a share of the requests to a shadow upstream,
+		// discarding its responses
+		Mirror Mirror `yaml:"mirror" json:"mirror"`
+		// CoalesceRequests shares one upstream fetch between identical
+		// concurrent GETs whose body fits CoalesceMaxBytes
+		CoalesceRequests bool  `yaml:"coalesceRequests" json:"coalesceRequests"`
+		CoalesceMaxBytes int64 `yaml:"coalesceMaxBytes" json:"coalesceMaxBytes"`
+		// BodyIdleTimeout detaches the response body handed to handlers from
+		// its pooled buffer once unread for that long, 0 disables it
+		BodyIdleTimeout time.Duration `yaml:"bodyIdleTimeout" json:"bodyIdleTimeout"`
+		// Forwarded appends a RFC 7239 Forwarded element to outbound requests
+		Forwarded Forwarded `yaml:"forwarded" json:"forwarded"`
+		// StaticRoutes answer matching host and path without going upstream
+		StaticRoutes []StaticRoute `yaml:"staticRoutes" json:"staticRoutes"`
+		// StreamContentTypes are relayed and handed to handlers as they
+		// arrive, text/event-stream by default
+		StreamContentTypes []string `yaml:"streamContentTypes" json:"streamContentTypes"`
+		// MaxResponseHeaders rejects upstream responses with more header
+		// fields with a 502, 0 is unlimited
+		MaxResponseHeaders int `yaml:"maxResponseHeaders" json:"maxResponseHeaders"`
+		// RequestTimeout bounds an upstream exchange up to the response
+		// headers, the body isn't cut by it. Timeouts override it for
+		// matching host and path, 0 is unlimited
+		RequestTimeout time.Duration `yaml:"requestTimeout" json:"requestTimeout"`
+		Timeouts       []TimeoutRule `yaml:"timeouts" json:"timeouts"`
+		// SlowRequestThreshold warns about upstream exchanges, body
+		// included, taking longer, 0 disables it
+		SlowRequestThreshold time.Duration `yaml:"slowRequestThreshold" json:"slowRequestThreshold"`
+		// DebugCapture logs requests of trusted clients sending
+		// X-Httpctl-Debug: 1 in full
+		DebugCapture DebugCapture `yaml:"debugCapture" json:"debugCapture"`
+		// ErrorPage renders failed upstream exchanges with a html/template
+		// given .Status .StatusText .Host .Addr and .Class
+		ErrorPage ErrorPage `yaml:"errorPage" json:"errorPage"`
+		// RawBody hands handlers the body exactly as sent by the origin,
+		// nothing is decoded
+		RawBody bool `yaml:"rawBody" json:"rawBody"`
+		// BufferPools pick the initial body buffer size, 1k to 8k, by
+		// content type prefix
+		BufferPools []BufferPoolRule `yaml:"bufferPools" json:"bufferPools"`
+		// AllowTrace forwards TRACE requests, blocked unless listed in
+		// AllowedMethods otherwise
+		AllowTrace bool `yaml:"allowTrace" json:"allowTrace"`
+		// MethodOverride forwards POST requests with the method of their
+		// X-HTTP-Method-Override header
+		MethodOverride bool `yaml:"methodOverride" json:"methodOverride"`
+		// ForwardOptionsAsterisk forwards "OPTIONS *" instead of answering
+		// it locally
+		ForwardOptionsAsterisk bool `yaml:"forwardOptionsAsterisk" json:"forwardOptionsAsterisk"`
+		// DropInformational swallows the 1xx responses of upstreams, such as
+		// 103 Early Hints, instead of relaying them ahead of the final one
+		DropInformational bool `yaml:"dropInformational" json:"dropInformational"`
+		// CORS answers preflight requests locally and adds the CORS
+		// headers to the responses to allowed origins
+		CORS CORS `yaml:"cors" json:"cors"`
+		// ClientACL allows or denies client CIDRs, BlockedHosts denies
+		// domains and their subdomains, denials go to the audit log
+		ClientACL    ClientACL `yaml:"clientACL" json:"clientACL"`
+		BlockedHosts []string  `yaml:"blockedHosts" json:"blockedHosts"`
+		// SSRFProtection answers requests to hosts resolving to blocked
+		// ranges with a 403, configured fallback upstreams are trusted
+		SSRFProtection SSRFProtection `yaml:"ssrfProtection" json:"ssrfProtection"`
+		// BlockedJA3 denies TLS clients by the JA3 hash of their ClientHello
+		BlockedJA3 []string `yaml:"blockedJA3" json:"blockedJA3"`
+		// UpstreamSelection orders the resolved addresses of a host
+		UpstreamSelection UpstreamSelection `yaml:"upstreamSelection" json:"upstreamSelection"`
+		// PAC serves a proxy auto-config file directing browsers here
+		PAC PAC `yaml:"pac" json:"pac"`
+		// LogMalformedBytes logs up to that many raw bytes of malformed
+		// plaintext upstream responses, 0 disables it
+		LogMalformedBytes int `yaml:"logMalformedBytes" json:"logMalformedBytes"`
+		// ConflictingLength handles plaintext upstream responses sending
+		// both Content-Length and Transfer-Encoding, "normalize", the
+		// default, relays them by Transfer-Encoding, "reject" answers a
+		// 502. TLS upstreams and client requests are always normalized
+		ConflictingLength string `yaml:"conflictingLength" json:"conflictingLength"`
+		// UpstreamKeepAlive is the TCP keep-alive probe interval of upstream
+		// connections, 30s by default and disabled when negative
+		UpstreamKeepAlive time.Duration `yaml:"upstreamKeepAlive" json:"upstreamKeepAlive"`
+		// UpstreamIdleTimeout closes pooled upstream connections idle for
+		// that long, 7s by default
+		UpstreamIdleTimeout time.Duration `yaml:"upstreamIdleTimeout" json:"upstreamIdleTimeout"`
+		// DrainTimeout bounds how long Shutdown waits for active connections,
+		// those left are closed, 0 waits on the Shutdown context only
+		DrainTimeout time.Duration `yaml:"drainTimeout" json:"drainTimeout"`
+		// Prewarm keeps idle connections to hot upstreams open, so first
+		// requests skip the connect and handshake
+		Prewarm Prewarm `yaml:"prewarm" json:"prewarm"`
+		// RewriteLocation moves absolute Location targets onto the scheme
+		// and port of the proxy, so redirected clients come back through it
+		RewriteLocation bool `yaml:"rewriteLocation" json:"rewriteLocation"`
+		// Cookies adds attributes to the Set-Cookie headers of responses
+		Cookies CookieRewrite `yaml:"cookies" json:"cookies"`
+		// SetCookies are injected unless the client or the origin already
+		// sets a cookie of that name
+		SetCookies []SetCookie `yaml:"setCookies" json:"setCookies"`
+		// MinTLSVersion, "1.0" to "1.3", and CipherSuites, crypto/tls names,
+		// restrict the client facing TLS and MITM listeners
+		MinTLSVersion string   `yaml:"minTLSVersion" json:"minTLSVersion"`
+		CipherSuites  []string `yaml:"cipherSuites" json:"cipherSuites"`
+		// CertPins are the base64 SHA-256 SPKI hashes by upstream host name,
+		// a certificate chain matching none fails with a 502
+		CertPins map[string][]string `yaml:"certPins" json:"certPins"`
+		// RateLimit answers clients over their rate with a 429, the client
+		// IP is taken from Forwarded or X-Forwarded-For of trusted peers
+		RateLimit RateLimit `yaml:"rateLimit" json:"rateLimit"`
+		// StaleIfError serves the last good response of a GET, with a
+		// Warning, when the upstream fails or answers a 5xx
+		StaleIfError StaleIfError `yaml:"staleIfError" json:"staleIfError"`
+		// FallbackUpstream is the ip or ip:port requests go to when their
+		// host doesn't resolve, such as a maintenance page server
+		FallbackUpstream string `yaml:"fallbackUpstream" json:"fallbackUpstream"`
+		// CollapseRequestHeaders are sent upstream as a single comma joined
+		// field, others keep their duplicate field lines
+		CollapseRequestHeaders []string `yaml:"collapseRequestHeaders" json:"collapseRequestHeaders"`
+		// Referer rewrites the Referer of outbound requests
+		Referer RefererPolicy `yaml:"referer" json:"referer"`
+		// AcceptLanguage overrides the Accept-Language of outbound requests,
+		// empty forwards the client's
+		AcceptLanguage string `yaml:"acceptLanguage" json:"acceptLanguage"`
+		// NormalizePath normalizes request paths before the rules of the
+		// proxy match them and the request goes out, the access log and the
+		// handlers still see the original one
+		NormalizePath PathNormalization `yaml:"normalizePath" json:"normalizePath"`
+		// HeaderOrder writes the outbound request header fields in this
+		// order, unlisted ones follow sorted by name. Upstream TLS is then
+		// limited to HTTP/1.1
+		HeaderOrder []string `yaml:"headerOrder" json:"headerOrder"`
+		// MaxRequestBytes answers requests with larger bodies with a 413,
+		// uploads of unknown length are aborted once they grow beyond, 0
+		// is unlimited
+		MaxRequestBytes int64 `yaml:"maxRequestBytes" json:"maxRequestBytes"`
+		// InspectRequestBodies exposes request bodies of up to that many
+		// bytes, decoded, to the handlers, 0 disables it
+		InspectRequestBodies int64 `yaml:"inspectRequestBodies" json:"inspectRequestBodies"`
+		// HostStats aggregates the body byte counts of transactions per host
+		HostStats bool `yaml:"hostStats" json:"hostStats"`
+		// UpstreamMetrics counts the requests served by each upstream IP
+		UpstreamMetrics UpstreamMetrics `yaml:"upstreamMetrics" json:"upstreamMetrics"`
+		// Tunnels relays CONNECT requests as opaque byte streams, counted
+		// in the access log and the host stats
+		Tunnels bool `yaml:"tunnels" json:"tunnels"`
+		// TunnelPorts are the ports CONNECT requests may open, 443 by default
+		TunnelPorts []int `yaml:"tunnelPorts" json:"tunnelPorts"`
+		// Transparent forwards the connections iptables redirected to the
+		// plaintext listeners to their original destination, Linux only
+		Transparent bool `yaml:"transparent" json:"transparent"`
+	}
+	Dns struct {
+		Servers     []string      `yaml:"servers" json:"servers"`
+		NegativeTTL time.Duration `yaml:"negativeTTL" json:"negativeTTL"`
+		// Retries of lookups failing with a timeout, waiting RetryBackoff
+		// doubled on each retry
+		Retries      int           `yaml:"retries" json:"retries"`
+		RetryBackoff time.Duration `yaml:"retryBackoff" json:"retryBackoff"`
+		// LookupTimeout bounds a whole lookup, 0 only bounds each query
+		LookupTimeout time.Duration `yaml:"lookupTimeout" json:"lookupTimeout"`
+	}
+	// Admin serves the /config dump and /logging/ level endpoints on
+	// Listen, empty disables it
+	Admin struct {
+		Listen string `yaml:"listen" json:"listen"`
 	}
 	Server struct {
 		Http     Http   `yaml:"http" json:"http"`
 		Https    Https  `yaml:"https" json:"https"`
+		Mux      Mux    `yaml:"mux" json:"mux"`
 		Resolver string `yaml:"resolver" json:"resolver"`
+		Dns      Dns    `yaml:"dns" json:"dns"`
+		Admin    Admin  `yaml:"admin" json:"admin"`
+		Proxy    Proxy  `yaml:"proxy" json:"proxy"`
 	}
 	ExampleExecutor struct {
 		Enable bool `yaml:"enable" json:"enable"`
@@ -43,10 +492,66 @@ type (
 		Hosts      []string `yaml:"hosts" json:"hosts"`
 		OutputPath string   `yaml:"outputPath" json:"outputPath"`
 	}
+	QueryMatch struct {
+		Name string `yaml:"name" json:"name"`
+		// Value must equal a value of the parameter, Regex match one, either
+		// empty the parameter only needs to be present
+		Value string `yaml:"value" json:"value"`
+		Regex string `yaml:"regex" json:"regex"`
+	}
+	RewriteRule struct {
+		// Name tags the transactions matching the rule, as do the names of
+		// static routes and fault, timeout and mirror rules, in the access
+		// log and their core.Context
+		Name   string `yaml:"name" json:"name"`
+		Host   string `yaml:"host" json:"host"`
+		Path   string `yaml:"path" json:"path"`
+		ToHost string `yaml:"toHost" json:"toHost"`
+		ToPath string `yaml:"toPath" json:"toPath"`
+		// Query must all match for the rule to apply
+		Query []QueryMatch `yaml:"query" json:"query"`
+		// Header must all match request header fields, like Query does
+		// parameters, names are case insensitive
+		Header []QueryMatch `yaml:"header" json:"header"`
+		// SetQuery and DelQuery edit the query parameters of matching requests
+		SetQuery map[string]string `yaml:"setQuery" json:"setQuery"`
+		DelQuery []string          `yaml:"delQuery" json:"delQuery"`
+	}
+	RewriteExecutor struct {
+		Enable bool          `yaml:"enable" json:"enable"`
+		Rules  []RewriteRule `yaml:"rules" json:"rules"`
+	}
+	ArchiveExecutor struct {
+		Enable     bool     `yaml:"enable" json:"enable"`
+		Hosts      []string `yaml:"hosts" json:"hosts"`
+		OutputPath string   `yaml:"outputPath" json:"outputPath"`
+		Template   string   `yaml:"template" json:"template"`
+	}
+	PrefetchExecutor struct {
+		Enable bool     `yaml:"enable" json:"enable"`
+		Hosts  []string `yaml:"hosts" json:"hosts"`
+		// Proxy is the URL of the proxy listener the prefetches go through
+		Proxy    string `yaml:"proxy" json:"proxy"`
+		Rate     int    `yaml:"rate" json:"rate"`
+		MaxLinks int    `yaml:"maxLinks" json:"maxLinks"`
+		MaxBytes int64  `yaml:"maxBytes" json:"maxBytes"`
+	}
+	RecorderExecutor struct {
+		Enable       bool     `yaml:"enable" json:"enable"`
+		Hosts        []string `yaml:"hosts" json:"hosts"`
+		MaxEntries   int      `yaml:"maxEntries" json:"maxEntries"`
+		MaxBodyBytes int64    `yaml:"maxBodyBytes" json:"maxBodyBytes"`
+		// Compress keeps the bodies gzip compressed until exported
+		Compress bool `yaml:"compress" json:"compress"`
+	}
 	Executor struct {
 		Example   ExampleExecutor   `yaml:"example" json:"example"`
 		SiteCopy  SiteCopyExecutor  `yaml:"sitecopy" json:"sitecopy"`
 		SourceMap SourceMapExecutor `yaml:"sourcemap" json:"sourcemap"`
+		Rewrite   RewriteExecutor   `yaml:"rewrite" json:"rewrite"`
+		Archive   ArchiveExecutor   `yaml:"archive" json:"archive"`
+		Prefetch  PrefetchExecutor  `yaml:"prefetch" json:"prefetch"`
+		Recorder  RecorderExecutor  `yaml:"recorder" json:"recorder"`
 	}
 	Config struct {
 		Server   Server                      `yaml:"server" json:"server"`
@@ -0,0 +1,74 @@
+package config
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// redacted replaces the values of secrets in the dumped config.
+const redacted = "REDACTED"
+
+// sensitiveKeys are the field names whose values are never dumped.
+var sensitiveKeys = []string{"password", "secret", "token", "credential", "apikey"}
+
+// Handler serves the server and executor config as JSON with its secrets
+// redacted, the passwords of URLs included. Loggers are left out, zap
+// encoder configs don't marshal.
+func Handler(cfg *Config) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := json.Marshal(struct {
+			Server   Server   `json:"server"`
+			Executor Executor `json:"executor"`
+		}{cfg.Server, cfg.Executor})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var dump interface{}
+		if err = json.Unmarshal(body, &dump); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "    ")
+		enc.Encode(redact(dump))
+	})
+}
+
+func redact(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for key, value := range v {
+			if sensitiveKey(key) {
+				v[key] = redacted
+				continue
+			}
+			v[key] = redact(value)
+		}
+	case []interface{}:
+		for i, value := range v {
+			v[i] = redact(value)
+		}
+	case string:
+		if u, err := url.Parse(v); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+	}
+	return v
+}
+
+func sensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
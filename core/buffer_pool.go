@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"strings"
 	"sync"
 )
 
@@ -48,3 +49,42 @@ func (p *BufferPool) Put(b *bytes.Buffer) {
 		p.pool.Put(b)
 	}
 }
+
+// PoolRule selects Pool for the content types starting with ContentType.
+type PoolRule struct {
+	ContentType string
+	Pool        *BufferPool
+}
+
+// DefaultPoolRules pre-select larger buffers for HTML pages and smaller
+// ones for JSON API responses.
+var DefaultPoolRules = []PoolRule{
+	{ContentType: "text/html", Pool: BufferPool8k},
+	{ContentType: "application/json", Pool: BufferPool1k},
+}
+
+// PoolOfSize returns the smallest predefined pool holding size bytes, the
+// largest one beyond.
+func PoolOfSize(size int) *BufferPool {
+	switch {
+	case size <= 1024:
+		return BufferPool1k
+	case size <= 2048:
+		return BufferPool2k
+	case size <= 4096:
+		return BufferPool4k
+	}
+	return BufferPool8k
+}
+
+// SelectPool returns the pool of the first rule matching contentType,
+// fallback otherwise.
+func SelectPool(rules []PoolRule, contentType string, fallback *BufferPool) *BufferPool {
+	contentType = strings.ToLower(strings.TrimSpace(contentType))
+	for _, rule := range rules {
+		if strings.HasPrefix(contentType, rule.ContentType) {
+			return rule.Pool
+		}
+	}
+	return fallback
+}
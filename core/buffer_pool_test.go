@@ -0,0 +1,34 @@
+package core
+
+import (
+	"bytes"
+	"testing"
+)
+
+// BenchmarkSelectPool fills a fresh buffer, as handed out by a pool emptied
+// by the GC, with a HTML page larger than the 4k default.
+func BenchmarkSelectPool(b *testing.B) {
+	page := bytes.Repeat([]byte("<p>lorem ipsum dolor sit amet</p>\n"), 200)
+	chunk := 512
+	for _, bench := range []struct {
+		name string
+		pool *BufferPool
+	}{
+		{"default", SelectPool(nil, "text/html; charset=utf-8", BufferPool4k)},
+		{"html", SelectPool(DefaultPoolRules, "text/html; charset=utf-8", BufferPool4k)},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				buf := bench.pool.pool.New().(*bytes.Buffer)
+				for off := 0; off < len(page); off += chunk {
+					end := off + chunk
+					if end > len(page) {
+						end = len(page)
+					}
+					buf.Write(page[off:end])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package core
+
+import (
+	"io"
+	"time"
+)
+
+// Timings are the phases of an upstream exchange, phases which didn't run
+// are zero, such as connecting on a reused connection.
+type Timings struct {
+	// DNS is the time resolving the upstream host.
+	DNS time.Duration
+	// Connect spans the TCP connects, failover attempts included.
+	Connect time.Duration
+	TLS     time.Duration
+	// TTFB is the time from sending the request to the first response byte.
+	TTFB time.Duration
+	// Total is the time from resolving to the end of the response body.
+	Total time.Duration
+}
+
+// Context holds the state of a proxied transaction.
+type Context struct {
+	RequestHeader  *RequestHeader
+	ResponseHeader *ResponseHeader
+	// ResponseBody reads the decoded response body, it is backed by a
+	// pooled buffer which Close returns to the pool. The proxy closes it
+	// once the transaction observers returned, unless one of them took it
+	// over with TakeResponseBody.
+	ResponseBody io.ReadCloser
+	bodyTaken    bool
+
+	// JA3 is the fingerprint of the client's TLS ClientHello, empty for
+	// plain connections.
+	JA3 string
+
+	// RequestBody is the request body decoded from its Content-Encoding,
+	// set when request body inspection is enabled and the body fits its
+	// limit. The original bytes are forwarded. Of larger multipart bodies
+	// it is the prefix up to the limit, with RequestBodyTruncated set.
+	RequestBody          []byte
+	RequestBodyTruncated bool
+
+	// MatchedRules are the names of the rules the transaction matched, in
+	// order, such as rewrite and timeout rules.
+	MatchedRules []string
+
+	// UpstreamAddr is the ip:port of the upstream connection which served
+	// the request, after any failover.
+	UpstreamAddr string
+
+	// RequestBytes and ResponseBytes count the body bytes sent upstream and
+	// received from it, DecodedBytes the decoded response body bytes handed
+	// to the executors. They are final once the response body is consumed.
+	RequestBytes  int64
+	ResponseBytes int64
+	DecodedBytes  int64
+
+	// Timings are the phases of the upstream exchange, Total is set once
+	// the response body was received.
+	Timings Timings
+}
+
+// TakeResponseBody hands the response body over to the caller, which then
+// owns it and must Close it once done reading so its buffer is recycled.
+// It must be called before ObserveTransaction returns, nil when there is
+// no body or it was taken already.
+func (c *Context) TakeResponseBody() io.ReadCloser {
+	if c.ResponseBody == nil || c.bodyTaken {
+		return nil
+	}
+	c.bodyTaken = true
+	return c.ResponseBody
+}
+
+// CloseResponseBody closes the response body unless it was taken.
+func (c *Context) CloseResponseBody() error {
+	if c.ResponseBody == nil || c.bodyTaken {
+		return nil
+	}
+	return c.ResponseBody.Close()
+}
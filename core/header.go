@@ -1,6 +1,9 @@
 package core
 
-import "bytes"
+import (
+	"bytes"
+	"net/url"
+)
 
 // HTTP methods were copied from net/http.
 const (
@@ -55,6 +58,7 @@ type ResponseHeader struct {
 	connectionClose      bool
 	noDefaultContentType bool
 	noDefaultDate        bool
+	truncated            bool
 
 	statusCode         int
 	contentLength      int
@@ -78,11 +82,13 @@ type RequestHeader struct {
 	contentLength      int
 	contentLengthBytes []byte
 
-	method      []byte
-	requestURI  []byte
-	host        []byte
-	contentType []byte
-	userAgent   []byte
+	method         []byte
+	requestURI     []byte
+	host           []byte
+	contentType    []byte
+	userAgent      []byte
+	referer        []byte
+	acceptLanguage []byte
 
 	h []argsKV
 
@@ -158,6 +164,36 @@ func (h *RequestHeader) SetUserAgentBytes(userAgent []byte) {
 	h.userAgent = append(h.userAgent[:0], userAgent...)
 }
 
+// Referer returns Referer header value.
+func (h *RequestHeader) Referer() []byte {
+	return h.referer
+}
+
+// SetReferer sets Referer header value.
+func (h *RequestHeader) SetReferer(referer string) {
+	h.referer = append(h.referer[:0], referer...)
+}
+
+// SetRefererBytes sets Referer header value.
+func (h *RequestHeader) SetRefererBytes(referer []byte) {
+	h.referer = append(h.referer[:0], referer...)
+}
+
+// AcceptLanguage returns Accept-Language header value.
+func (h *RequestHeader) AcceptLanguage() []byte {
+	return h.acceptLanguage
+}
+
+// SetAcceptLanguage sets Accept-Language header value.
+func (h *RequestHeader) SetAcceptLanguage(acceptLanguage string) {
+	h.acceptLanguage = append(h.acceptLanguage[:0], acceptLanguage...)
+}
+
+// SetAcceptLanguageBytes sets Accept-Language header value.
+func (h *RequestHeader) SetAcceptLanguageBytes(acceptLanguage []byte) {
+	h.acceptLanguage = append(h.acceptLanguage[:0], acceptLanguage...)
+}
+
 // Method returns HTTP request method.
 func (h *RequestHeader) Method() []byte {
 	if len(h.method) == 0 {
@@ -185,6 +221,22 @@ func (h *RequestHeader) RequestURI() []byte {
 	return requestURI
 }
 
+// QueryArgs returns the query parameters of RequestURI, invalid pairs are
+// skipped.
+func (h *RequestHeader) QueryArgs() url.Values {
+	requestURI := h.RequestURI()
+	i := bytes.IndexByte(requestURI, '?')
+	if i < 0 {
+		return url.Values{}
+	}
+	query := requestURI[i+1:]
+	if j := bytes.IndexByte(query, '#'); j >= 0 {
+		query = query[:j]
+	}
+	values, _ := url.ParseQuery(string(query))
+	return values
+}
+
 // SetRequestURI sets RequestURI for the first HTTP request line.
 // RequestURI must be properly encoded.
 // Use URI.RequestURI for constructing proper RequestURI if unsure.
@@ -300,3 +352,13 @@ func (h *ResponseHeader) StatusCode() int {
 func (h *ResponseHeader) SetStatusCode(statusCode int) {
 	h.statusCode = statusCode
 }
+
+// Truncated returns true if the body handed to executors was cut short.
+func (h *ResponseHeader) Truncated() bool {
+	return h.truncated
+}
+
+// SetTruncated marks the body handed to executors as cut short.
+func (h *ResponseHeader) SetTruncated() {
+	h.truncated = true
+}
@@ -8,15 +8,28 @@ import (
 	"time"
 )
 
-func CreateHTTPTransport(localAddr net.Addr) *http.Transport {
+// DefaultKeepAlive is the TCP keep-alive probe interval of dialed connections.
+const DefaultKeepAlive = 30 * time.Second
+
+// CreateDialer returns the dialer of upstream connections, probing idle
+// ones every keepAlive, DefaultKeepAlive when 0 and disabled when negative.
+func CreateDialer(localAddr net.Addr, keepAlive time.Duration) *net.Dialer {
+	if keepAlive == 0 {
+		keepAlive = DefaultKeepAlive
+	}
 	dialer := &net.Dialer{
 		Timeout:   30 * time.Second,
-		KeepAlive: 30 * time.Second,
+		KeepAlive: keepAlive,
 		DualStack: true,
 	}
 	if localAddr != nil {
 		dialer.LocalAddr = localAddr
 	}
+	return dialer
+}
+
+func CreateHTTPTransport(localAddr net.Addr) *http.Transport {
+	dialer := CreateDialer(localAddr, DefaultKeepAlive)
 	return &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           dialer.DialContext,
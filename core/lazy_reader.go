@@ -0,0 +1,30 @@
+package core
+
+import "io"
+
+// LazyReader defers creating the underlying reader until the first Read,
+// so no work is done for a body nobody reads.
+type LazyReader struct {
+	New func() (io.Reader, error)
+
+	r   io.Reader
+	err error
+}
+
+// NewLazyReader returns a LazyReader creating its reader with fn.
+func NewLazyReader(fn func() (io.Reader, error)) *LazyReader {
+	return &LazyReader{New: fn}
+}
+
+// Read implements io.Reader.
+func (l *LazyReader) Read(p []byte) (int, error) {
+	if l.r == nil && l.err == nil {
+		if l.r, l.err = l.New(); l.r == nil && l.err == nil {
+			l.err = io.EOF
+		}
+	}
+	if l.err != nil {
+		return 0, l.err
+	}
+	return l.r.Read(p)
+}
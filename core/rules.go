@@ -0,0 +1,43 @@
+package core
+
+import (
+	"context"
+	"sync"
+)
+
+type matchedRulesKey struct{}
+
+// matchedRules collects the names of the rules a transaction matched.
+type matchedRules struct {
+	mu    sync.Mutex
+	names []string
+}
+
+// WithMatchedRules returns ctx recording the rules matched by MatchRule.
+func WithMatchedRules(ctx context.Context) context.Context {
+	return context.WithValue(ctx, matchedRulesKey{}, &matchedRules{})
+}
+
+// MatchRule records the rule name as matched by the transaction of ctx,
+// unnamed rules aren't.
+func MatchRule(ctx context.Context, name string) {
+	rules, ok := ctx.Value(matchedRulesKey{}).(*matchedRules)
+	if !ok || name == "" {
+		return
+	}
+	rules.mu.Lock()
+	rules.names = append(rules.names, name)
+	rules.mu.Unlock()
+}
+
+// MatchedRules returns the names of the rules matched by the transaction of
+// ctx, in the order they matched.
+func MatchedRules(ctx context.Context) []string {
+	rules, ok := ctx.Value(matchedRulesKey{}).(*matchedRules)
+	if !ok {
+		return nil
+	}
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+	return append([]string(nil), rules.names...)
+}
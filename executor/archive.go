@@ -0,0 +1,101 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+)
+
+const defaultArchiveTemplate = "{host}{path}.{time}"
+
+type ArchiveExecutor struct {
+	cfg config.ArchiveExecutor
+	log *zap.Logger
+}
+
+func newArchiveExecutor(ctx context.Context, cfg config.ArchiveExecutor) Executor {
+	if cfg.Template == "" {
+		cfg.Template = defaultArchiveTemplate
+	}
+	return &ArchiveExecutor{
+		cfg: cfg,
+		log: log.Logger("archive_executor"),
+	}
+}
+
+func (e *ArchiveExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+// ArchiveWriter returns a file receiving the raw response body of the
+// configured hosts, named by the template.
+func (e *ArchiveExecutor) ArchiveWriter(req *core.RequestHeader, resHeader *core.ResponseHeader) io.WriteCloser {
+	host := strings.ToLower(string(req.Host()))
+	if idx := strings.LastIndex(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	hit := len(e.cfg.Hosts) == 0
+	for _, h := range e.cfg.Hosts {
+		if h == host {
+			hit = true
+			break
+		}
+	}
+	if !hit {
+		return nil
+	}
+	uri := string(req.RequestURI())
+	if idx := strings.IndexByte(uri, '?'); idx > -1 {
+		uri = uri[:idx]
+	}
+	if strings.HasSuffix(uri, "/") {
+		uri += "index"
+	}
+	name := strings.NewReplacer(
+		"{host}", host,
+		"{path}", filepath.Clean("/"+uri),
+		"{time}", strconv.FormatInt(time.Now().UnixNano(), 10),
+	).Replace(e.cfg.Template)
+	dfile := filepath.Join(e.cfg.OutputPath, filepath.Clean("/"+name))
+	if err := os.MkdirAll(filepath.Dir(dfile), 0700); err != nil {
+		e.log.Error("can not mkdir", zap.String("dir", filepath.Dir(dfile)), zap.Error(err))
+		return nil
+	}
+	fhandler, err := os.Create(dfile)
+	if err != nil {
+		e.log.Error("can not create file", zap.String("file", dfile), zap.Error(err))
+		return nil
+	}
+	e.log.Debug("archive response", zap.String("file", dfile))
+	return &archiveFile{file: fhandler, log: e.log}
+}
+
+// archiveFile never fails a write, so a broken archive doesn't interrupt
+// the body streamed to the client.
+type archiveFile struct {
+	file *os.File
+	log  *zap.Logger
+	err  error
+}
+
+func (f *archiveFile) Write(b []byte) (int, error) {
+	if f.err == nil {
+		if _, f.err = f.file.Write(b); f.err != nil {
+			f.log.Error("can not write archive", zap.String("file", f.file.Name()), zap.Error(f.err))
+		}
+	}
+	return len(b), nil
+}
+
+func (f *archiveFile) Close() error {
+	return f.file.Close()
+}
@@ -3,7 +3,7 @@ package executor
 import (
 	"context"
 	"io"
-	"io/ioutil"
+	"net/http"
 
 	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/core"
@@ -15,6 +15,65 @@ type Executor interface {
 	Writer(*core.RequestHeader, *core.ResponseHeader) io.Writer
 }
 
+// BodyArchiver is implemented by executors which archive the raw response
+// body as it is streamed to the client, nil skips the transaction.
+type BodyArchiver interface {
+	ArchiveWriter(*core.RequestHeader, *core.ResponseHeader) io.WriteCloser
+}
+
+// BodyConsumer is implemented by executors which handle the decoded
+// response body as a whole, the writer is closed once the body ended.
+type BodyConsumer interface {
+	ConsumeBody(*core.RequestHeader, *core.ResponseHeader) io.WriteCloser
+}
+
+// RequestBodyRewriter is implemented by executors which rewrite the request
+// body before it is forwarded, the returned body replaces the original.
+type RequestBodyRewriter interface {
+	RewriteRequestBody(req *core.RequestHeader, body []byte) []byte
+}
+
+// RequestRewriter is implemented by executors which rewrite the outbound
+// request before it is dispatched, req.URL carries the request host.
+type RequestRewriter interface {
+	RewriteRequest(req *http.Request)
+}
+
+// TransactionObserver is implemented by executors which look at the whole
+// transaction once it ended, its byte counts and timings included.
+type TransactionObserver interface {
+	ObserveTransaction(c *core.Context)
+}
+
+// ResponseHeaderRewriter is implemented by executors which rewrite the
+// response header, such as its status code, before it is sent to the client.
+type ResponseHeaderRewriter interface {
+	RewriteResponseHeader(req *core.RequestHeader, res *core.ResponseHeader)
+}
+
+// StreamFilter is implemented by executors which filter streamed response
+// bodies as they are relayed. The unit is a line, or an event terminated by
+// its blank line for server-sent events, delimiters included. The returned
+// bytes replace it, empty drops it.
+type StreamFilter interface {
+	FilterStream(req *core.RequestHeader, res *core.ResponseHeader, unit []byte) []byte
+}
+
+// Verdict is the outcome of a body scan.
+type Verdict int
+
+const (
+	VerdictAllow Verdict = iota
+	VerdictBlock
+)
+
+// Scanner is implemented by executors which scan the decoded response body
+// before it is delivered, VerdictBlock replaces the client response. The
+// body is streamed while it is downloaded and a scan error allows it.
+type Scanner interface {
+	Scan(ctx context.Context, contentType string, body io.Reader) (Verdict, error)
+}
+
 type Execute struct {
 	cfg       config.Executor
 	log       *zap.Logger
@@ -36,11 +95,67 @@ func NewExecutor(ctx context.Context, cfg config.Executor) *Execute {
 	if cfg.SourceMap.Enable {
 		e.executors = append(e.executors, newSourceMapExecutor(ctx, cfg.SourceMap))
 	}
+	if cfg.Rewrite.Enable {
+		e.executors = append(e.executors, newRewriteExecutor(ctx, cfg.Rewrite))
+	}
+	if cfg.Archive.Enable {
+		e.executors = append(e.executors, newArchiveExecutor(ctx, cfg.Archive))
+	}
+	if cfg.Prefetch.Enable {
+		e.executors = append(e.executors, newPrefetchExecutor(ctx, cfg.Prefetch))
+	}
+	if cfg.Recorder.Enable {
+		e.executors = append(e.executors, newRecorderExecutor(ctx, cfg.Recorder))
+	}
 	return e
 }
 
+// Recorder returns the recorder executor, nil when it isn't enabled.
+func (e *Execute) Recorder() *RecorderExecutor {
+	for _, executor := range e.executors {
+		if recorder, ok := executor.(*RecorderExecutor); ok {
+			return recorder
+		}
+	}
+	return nil
+}
+
+// Register appends an executor, executors run in registration order.
+func (e *Execute) Register(executor Executor) {
+	e.executors = append(e.executors, executor)
+}
+
+// RewriteRequest runs the request rewriters in order.
+func (e *Execute) RewriteRequest(req *http.Request) {
+	for _, executor := range e.executors {
+		if rewriter, ok := executor.(RequestRewriter); ok {
+			rewriter.RewriteRequest(req)
+		}
+	}
+}
+
+// RewriteResponseHeader runs the response header rewriters in order.
+func (e *Execute) RewriteResponseHeader(req *core.RequestHeader, res *core.ResponseHeader) {
+	for _, executor := range e.executors {
+		if rewriter, ok := executor.(ResponseHeaderRewriter); ok {
+			rewriter.RewriteResponseHeader(req, res)
+		}
+	}
+}
+
+// ObserveTransaction hands the ended transaction to the observers in order.
+func (e *Execute) ObserveTransaction(c *core.Context) {
+	for _, executor := range e.executors {
+		if observer, ok := executor.(TransactionObserver); ok {
+			observer.ObserveTransaction(c)
+		}
+	}
+}
+
+// Writer returns the writers of the executors handling the response body,
+// none means the body needn't be decoded at all.
 func (e *Execute) Writer(req *core.RequestHeader, res *core.ResponseHeader) []io.Writer {
-	writers := []io.Writer{ioutil.Discard}
+	writers := []io.Writer{}
 	for _, executor := range e.executors {
 		if writer := executor.Writer(req, res); writer != nil {
 			writers = append(writers, writer)
@@ -48,3 +163,84 @@ func (e *Execute) Writer(req *core.RequestHeader, res *core.ResponseHeader) []io
 	}
 	return writers
 }
+
+// BodyConsumers returns the body consumers opted in for the transaction.
+func (e *Execute) BodyConsumers(req *core.RequestHeader, res *core.ResponseHeader) []io.WriteCloser {
+	writers := []io.WriteCloser{}
+	for _, executor := range e.executors {
+		if consumer, ok := executor.(BodyConsumer); ok {
+			if writer := consumer.ConsumeBody(req, res); writer != nil {
+				writers = append(writers, writer)
+			}
+		}
+	}
+	return writers
+}
+
+// ArchiveWriters returns the archive writers opted in for the transaction.
+func (e *Execute) ArchiveWriters(req *core.RequestHeader, res *core.ResponseHeader) []io.WriteCloser {
+	writers := []io.WriteCloser{}
+	for _, executor := range e.executors {
+		if archiver, ok := executor.(BodyArchiver); ok {
+			if writer := archiver.ArchiveWriter(req, res); writer != nil {
+				writers = append(writers, writer)
+			}
+		}
+	}
+	return writers
+}
+
+// HasRequestBodyRewriters reports whether any executor rewrites request
+// bodies, so the proxy only buffers bodies when needed.
+func (e *Execute) HasRequestBodyRewriters() bool {
+	for _, executor := range e.executors {
+		if _, ok := executor.(RequestBodyRewriter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RewriteRequestBody runs the request body rewriters in order.
+func (e *Execute) RewriteRequestBody(req *core.RequestHeader, body []byte) []byte {
+	for _, executor := range e.executors {
+		if rewriter, ok := executor.(RequestBodyRewriter); ok {
+			body = rewriter.RewriteRequestBody(req, body)
+		}
+	}
+	return body
+}
+
+// HasStreamFilters reports whether any executor filters streamed bodies.
+func (e *Execute) HasStreamFilters() bool {
+	for _, executor := range e.executors {
+		if _, ok := executor.(StreamFilter); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStream runs the stream filters in order, a dropped unit isn't
+// passed on.
+func (e *Execute) FilterStream(req *core.RequestHeader, res *core.ResponseHeader, unit []byte) []byte {
+	for _, executor := range e.executors {
+		if filter, ok := executor.(StreamFilter); ok {
+			if unit = filter.FilterStream(req, res, unit); len(unit) == 0 {
+				return nil
+			}
+		}
+	}
+	return unit
+}
+
+// Scanners returns the executors scanning response bodies.
+func (e *Execute) Scanners() []Scanner {
+	scanners := []Scanner{}
+	for _, executor := range e.executors {
+		if scanner, ok := executor.(Scanner); ok {
+			scanners = append(scanners, scanner)
+		}
+	}
+	return scanners
+}
@@ -0,0 +1,216 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+	"golang.org/x/net/html"
+)
+
+// PrefetchUserAgent marks the prefetch requests, their responses aren't
+// prefetched from again.
+const PrefetchUserAgent = "httpctl-prefetch"
+
+const (
+	defaultPrefetchRate     = 5
+	defaultPrefetchMaxLinks = 16
+	defaultPrefetchMaxBytes = 1 << 20
+	prefetchQueueSize       = 64
+)
+
+// PrefetchExecutor warms linked resources of HTML pages, the preloaded
+// links and scripts are fetched in the background through the proxy.
+type PrefetchExecutor struct {
+	cfg    config.PrefetchExecutor
+	log    *zap.Logger
+	proxy  *url.URL
+	client *http.Client
+	queue  chan *url.URL
+}
+
+func newPrefetchExecutor(ctx context.Context, cfg config.PrefetchExecutor) Executor {
+	if cfg.Rate <= 0 {
+		cfg.Rate = defaultPrefetchRate
+	}
+	if cfg.MaxLinks <= 0 {
+		cfg.MaxLinks = defaultPrefetchMaxLinks
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = defaultPrefetchMaxBytes
+	}
+	e := &PrefetchExecutor{
+		cfg:    cfg,
+		log:    log.Logger("prefetch_executor"),
+		client: &http.Client{Timeout: time.Minute},
+		queue:  make(chan *url.URL, prefetchQueueSize),
+	}
+	proxy, err := url.Parse(cfg.Proxy)
+	if err != nil || proxy.Host == "" {
+		e.log.Error("invalid prefetch proxy", zap.String("proxy", cfg.Proxy), zap.Error(err))
+	} else {
+		e.proxy = proxy
+		go e.run(ctx)
+	}
+	return e
+}
+
+func (e *PrefetchExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+// ConsumeBody collects the HTML page of the configured hosts, its links are
+// queued once the body ended.
+func (e *PrefetchExecutor) ConsumeBody(req *core.RequestHeader, resHeader *core.ResponseHeader) io.WriteCloser {
+	if e.proxy == nil || string(req.UserAgent()) == PrefetchUserAgent || !req.IsGet() ||
+		resHeader.StatusCode() != http.StatusOK || !bytes.HasPrefix(resHeader.ContentType(), []byte("text/html")) {
+		return nil
+	}
+	host := strings.ToLower(string(req.Host()))
+	if idx := strings.LastIndex(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	hit := len(e.cfg.Hosts) == 0
+	for _, h := range e.cfg.Hosts {
+		if h == host {
+			hit = true
+			break
+		}
+	}
+	if !hit {
+		return nil
+	}
+	scheme := "http"
+	if req.GetHTTPS() {
+		scheme = "https"
+	}
+	page, err := url.Parse(scheme + "://" + string(req.Host()) + string(req.RequestURI()))
+	if err != nil {
+		return nil
+	}
+	return &prefetchPage{e: e, page: page}
+}
+
+// prefetchPage buffers the page up to the byte limit.
+type prefetchPage struct {
+	e    *PrefetchExecutor
+	page *url.URL
+	buf  bytes.Buffer
+}
+
+func (p *prefetchPage) Write(b []byte) (int, error) {
+	if rest := p.e.cfg.MaxBytes - int64(p.buf.Len()); rest > 0 {
+		if int64(len(b)) > rest {
+			p.buf.Write(b[:rest])
+		} else {
+			p.buf.Write(b)
+		}
+	}
+	return len(b), nil
+}
+
+func (p *prefetchPage) Close() error {
+	for _, link := range prefetchLinks(p.page, &p.buf, p.e.cfg.MaxLinks) {
+		select {
+		case p.e.queue <- link:
+		default:
+			p.e.log.Debug("prefetch queue full, dropped", zap.String("url", link.String()))
+		}
+	}
+	return nil
+}
+
+// prefetchLinks returns the preloaded links and script sources of the page,
+// resolved against its URL.
+func prefetchLinks(page *url.URL, body io.Reader, max int) []*url.URL {
+	links := []*url.URL{}
+	seen := map[string]bool{}
+	z := html.NewTokenizer(body)
+	for len(links) < max {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken {
+			continue
+		}
+		name, hasAttr := z.TagName()
+		attrs := map[string]string{}
+		for hasAttr {
+			var key, val []byte
+			key, val, hasAttr = z.TagAttr()
+			attrs[string(key)] = string(val)
+		}
+		var ref string
+		switch string(name) {
+		case "link":
+			for _, rel := range strings.Fields(strings.ToLower(attrs["rel"])) {
+				if rel == "preload" || rel == "modulepreload" {
+					ref = attrs["href"]
+				}
+			}
+		case "script":
+			ref = attrs["src"]
+		}
+		if ref == "" {
+			continue
+		}
+		link, err := page.Parse(ref)
+		if err != nil || (link.Scheme != "http" && link.Scheme != "https") || seen[link.String()] {
+			continue
+		}
+		seen[link.String()] = true
+		links = append(links, link)
+	}
+	return links
+}
+
+// run fetches the queued links at the configured rate.
+func (e *PrefetchExecutor) run(ctx context.Context) {
+	ticker := time.NewTicker(time.Second / time.Duration(e.cfg.Rate))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case link := <-e.queue:
+			e.fetch(ctx, link)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// fetch requests link from the proxy listener, the listener decides the
+// upstream scheme.
+func (e *PrefetchExecutor) fetch(ctx context.Context, link *url.URL) {
+	target := *e.proxy
+	target.Path, target.RawPath, target.RawQuery = link.Path, link.RawPath, link.RawQuery
+	req, err := http.NewRequest(http.MethodGet, target.String(), nil)
+	if err != nil {
+		return
+	}
+	req = req.WithContext(ctx)
+	req.Host = link.Host
+	req.Header.Set("User-Agent", PrefetchUserAgent)
+	res, err := e.client.Do(req)
+	if err != nil {
+		e.log.Warn("prefetch", zap.String("url", link.String()), zap.Error(err))
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+	e.log.Debug("prefetched", zap.String("url", link.String()), zap.Int("status", res.StatusCode))
+}
@@ -0,0 +1,72 @@
+package executor
+
+import (
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"regexp"
+
+	"github.com/millken/httpctl/config"
+)
+
+// queryMatcher matches one query parameter of a rule.
+type queryMatcher struct {
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+func compileQueryMatchers(matches []config.QueryMatch) ([]queryMatcher, error) {
+	matchers := make([]queryMatcher, 0, len(matches))
+	for _, match := range matches {
+		matcher := queryMatcher{name: match.Name, value: match.Value}
+		if match.Regex != "" {
+			re, err := regexp.Compile(match.Regex)
+			if err != nil {
+				return nil, err
+			}
+			matcher.re = re
+		}
+		matchers = append(matchers, matcher)
+	}
+	return matchers, nil
+}
+
+// compileHeaderMatchers compiles matches of request header fields, their
+// names are canonicalized as net/http keys them.
+func compileHeaderMatchers(matches []config.QueryMatch) ([]queryMatcher, error) {
+	matchers, err := compileQueryMatchers(matches)
+	for i := range matchers {
+		matchers[i].name = textproto.CanonicalMIMEHeaderKey(matchers[i].name)
+	}
+	return matchers, err
+}
+
+// matchHeader returns true if every matcher matches a value of its field.
+func matchHeader(matchers []queryMatcher, header http.Header) bool {
+	return matchQuery(matchers, url.Values(header))
+}
+
+// matchQuery returns true if every matcher matches a value of its parameter.
+func matchQuery(matchers []queryMatcher, query url.Values) bool {
+	for _, matcher := range matchers {
+		values, found := query[matcher.name]
+		if !found {
+			return false
+		}
+		if matcher.value == "" && matcher.re == nil {
+			continue
+		}
+		matched := false
+		for _, value := range values {
+			if (matcher.value == "" || value == matcher.value) && (matcher.re == nil || matcher.re.MatchString(value)) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
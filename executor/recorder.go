@@ -0,0 +1,179 @@
+package executor
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultRecorderMaxEntries   = 1000
+	defaultRecorderMaxBodyBytes = 1 << 20
+)
+
+// RecordedTransaction is a transaction kept by the recorder.
+type RecordedTransaction struct {
+	Time        time.Time
+	Method      string
+	URL         string
+	Status      int
+	ContentType string
+	Body        []byte
+	// Truncated is set when the body exceeded the recorder limit.
+	Truncated bool
+}
+
+// RecorderExecutor keeps the latest transactions in memory, their bodies
+// optionally gzip compressed until exported.
+type RecorderExecutor struct {
+	cfg config.RecorderExecutor
+	log *zap.Logger
+
+	mu      sync.Mutex
+	entries []*recordedEntry
+}
+
+// recordedEntry holds the transaction body as stored, compressed or not.
+type recordedEntry struct {
+	tx         RecordedTransaction
+	compressed bool
+}
+
+func newRecorderExecutor(ctx context.Context, cfg config.RecorderExecutor) Executor {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultRecorderMaxEntries
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultRecorderMaxBodyBytes
+	}
+	return &RecorderExecutor{
+		cfg: cfg,
+		log: log.Logger("recorder_executor"),
+	}
+}
+
+func (e *RecorderExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+// ConsumeBody records the transaction of the configured hosts once its
+// decoded body ended.
+func (e *RecorderExecutor) ConsumeBody(req *core.RequestHeader, resHeader *core.ResponseHeader) io.WriteCloser {
+	host := strings.ToLower(string(req.Host()))
+	if idx := strings.LastIndex(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	hit := len(e.cfg.Hosts) == 0
+	for _, h := range e.cfg.Hosts {
+		if h == host {
+			hit = true
+			break
+		}
+	}
+	if !hit {
+		return nil
+	}
+	scheme := "http://"
+	if req.GetHTTPS() {
+		scheme = "https://"
+	}
+	r := &recording{
+		e: e,
+		entry: &recordedEntry{
+			tx: RecordedTransaction{
+				Time:        time.Now(),
+				Method:      string(req.Method()),
+				URL:         scheme + string(req.Host()) + string(req.RequestURI()),
+				Status:      resHeader.StatusCode(),
+				ContentType: string(resHeader.ContentType()),
+			},
+			compressed: e.cfg.Compress,
+		},
+	}
+	r.w = &r.buf
+	if e.cfg.Compress {
+		r.zw = gzip.NewWriter(&r.buf)
+		r.w = r.zw
+	}
+	return r
+}
+
+type recording struct {
+	e     *RecorderExecutor
+	entry *recordedEntry
+	buf   bytes.Buffer
+	zw    *gzip.Writer
+	w     io.Writer
+	n     int64
+}
+
+func (r *recording) Write(b []byte) (int, error) {
+	size := len(b)
+	if rest := r.e.cfg.MaxBodyBytes - r.n; int64(len(b)) > rest {
+		b = b[:rest]
+		r.entry.tx.Truncated = true
+	}
+	r.n += int64(len(b))
+	r.w.Write(b)
+	return size, nil
+}
+
+func (r *recording) Close() error {
+	if r.zw != nil {
+		r.zw.Close()
+	}
+	r.entry.tx.Body = r.buf.Bytes()
+	r.e.mu.Lock()
+	r.e.entries = append(r.e.entries, r.entry)
+	if over := len(r.e.entries) - r.e.cfg.MaxEntries; over > 0 {
+		r.e.entries = append(r.e.entries[:0], r.e.entries[over:]...)
+	}
+	r.e.mu.Unlock()
+	return nil
+}
+
+// Size returns the bytes held by the recorded bodies.
+func (e *RecorderExecutor) Size() int64 {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var size int64
+	for _, entry := range e.entries {
+		size += int64(len(entry.tx.Body))
+	}
+	return size
+}
+
+// Export returns the recorded transactions oldest first, compressed bodies
+// are decompressed.
+func (e *RecorderExecutor) Export() []RecordedTransaction {
+	e.mu.Lock()
+	entries := append([]*recordedEntry(nil), e.entries...)
+	e.mu.Unlock()
+
+	txs := make([]RecordedTransaction, 0, len(entries))
+	for _, entry := range entries {
+		tx := entry.tx
+		if entry.compressed {
+			zr, err := gzip.NewReader(bytes.NewReader(tx.Body))
+			if err == nil {
+				tx.Body, err = ioutil.ReadAll(zr)
+			}
+			if err != nil {
+				e.log.Error("decompress recorded body", zap.String("url", tx.URL), zap.Error(err))
+				tx.Body = nil
+			}
+		}
+		txs = append(txs, tx)
+	}
+	return txs
+}
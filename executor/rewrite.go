@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+)
+
+type RewriteExecutor struct {
+	cfg config.RewriteExecutor
+	log *zap.Logger
+	// queries are the query matchers of each rule, nil for rules whose
+	// regex doesn't compile, which never match
+	queries [][]queryMatcher
+	// headers are the request header matchers of each rule, likewise
+	headers [][]queryMatcher
+}
+
+func newRewriteExecutor(ctx context.Context, cfg config.RewriteExecutor) Executor {
+	// rule hosts are compared with lowercased request hosts
+	cfg.Rules = append([]config.RewriteRule(nil), cfg.Rules...)
+	for i := range cfg.Rules {
+		cfg.Rules[i].Host = strings.ToLower(cfg.Rules[i].Host)
+	}
+	e := &RewriteExecutor{
+		cfg: cfg,
+		log: log.Logger("rewrite_executor"),
+	}
+	for _, rule := range cfg.Rules {
+		matchers, err := compileQueryMatchers(rule.Query)
+		if err != nil {
+			e.log.Error("rewrite rule query", zap.String("host", rule.Host), zap.String("path", rule.Path), zap.Error(err))
+		}
+		e.queries = append(e.queries, matchers)
+		headers, err := compileHeaderMatchers(rule.Header)
+		if err != nil {
+			e.log.Error("rewrite rule header", zap.String("host", rule.Host), zap.String("path", rule.Path), zap.Error(err))
+		}
+		e.headers = append(e.headers, headers)
+	}
+	return e
+}
+
+func (e *RewriteExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+// RewriteRequest applies the first rule matching the request host, path
+// prefix, query parameters and header fields, an empty rule host or path
+// matches any.
+func (e *RewriteExecutor) RewriteRequest(req *http.Request) {
+	host := strings.ToLower(req.URL.Hostname())
+	query := req.URL.Query()
+	for i, rule := range e.cfg.Rules {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(req.URL.Path, rule.Path) {
+			continue
+		}
+		if e.queries[i] == nil || !matchQuery(e.queries[i], query) {
+			continue
+		}
+		if e.headers[i] == nil || !matchHeader(e.headers[i], req.Header) {
+			continue
+		}
+		from := req.URL.Host + req.URL.Path
+		if rule.ToHost != "" {
+			if _, _, err := net.SplitHostPort(rule.ToHost); err != nil && req.URL.Port() != "" {
+				req.URL.Host = net.JoinHostPort(rule.ToHost, req.URL.Port())
+			} else {
+				req.URL.Host = rule.ToHost
+			}
+		}
+		if rule.ToPath != "" {
+			req.URL.Path = rule.ToPath + strings.TrimPrefix(req.URL.Path, rule.Path)
+			req.URL.RawPath = ""
+		}
+		if len(rule.SetQuery) > 0 || len(rule.DelQuery) > 0 {
+			for _, name := range rule.DelQuery {
+				query.Del(name)
+			}
+			for name, value := range rule.SetQuery {
+				query.Set(name, value)
+			}
+			req.URL.RawQuery = query.Encode()
+		}
+		core.MatchRule(req.Context(), rule.Name)
+		e.log.Debug("rewrite request", zap.String("from", from), zap.String("to", req.URL.Host+req.URL.Path))
+		return
+	}
+}
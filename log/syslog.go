@@ -0,0 +1,173 @@
+package log
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pkg/errors"
+)
+
+// Facilities are the RFC 5424 syslog facilities by name.
+var facilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// severities are the RFC 5424 syslog severities by zap level name.
+var severities = map[string]int{
+	"fatal": 2, "panic": 2, "dpanic": 2, "error": 3, "warn": 4, "info": 6, "debug": 7,
+}
+
+func init() {
+	for _, scheme := range []string{"syslog", "syslog+udp", "syslog+tcp"} {
+		if err := zap.RegisterSink(scheme, newSyslogSink); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// syslogSink sends every log entry as a RFC 5424 message, so zap output
+// paths like "syslog+udp://127.0.0.1:514?facility=local0&tag=httpctl" or
+// "syslog:///dev/log" ship a log to syslog. Entries carry the severity of
+// their level, read from the json or console encoding, those without one
+// the severity of the "severity" parameter, info by default. TCP messages
+// are octet counted as of RFC 6587.
+type syslogSink struct {
+	network, addr      string
+	facility, severity int
+	hostname, tag      string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newSyslogSink(u *url.URL) (zap.Sink, error) {
+	s := &syslogSink{tag: filepath.Base(os.Args[0])}
+	switch u.Scheme {
+	case "syslog":
+		s.network, s.addr = "unixgram", u.Path
+		if s.addr == "" {
+			s.addr = "/dev/log"
+		}
+	case "syslog+udp":
+		s.network, s.addr = "udp", u.Host
+	case "syslog+tcp":
+		s.network, s.addr = "tcp", u.Host
+	}
+	query := u.Query()
+	facility, severity := facilities["user"], severities["info"]
+	if name := query.Get("facility"); name != "" {
+		var found bool
+		if facility, found = facilities[strings.ToLower(name)]; !found {
+			return nil, errors.Errorf("unknown syslog facility %q", name)
+		}
+	}
+	if name := query.Get("severity"); name != "" {
+		var found bool
+		if severity, found = severities[strings.ToLower(name)]; !found {
+			return nil, errors.Errorf("unknown syslog severity %q", name)
+		}
+	}
+	s.facility, s.severity = facility, severity
+	if tag := query.Get("tag"); tag != "" {
+		s.tag = tag
+	}
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to dial syslog")
+	}
+	s.conn = conn
+	return s, nil
+}
+
+// Write sends p, one encoded entry, as one message, redialing a broken
+// connection once.
+func (s *syslogSink) Write(p []byte) (int, error) {
+	msg := strings.TrimRight(string(p), "\n")
+	severity, found := entrySeverity(msg)
+	if !found {
+		severity = s.severity
+	}
+	frame := fmt.Sprintf("<%d>1 %s %s %s %d - - %s", s.facility*8+severity,
+		time.Now().Format(time.RFC3339Nano), s.hostname, s.tag, os.Getpid(), msg)
+	if s.network == "tcp" {
+		frame = strconv.Itoa(len(frame)) + " " + frame
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != nil {
+		if _, err := s.conn.Write([]byte(frame)); err == nil {
+			return len(p), nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	conn, err := net.Dial(s.network, s.addr)
+	if err != nil {
+		return 0, err
+	}
+	s.conn = conn
+	if _, err := conn.Write([]byte(frame)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// entrySeverity returns the severity of the level of an encoded entry, the
+// "level" field of a json entry, one of the first two tab separated fields
+// of a console one.
+func entrySeverity(msg string) (int, bool) {
+	if strings.HasPrefix(msg, "{") {
+		const key = `"level":"`
+		i := strings.Index(msg, key)
+		if i < 0 {
+			return 0, false
+		}
+		level := msg[i+len(key):]
+		if j := strings.IndexByte(level, '"'); j >= 0 {
+			severity, found := severities[strings.ToLower(level[:j])]
+			return severity, found
+		}
+		return 0, false
+	}
+	fields := strings.SplitN(msg, "\t", 3)
+	if len(fields) > 2 {
+		fields = fields[:2]
+	}
+	for _, field := range fields {
+		if severity, found := severities[strings.ToLower(field)]; found {
+			return severity, true
+		}
+	}
+	return 0, false
+}
+
+func (s *syslogSink) Sync() error {
+	return nil
+}
+
+func (s *syslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
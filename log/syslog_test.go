@@ -0,0 +1,189 @@
+package log
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func newTestSink(t *testing.T, rawurl string) *syslogSink {
+	u, err := url.Parse(rawurl)
+	require.NoError(t, err)
+	sink, err := newSyslogSink(u)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	return sink.(*syslogSink)
+}
+
+// readFrame reads a RFC 6587 octet counted frame.
+func readFrame(r *bufio.Reader) (string, error) {
+	length, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(length, " "))
+	if err != nil {
+		return "", err
+	}
+	frame := make([]byte, n)
+	_, err = io.ReadFull(r, frame)
+	return string(frame), err
+}
+
+func TestSyslogSink_TCPFraming(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	conns := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conns <- conn
+		}
+	}()
+
+	sink := newTestSink(t, "syslog+tcp://"+ln.Addr().String()+"?facility=local1&tag=test")
+	// entries with newlines in them stay one frame each
+	_, err = sink.Write([]byte(`{"level":"info","msg":"first` + "\n" + `line"}` + "\n"))
+	require.NoError(err)
+	_, err = sink.Write([]byte(`{"level":"info","msg":"second"}` + "\n"))
+	require.NoError(err)
+
+	conn := <-conns
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	frame, err := readFrame(r)
+	require.NoError(err)
+	// <local1.info>
+	require.Regexp(`^<142>1 \S+ \S+ test \d+ - - \{"level":"info","msg":"first\nline"\}$`, frame)
+	frame, err = readFrame(r)
+	require.NoError(err)
+	require.Regexp(`^<142>1 .* - - \{"level":"info","msg":"second"\}$`, frame)
+}
+
+func TestSyslogSink_Unixgram(t *testing.T) {
+	require := require.New(t)
+	dir, err := ioutil.TempDir("", "syslog")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log.sock")
+	pc, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(err)
+	defer pc.Close()
+
+	sink := newTestSink(t, "syslog://"+path)
+	_, err = sink.Write([]byte("plain message\n"))
+	require.NoError(err)
+
+	buf := make([]byte, 4096)
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := pc.Read(buf)
+	require.NoError(err)
+	// <user.info>, datagrams aren't octet counted
+	require.Regexp(`^<14>1 \S+ \S+ \S+ \d+ - - plain message$`, string(buf[:n]))
+}
+
+func TestSyslogSink_UnknownNames(t *testing.T) {
+	require := require.New(t)
+	for query, msg := range map[string]string{
+		"facility=local9": `unknown syslog facility "local9"`,
+		"severity=loud":   `unknown syslog severity "loud"`,
+	} {
+		u, err := url.Parse("syslog+udp://127.0.0.1:514?" + query)
+		require.NoError(err)
+		_, err = newSyslogSink(u)
+		require.EqualError(err, msg)
+	}
+}
+
+func TestSyslogSink_EntrySeverity(t *testing.T) {
+	require := require.New(t)
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer pc.Close()
+	read := func() string {
+		buf := make([]byte, 4096)
+		pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := pc.ReadFrom(buf)
+		require.NoError(err)
+		return string(buf[:n])
+	}
+
+	for _, encoding := range []string{"json", "console"} {
+		zapCfg := zap.NewProductionConfig()
+		zapCfg.Encoding = encoding
+		zapCfg.OutputPaths = []string{"syslog+udp://" + pc.LocalAddr().String() + "?facility=local0&severity=debug"}
+		logger, err := zapCfg.Build()
+		require.NoError(err)
+		logger.Error("broken")
+		logger.Warn("careful")
+		logger.Info("fine")
+		// local0 is 16, the severities of error, warn and info are 3, 4 and 6
+		require.True(strings.HasPrefix(read(), "<131>1 "), encoding)
+		require.True(strings.HasPrefix(read(), "<132>1 "), encoding)
+		require.True(strings.HasPrefix(read(), "<134>1 "), encoding)
+		logger.Sync()
+	}
+
+	// entries without a level get the severity parameter
+	sink := newTestSink(t, "syslog+udp://"+pc.LocalAddr().String()+"?severity=warn")
+	_, err = sink.Write([]byte("no level\n"))
+	require.NoError(err)
+	require.True(strings.HasPrefix(read(), "<12>1 "))
+}
+
+func TestSyslogSink_Redial(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	conns := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+		}
+	}()
+
+	sink := newTestSink(t, "syslog+tcp://"+ln.Addr().String())
+	// the server hangs up, writes fail once the peer resets and redial
+	(<-conns).Close()
+	var second net.Conn
+	require.Eventually(func() bool {
+		sink.Write([]byte("again\n"))
+		select {
+		case second = <-conns:
+			return true
+		default:
+			return false
+		}
+	}, 5*time.Second, 10*time.Millisecond)
+	defer second.Close()
+
+	_, err = sink.Write([]byte("after redial\n"))
+	require.NoError(err)
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(second)
+	for {
+		frame, err := readFrame(r)
+		require.NoError(err)
+		if strings.HasSuffix(frame, " - - after redial") {
+			break
+		}
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 
 	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/executor"
@@ -41,16 +44,65 @@ func main() {
 	ctx := context.Background()
 	execute := executor.NewExecutor(ctx, cfg.Executor)
 
-	var proxyer proxy.Proxy
 	resolvers := resolver.NewResolver(cfg.Server.Resolver)
-	proxyer = proxy.NewHttpProxy(resolvers, execute)
+	if len(cfg.Server.Dns.Servers) > 0 {
+		resolvers.SetServers(cfg.Server.Dns.Servers)
+	}
+	if cfg.Server.Dns.NegativeTTL > 0 {
+		resolvers.SetNegativeTTL(cfg.Server.Dns.NegativeTTL)
+	}
+	if cfg.Server.Dns.Retries > 0 {
+		resolvers.SetRetry(cfg.Server.Dns.Retries, cfg.Server.Dns.RetryBackoff)
+	}
+	if cfg.Server.Dns.LookupTimeout > 0 {
+		resolvers.SetLookupTimeout(cfg.Server.Dns.LookupTimeout)
+	}
+	proxyer, err := proxy.NewHttpProxy(cfg.Server.Proxy, resolvers, execute)
+	if err != nil {
+		log.L().Fatal("Failed to create proxy: ", zap.Error(err))
+	}
+
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if reloaded, err := config.New(configPath); err != nil {
+				log.L().Error("Failed to reload config: ", zap.Error(err))
+			} else {
+				proxyer.SetUpstreamWeights(reloaded.Server.Proxy.UpstreamSelection)
+			}
+			if err := proxyer.ReloadCertificates(); err != nil {
+				log.L().Error("Failed to reload certificates: ", zap.Error(err))
+				continue
+			}
+			log.L().Info("reloaded certificates")
+		}
+	}()
+
+	if cfg.Server.Admin.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/config", config.Handler(cfg))
+		log.RegisterLevelConfigMux(mux)
+		if cfg.Server.Proxy.UpstreamMetrics.Enable {
+			mux.Handle("/metrics", proxyer.MetricsHandler())
+		}
+		go func() {
+			if err := http.ListenAndServe(cfg.Server.Admin.Listen, mux); err != nil {
+				log.L().Error("Failed to bind on the given interface (admin): ", zap.Error(err))
+			}
+		}()
+	}
+
+	// SIGINT and SIGTERM drain the connections, see DrainTimeout
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 
 	var wg sync.WaitGroup
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := proxyer.ListenAndServe(cfg.Server.Http.Listen); err != nil {
+		if err := proxyer.ListenAndServeAll(append([]string{cfg.Server.Http.Listen}, cfg.Server.Http.Listens...)...); err != nil && err != http.ErrServerClosed {
 			log.L().Fatal("Failed to bind on the given interface (HTTP): ", zap.Error(err))
 		}
 
@@ -59,11 +111,36 @@ func main() {
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := proxyer.ListenAndServeTLS(cfg.Server.Https.Listen, cfg.Server.Https.CertFile, cfg.Server.Https.KeyFile); err != nil {
+		if cfg.Server.Https.Mitm.Enable {
+			certs, err := proxy.NewCertGenerator(caCert, caKey)
+			if err != nil {
+				log.L().Fatal("Failed to load mitm ca: ", zap.Error(err))
+			}
+			certs.SetWildcardDomains(cfg.Server.Https.Mitm.WildcardDomains)
+			if err := proxyer.ListenAndServeMITM(cfg.Server.Https.Listen, certs); err != nil && err != http.ErrServerClosed {
+				log.L().Fatal("Failed to bind on the given interface (HTTPS): ", zap.Error(err))
+			}
+			return
+		}
+		if err := proxyer.ListenAndServeTLS(cfg.Server.Https.Listen, cfg.Server.Https.CertFile, cfg.Server.Https.KeyFile); err != nil && err != http.ErrServerClosed {
 			log.L().Fatal("Failed to bind on the given interface (HTTPS): ", zap.Error(err))
 		}
 	}()
 
-	wg.Wait()
+	if cfg.Server.Mux.Listen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := proxyer.ListenAndServeMux(cfg.Server.Mux.Listen, cfg.Server.Https.CertFile, cfg.Server.Https.KeyFile); err != nil && err != http.ErrServerClosed {
+				log.L().Fatal("Failed to bind on the given interface (mux): ", zap.Error(err))
+			}
+		}()
+	}
 
+	sig := <-stop
+	log.L().Info("shutting down", zap.String("signal", sig.String()))
+	if err := proxyer.Shutdown(ctx); err != nil {
+		log.L().Error("Failed to shut down: ", zap.Error(err))
+	}
+	wg.Wait()
 }
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// statusWriter records the status and the number of body bytes written to
+// the client for the access log.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+	// tunnel is set for CONNECT tunnels, up counts the bytes relayed from
+	// the client, bytes those relayed to it
+	tunnel bool
+	up     int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	// informational responses precede the one logged
+	if w.status == 0 && status >= 200 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	atomic.AddInt64(&w.bytes, int64(n))
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hijacker.Hijack()
+}
+
+func (w *statusWriter) tunneled(up, down int64) {
+	w.status = http.StatusOK
+	w.tunnel = true
+	atomic.StoreInt64(&w.up, up)
+	atomic.StoreInt64(&w.bytes, down)
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (p *HttpProxy) logAccess(w *statusWriter, r *http.Request, start time.Time) {
+	fields := []zap.Field{
+		zap.String("remote", r.RemoteAddr),
+		zap.String("client", p.clientIP(r)),
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.String("uri", r.RequestURI),
+		zap.Int("status", w.status),
+		zap.Int64("bytes", atomic.LoadInt64(&w.bytes)),
+		zap.Duration("duration", time.Since(start)),
+	}
+	if rules := core.MatchedRules(r.Context()); len(rules) > 0 {
+		fields = append(fields, zap.Strings("rules", rules))
+	}
+	// the language the client asked for, not the one forced upstream
+	if p.cfg.AcceptLanguage != "" {
+		fields = append(fields, zap.String("accept_language", r.Header.Get("Accept-Language")))
+	}
+	if w.tunnel {
+		fields = append(fields, zap.Int64("bytes_up", atomic.LoadInt64(&w.up)))
+	}
+	p.accessLog.Info("access", fields...)
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo describes an in-flight proxied request.
+type ConnInfo struct {
+	ID         uint64
+	Method     string
+	Host       string
+	URI        string
+	RemoteAddr string
+	Start      time.Time
+	// Bytes is the number of body bytes sent to the client so far.
+	Bytes int64
+}
+
+type activeConn struct {
+	info ConnInfo
+	w    *statusWriter
+}
+
+// activeRegistry tracks in-flight requests, sync.Map keeps the add/remove
+// on every request free of a shared lock.
+type activeRegistry struct {
+	seq   uint64
+	conns sync.Map
+}
+
+func (a *activeRegistry) add(r *http.Request, w *statusWriter, start time.Time) uint64 {
+	id := atomic.AddUint64(&a.seq, 1)
+	a.conns.Store(id, &activeConn{
+		info: ConnInfo{
+			ID:         id,
+			Method:     r.Method,
+			Host:       r.Host,
+			URI:        r.RequestURI,
+			RemoteAddr: r.RemoteAddr,
+			Start:      start,
+		},
+		w: w,
+	})
+	return id
+}
+
+func (a *activeRegistry) remove(id uint64) {
+	a.conns.Delete(id)
+}
+
+// ActiveConnections returns the in-flight requests ordered by start time.
+func (p *HttpProxy) ActiveConnections() []ConnInfo {
+	infos := []ConnInfo{}
+	p.active.conns.Range(func(key, value interface{}) bool {
+		conn := value.(*activeConn)
+		info := conn.info
+		info.Bytes = atomic.LoadInt64(&conn.w.bytes)
+		infos = append(infos, info)
+		return true
+	})
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
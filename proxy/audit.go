@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// Audit reason codes of denied requests.
+const (
+	AuditACLDenied        = "acl_denied"
+	AuditHostBlocked      = "host_blocked"
+	AuditMethodNotAllowed = "method_not_allowed"
+	AuditScannerBlocked   = "scanner_blocked"
+	AuditRateLimited      = "rate_limited"
+	AuditJA3Blocked       = "ja3_blocked"
+	AuditAddrBlocked      = "addr_blocked"
+	AuditTunnelPort       = "tunnel_port_denied"
+)
+
+// audit records a denied request to the audit log, a sub logger named
+// "audit" writes it to its own sink.
+func (p *HttpProxy) audit(r *http.Request, reason, rule string) {
+	fields := []zap.Field{
+		zap.String("client", p.clientIP(r)),
+		zap.String("reason", reason),
+		zap.String("rule", rule),
+		zap.String("method", r.Method),
+		zap.String("target", r.Host+r.URL.RequestURI()),
+	}
+	if rules := core.MatchedRules(r.Context()); len(rules) > 0 {
+		fields = append(fields, zap.Strings("rules", rules))
+	}
+	p.auditLog.Warn("denied", fields...)
+}
+
+// clientDenied returns the rule denying the client, deny entries win and a
+// non empty allow list denies any client outside it.
+func (p *HttpProxy) clientDenied(r *http.Request) (string, bool) {
+	if len(p.aclAllow) == 0 && len(p.aclDeny) == 0 {
+		return "", false
+	}
+	ip := net.ParseIP(p.clientIP(r))
+	if ip == nil {
+		return "invalid client address", true
+	}
+	for _, ipnet := range p.aclDeny {
+		if ipnet.Contains(ip) {
+			return "deny " + ipnet.String(), true
+		}
+	}
+	if len(p.aclAllow) > 0 && !ipTrusted(p.aclAllow, ip) {
+		return "allow list", true
+	}
+	return "", false
+}
+
+// hostBlocked returns the blocklist entry matching the request host, an
+// entry matches the domain and its subdomains.
+func (p *HttpProxy) hostBlocked(r *http.Request) (string, bool) {
+	host := strings.ToLower(stripPort(r.Host))
+	for _, blocked := range p.cfg.BlockedHosts {
+		blocked = strings.ToLower(blocked)
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return blocked, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// certPinError fails an upstream handshake whose certificate matches none of
+// the pins of the host.
+type certPinError struct {
+	host string
+}
+
+func (e *certPinError) Error() string {
+	return fmt.Sprintf("certificate of %s matches no pinned public key", e.host)
+}
+
+// spkiHash returns the base64 SHA-256 of a certificate public key, the
+// pin format of RFC 7469.
+func spkiHash(rawSubjectPublicKeyInfo []byte) string {
+	sum := sha256.Sum256(rawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins returns the VerifyConnection of host, nil when it has no pins.
+// Any certificate of the presented chain may match, pins are given with or
+// without the "sha256/" prefix.
+func (p *HttpProxy) verifyPins(host string) func(tls.ConnectionState) error {
+	pins := p.cfg.CertPins[strings.ToLower(host)]
+	if len(pins) == 0 {
+		return nil
+	}
+	return func(state tls.ConnectionState) error {
+		for _, cert := range state.PeerCertificates {
+			hash := spkiHash(cert.RawSubjectPublicKeyInfo)
+			for _, pin := range pins {
+				if strings.TrimPrefix(pin, "sha256/") == hash {
+					return nil
+				}
+			}
+		}
+		return &certPinError{host: host}
+	}
+}
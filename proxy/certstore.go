@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+)
+
+// certStore serves the listener certificate loaded from files, reloading
+// swaps it for new handshakes while established connections keep theirs.
+type certStore struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Value
+}
+
+// certFiles names the files of a key pair, listeners serving the same pair
+// share its store.
+type certFiles struct {
+	certFile string
+	keyFile  string
+}
+
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	s := &certStore{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads and validates the key pair before replacing the current one.
+func (s *certStore) load() error {
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return err
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+func (s *certStore) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load().(*tls.Certificate), nil
+}
+
+// certStore returns the store of the key pair, loading it for the first
+// listener serving it.
+func (p *HttpProxy) certStore(certFile, keyFile string) (*certStore, error) {
+	p.certsMu.Lock()
+	defer p.certsMu.Unlock()
+	files := certFiles{certFile: certFile, keyFile: keyFile}
+	if certs, ok := p.certs[files]; ok {
+		return certs, nil
+	}
+	certs, err := newCertStore(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if p.certs == nil {
+		p.certs = make(map[certFiles]*certStore)
+	}
+	p.certs[files] = certs
+	return certs, nil
+}
+
+// ReloadCertificates re-reads the certificate and key files of the TLS
+// listeners, the current certificate of a pair is kept if its files are
+// invalid. The first error is returned after trying every pair, without
+// any pair, as in MITM mode, there is nothing to reload.
+func (p *HttpProxy) ReloadCertificates() error {
+	p.certsMu.Lock()
+	stores := make([]*certStore, 0, len(p.certs))
+	for _, certs := range p.certs {
+		stores = append(stores, certs)
+	}
+	p.certsMu.Unlock()
+	var first error
+	for _, certs := range stores {
+		if err := certs.load(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", certs.certFile, err)
+		}
+	}
+	return first
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestCert(t *testing.T, dir, cn string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestHttpProxy_ReloadCertificates(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	certFile, keyFile := writeTestCert(t, dir, "old.example")
+
+	p := testProxy(config.Proxy{}, testResolver{})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go p.serveTLS(ln, certFile, keyFile)
+
+	dial := func() *tls.Conn {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		require.NoError(err)
+		return conn
+	}
+	var old *tls.Conn
+	require.Eventually(func() bool {
+		conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+		old = conn
+		return err == nil
+	}, 5*time.Second, 5*time.Millisecond)
+	defer old.Close()
+	require.Equal("old.example", old.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// an invalid pair is rejected and the current certificate kept
+	require.NoError(ioutil.WriteFile(keyFile, []byte("garbage"), 0600))
+	require.Error(p.ReloadCertificates())
+	conn := dial()
+	require.Equal("old.example", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+
+	writeTestCert(t, dir, "new.example")
+	require.NoError(p.ReloadCertificates())
+	conn = dial()
+	require.Equal("new.example", conn.ConnectionState().PeerCertificates[0].Subject.CommonName)
+	conn.Close()
+
+	// the established connection keeps serving requests
+	_, err = old.Write([]byte("GET / HTTP/1.1\r\nHost: unknown.example\r\n\r\n"))
+	require.NoError(err)
+	res, err := http.ReadResponse(bufio.NewReader(old), nil)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal("old.example", old.ConnectionState().PeerCertificates[0].Subject.CommonName)
+}
+
+func TestHttpProxy_ReloadCertificatesListeners(t *testing.T) {
+	require := require.New(t)
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "a.example")
+	otherDir := t.TempDir()
+	otherCert, otherKey := writeTestCert(t, otherDir, "b.example")
+
+	p := testProxy(config.Proxy{}, testResolver{})
+	// no listener loaded a pair yet, as in MITM mode
+	require.NoError(p.ReloadCertificates())
+	serve := func(certFile, keyFile string) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		t.Cleanup(func() { ln.Close() })
+		go p.serveTLS(ln, certFile, keyFile)
+		return ln.Addr().String()
+	}
+	// the TLS and the mux listener often serve the same pair
+	addrs := []string{serve(certFile, keyFile), serve(certFile, keyFile), serve(otherCert, otherKey)}
+	commonName := func(addr string) string {
+		var conn *tls.Conn
+		require.Eventually(func() bool {
+			var err error
+			conn, err = tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+			return err == nil
+		}, 5*time.Second, 5*time.Millisecond)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	require.Equal("a.example", commonName(addrs[0]))
+	require.Equal("a.example", commonName(addrs[1]))
+	require.Equal("b.example", commonName(addrs[2]))
+
+	writeTestCert(t, filepath.Dir(certFile), "a2.example")
+	writeTestCert(t, otherDir, "b2.example")
+	require.NoError(p.ReloadCertificates())
+	require.Equal("a2.example", commonName(addrs[0]))
+	require.Equal("a2.example", commonName(addrs[1]))
+	require.Equal("b2.example", commonName(addrs[2]))
+}
+
+func TestHttpProxy_MinTLSVersion(t *testing.T) {
+	require := require.New(t)
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "example.com")
+	serve := func(cfg config.Proxy) string {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		t.Cleanup(func() { ln.Close() })
+		go testProxy(cfg, testResolver{}).serveTLS(ln, certFile, keyFile)
+		return ln.Addr().String()
+	}
+	dial := func(addr string, version uint16, suites ...uint16) (tls.ConnectionState, error) {
+		var state tls.ConnectionState
+		conn, err := tls.Dial("tcp", addr, &tls.Config{
+			InsecureSkipVerify: true,
+			MinVersion:         version,
+			MaxVersion:         version,
+			CipherSuites:       suites,
+		})
+		if err == nil {
+			state = conn.ConnectionState()
+			conn.Close()
+		}
+		return state, err
+	}
+
+	addr := serve(config.Proxy{
+		MinTLSVersion: "1.2",
+		CipherSuites:  []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+	})
+	var state tls.ConnectionState
+	require.Eventually(func() bool {
+		var err error
+		state, err = dial(addr, tls.VersionTLS12)
+		return err == nil
+	}, 5*time.Second, 5*time.Millisecond)
+	require.Equal(tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, state.CipherSuite)
+	_, err := dial(addr, tls.VersionTLS10)
+	require.Error(err)
+	_, err = dial(addr, tls.VersionTLS12, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384)
+	require.Error(err)
+
+	addr = serve(config.Proxy{MinTLSVersion: "1.3"})
+	require.Eventually(func() bool {
+		_, err := dial(addr, tls.VersionTLS13)
+		return err == nil
+	}, 5*time.Second, 5*time.Millisecond)
+	_, err = dial(addr, tls.VersionTLS12)
+	require.Error(err)
+}
+
+func TestHttpProxy_JA3(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	certFile, keyFile := writeTestCert(t, t.TempDir(), "example.com")
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var fingerprints []string
+	p.execute.Register(testObserver(func(c *core.Context) {
+		fingerprints = append(fingerprints, c.JA3)
+	}))
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go p.serveTLS(ln, certFile, keyFile)
+
+	get := func(cfg *tls.Config) {
+		cfg.InsecureSkipVerify = true
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig: cfg,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial(network, ln.Addr().String())
+			},
+		}}
+		defer client.CloseIdleConnections()
+		var res *http.Response
+		require.Eventually(func() bool {
+			res, err = client.Get(testURL(backend, "example.com", "/"))
+			return err == nil
+		}, 5*time.Second, 5*time.Millisecond)
+		defer res.Body.Close()
+		b, err := ioutil.ReadAll(res.Body)
+		require.NoError(err)
+		require.Equal("ok", string(b))
+	}
+	get(&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+	get(&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}})
+	get(&tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}})
+
+	require.Len(fingerprints, 3)
+	require.Len(fingerprints[0], 32)
+	require.NotEqual(fingerprints[0], fingerprints[1])
+	require.Equal(fingerprints[0], fingerprints[2])
+}
+
+func TestJA3Hash(t *testing.T) {
+	require := require.New(t)
+	hello := &tls.ClientHelloInfo{
+		SupportedVersions: []uint16{0x1a1a, tls.VersionTLS13, tls.VersionTLS12},
+		CipherSuites:      []uint16{0x2a2a, 4865, 49195},
+		Extensions:        []uint16{0, 10, 11, 0xfafa},
+		SupportedCurves:   []tls.CurveID{0x3a3a, tls.X25519, tls.CurveP256},
+		SupportedPoints:   []uint8{0},
+	}
+	sum := md5.Sum([]byte("771,4865-49195,0-10-11,29-23,0"))
+	require.Equal(hex.EncodeToString(sum[:]), ja3Hash(hello))
+}
@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// DefaultCoalesceMaxBytes bounds the body shared between coalesced requests
+// when the limit isn't configured.
+var DefaultCoalesceMaxBytes int64 = 1 << 20
+
+// coalesceKeyHeaders are the request fields responses commonly vary on,
+// requests share a fetch only when they agree on them.
+var coalesceKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language"}
+
+// flightGroup tracks the upstream fetches in flight by request key.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// flightCall is an upstream fetch shared with identical requests, res is
+// nil when the response can't be shared.
+type flightCall struct {
+	wg   sync.WaitGroup
+	dups int
+	res  *sharedResponse
+}
+
+type sharedResponse struct {
+	status     string
+	statusCode int
+	proto      string
+	header     http.Header
+	body       []byte
+	remoteAddr string
+}
+
+// response returns a copy of the shared response for req.
+func (s *sharedResponse) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        s.status,
+		StatusCode:    s.statusCode,
+		Proto:         s.proto,
+		Header:        s.header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(s.body)),
+		ContentLength: int64(len(s.body)),
+		Request:       req,
+	}
+}
+
+type multiReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// coalescable reports whether req may share its upstream fetch, requests
+// carrying credentials, validators or ranges are always fetched on their own.
+func coalescable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.ContentLength != 0 {
+		return false
+	}
+	for _, name := range []string{"Authorization", "Cookie", "If-None-Match", "If-Modified-Since", "Range"} {
+		if req.Header.Get(name) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// do sends req upstream, identical concurrent GETs share a single fetch and
+// its buffered response. Waiters fetch on their own when the response
+// fails or exceeds the body limit.
+func (p *HttpProxy) do(c *core.Context, req *http.Request) (*http.Response, error) {
+	if !p.cfg.CoalesceRequests || !coalescable(req) {
+		return p.client.Do(p.traceRequest(c, req))
+	}
+	key := req.URL.Scheme + "://" + req.Host + req.URL.RequestURI()
+	for _, name := range coalesceKeyHeaders {
+		key += "\x00" + req.Header.Get(name)
+	}
+	p.flights.mu.Lock()
+	if p.flights.calls == nil {
+		p.flights.calls = make(map[string]*flightCall)
+	}
+	if call, found := p.flights.calls[key]; found {
+		call.dups++
+		p.flights.mu.Unlock()
+		call.wg.Wait()
+		if call.res == nil {
+			return p.client.Do(p.traceRequest(c, req))
+		}
+		c.UpstreamAddr = call.res.remoteAddr
+		return call.res.response(req), nil
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	p.flights.calls[key] = call
+	p.flights.mu.Unlock()
+
+	defer func() {
+		p.flights.mu.Lock()
+		delete(p.flights.calls, key)
+		if call.dups > 0 {
+			p.log.Debug("coalesced requests", zap.String("key", key), zap.Int("shared", call.dups), zap.Bool("buffered", call.res != nil))
+		}
+		p.flights.mu.Unlock()
+		call.wg.Done()
+	}()
+	response, err := p.client.Do(p.traceRequest(c, req))
+	if err != nil {
+		return nil, err
+	}
+	// a response varying on fields outside the key may not suit the waiters
+	if !varyWithin(response.Header, coalesceKeyHeaders) {
+		return response, nil
+	}
+	max := p.cfg.CoalesceMaxBytes
+	if max <= 0 {
+		max = DefaultCoalesceMaxBytes
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(response.Body, max+1))
+	if err != nil || int64(len(body)) > max {
+		response.Body = multiReadCloser{io.MultiReader(bytes.NewReader(body), response.Body), response.Body}
+		return response, nil
+	}
+	response.Body.Close()
+	call.res = &sharedResponse{
+		status:     response.Status,
+		statusCode: response.StatusCode,
+		proto:      response.Proto,
+		header:     response.Header,
+		body:       body,
+		remoteAddr: c.UpstreamAddr,
+	}
+	return call.res.response(req), nil
+}
+
+// varyWithin reports whether the Vary fields of header are all among names,
+// "*" never is.
+func varyWithin(header http.Header, names []string) bool {
+	for _, value := range header.Values("Vary") {
+		for _, field := range strings.Split(value, ",") {
+			field = strings.TrimSpace(field)
+			if field == "" {
+				continue
+			}
+			listed := false
+			for _, name := range names {
+				if strings.EqualFold(field, name) {
+					listed = true
+					break
+				}
+			}
+			if !listed {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// collapseHeaders joins the field lines of each named header into one, as
+// RFC 7230 section 3.2.2 allows for list headers. Cookie lines are joined
+// with "; " as of RFC 6265 section 5.4.
+func collapseHeaders(header http.Header, names []string) {
+	for _, name := range names {
+		key := http.CanonicalHeaderKey(name)
+		values := header[key]
+		if len(values) < 2 {
+			continue
+		}
+		sep := ", "
+		if key == "Cookie" {
+			sep = "; "
+		}
+		header[key] = []string{strings.Join(values, sep)}
+	}
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimiter counts the open connections of each client IP, connections
+// beyond the limit are closed as soon as they are accepted.
+type connLimiter struct {
+	limit int
+
+	mu sync.Mutex
+	// counted holds the IP of the connections counted, rejected ones
+	// aren't released
+	counted map[net.Conn]string
+	ips     map[string]int
+}
+
+func newConnLimiter(limit int) *connLimiter {
+	return &connLimiter{
+		limit:   limit,
+		counted: map[net.Conn]string{},
+		ips:     map[string]int{},
+	}
+}
+
+// acquire counts conn against the IP of its peer, false when the IP is at
+// the limit already.
+func (l *connLimiter) acquire(conn net.Conn) (string, bool) {
+	ip := stripPort(conn.RemoteAddr().String())
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ips[ip] >= l.limit {
+		return ip, false
+	}
+	l.ips[ip]++
+	l.counted[conn] = ip
+	return ip, true
+}
+
+func (l *connLimiter) release(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ip, ok := l.counted[conn]
+	if !ok {
+		return
+	}
+	delete(l.counted, conn)
+	if l.ips[ip]--; l.ips[ip] <= 0 {
+		delete(l.ips, ip)
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync/atomic"
+)
+
+// TransportStats counts the upstream connections of the shared transport.
+type TransportStats struct {
+	// Created is the number of connections dialed.
+	Created uint64
+	// Reused is the number of requests sent over an already used connection.
+	Reused uint64
+	// IdleClosed is the number of connections closed while idle in the pool.
+	IdleClosed uint64
+}
+
+type connStats struct {
+	created    uint64
+	reused     uint64
+	idleClosed uint64
+}
+
+// countedConn flags whether it is idle in the transport pool, so its close
+// is counted as an idle close.
+type countedConn struct {
+	net.Conn
+	stats *connStats
+	idle  int32
+	once  int32
+}
+
+func (c *countedConn) Close() error {
+	if atomic.CompareAndSwapInt32(&c.once, 0, 1) && atomic.LoadInt32(&c.idle) == 1 {
+		atomic.AddUint64(&c.stats.idleClosed, 1)
+	}
+	return c.Conn.Close()
+}
+
+// countDial wraps dial to count the upstream connections.
+func (p *HttpProxy) countDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddUint64(&p.connStats.created, 1)
+		return &countedConn{Conn: conn, stats: &p.connStats}, nil
+	}
+}
+
+// countedConnOf returns the countedConn under conn, conn may wrap it in TLS
+// or a capture.
+func countedConnOf(conn net.Conn) *countedConn {
+	if capture, ok := conn.(*captureConn); ok {
+		conn = capture.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	counted, _ := conn.(*countedConn)
+	return counted
+}
+
+// countTrace hooks the connection accounting into trace.
+func (p *HttpProxy) countTrace(trace *httptrace.ClientTrace) {
+	var counted *countedConn
+	gotConn := trace.GotConn
+	trace.GotConn = func(info httptrace.GotConnInfo) {
+		if info.Reused {
+			atomic.AddUint64(&p.connStats.reused, 1)
+		}
+		if counted = countedConnOf(info.Conn); counted != nil {
+			atomic.StoreInt32(&counted.idle, 0)
+		}
+		if gotConn != nil {
+			gotConn(info)
+		}
+	}
+	trace.PutIdleConn = func(err error) {
+		if err == nil && counted != nil {
+			atomic.StoreInt32(&counted.idle, 1)
+		}
+	}
+}
+
+// TransportStats returns the upstream connection counters.
+func (p *HttpProxy) TransportStats() TransportStats {
+	return TransportStats{
+		Created:    atomic.LoadUint64(&p.connStats.created),
+		Reused:     atomic.LoadUint64(&p.connStats.reused),
+		IdleClosed: atomic.LoadUint64(&p.connStats.idleClosed),
+	}
+}
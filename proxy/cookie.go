@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+)
+
+// rewriteCookies applies the configured attributes to every Set-Cookie of
+// the response. Cookies are edited attribute by attribute so the ones net/http
+// doesn't know survive.
+func rewriteCookies(header http.Header, rule config.CookieRewrite) {
+	cookies := header.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	rewritten := make([]string, 0, len(cookies))
+	for _, cookie := range cookies {
+		rewritten = append(rewritten, rewriteCookie(cookie, rule))
+	}
+	header["Set-Cookie"] = rewritten
+}
+
+func rewriteCookie(cookie string, rule config.CookieRewrite) string {
+	parts := strings.Split(cookie, ";")
+	attrs := parts[:1]
+	var secure, httpOnly bool
+	for _, part := range parts[1:] {
+		attr := strings.TrimSpace(part)
+		if attr == "" {
+			continue
+		}
+		name := attr
+		if i := strings.IndexByte(attr, '='); i >= 0 {
+			name = strings.TrimSpace(attr[:i])
+		}
+		switch strings.ToLower(name) {
+		case "secure":
+			secure = true
+		case "httponly":
+			httpOnly = true
+		case "samesite":
+			if rule.SameSite != "" {
+				continue
+			}
+		}
+		attrs = append(attrs, " "+attr)
+	}
+	if rule.Secure && !secure {
+		attrs = append(attrs, " Secure")
+	}
+	if rule.HttpOnly && !httpOnly {
+		attrs = append(attrs, " HttpOnly")
+	}
+	if rule.SameSite != "" {
+		attrs = append(attrs, " SameSite="+rule.SameSite)
+	}
+	return strings.Join(attrs, ";")
+}
+
+// injectCookies adds the Set-Cookie of every rule matching the response to
+// header, a cookie the client sent or the response sets already is kept.
+func (p *HttpProxy) injectCookies(header http.Header, r *http.Request, response *http.Response) {
+	if len(p.cfg.SetCookies) == 0 {
+		return
+	}
+	host := strings.ToLower(stripPort(r.Host))
+	contentType := response.Header.Get("Content-Type")
+	for _, rule := range p.cfg.SetCookies {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, rule.Path) || !strings.HasPrefix(contentType, rule.ContentType) {
+			continue
+		}
+		if !statusMatches(rule.Status, response.StatusCode) {
+			continue
+		}
+		if _, err := r.Cookie(rule.Name); err == nil || setsCookie(header, rule.Name) {
+			continue
+		}
+		header.Add("Set-Cookie", injectedCookie(rule))
+	}
+}
+
+func statusMatches(statuses []int, status int) bool {
+	if len(statuses) == 0 {
+		return true
+	}
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// setsCookie reports whether a Set-Cookie of header sets the named cookie.
+func setsCookie(header http.Header, name string) bool {
+	for _, cookie := range header.Values("Set-Cookie") {
+		if i := strings.IndexByte(cookie, '='); i >= 0 && strings.TrimSpace(cookie[:i]) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func injectedCookie(rule config.SetCookie) string {
+	cookie := rule.Name + "=" + rule.Value
+	if rule.CookiePath != "" {
+		cookie += "; Path=" + rule.CookiePath
+	}
+	if rule.Domain != "" {
+		cookie += "; Domain=" + rule.Domain
+	}
+	if rule.MaxAge != 0 {
+		cookie += "; Max-Age=" + strconv.Itoa(rule.MaxAge)
+	}
+	if rule.Secure {
+		cookie += "; Secure"
+	}
+	if rule.HttpOnly {
+		cookie += "; HttpOnly"
+	}
+	if rule.SameSite != "" {
+		cookie += "; SameSite=" + rule.SameSite
+	}
+	return cookie
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+)
+
+// corsPreflight reports whether r is a CORS preflight request, an OPTIONS
+// request asking for the method of the actual one.
+func corsPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions && r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// corsOrigin returns the Access-Control-Allow-Origin of origin, empty when
+// it isn't allowed. Credentialed responses may not allow any origin, the
+// listed origin is echoed then and "*" allows none, echoing every origin
+// would hand the credentials of the user to any site.
+func corsOrigin(cfg config.CORS, origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range cfg.Origins {
+		switch {
+		case allowed == "*" && !cfg.Credentials:
+			return "*"
+		case allowed != "*" && strings.EqualFold(allowed, origin):
+			return origin
+		}
+	}
+	return ""
+}
+
+// checkCORS rejects credentials for any origin, which browsers refuse and
+// corsOrigin never grants.
+func checkCORS(cfg config.CORS) error {
+	if !cfg.Enable || !cfg.Credentials {
+		return nil
+	}
+	for _, allowed := range cfg.Origins {
+		if allowed == "*" {
+			return errors.New(`credentials can't be allowed for origin "*", list the origins`)
+		}
+	}
+	return nil
+}
+
+// preflight answers a CORS preflight request locally, without CORS headers
+// when the origin, method or headers aren't allowed, which the browser
+// takes as a denial.
+func (p *HttpProxy) preflight(w http.ResponseWriter, r *http.Request) {
+	cfg := p.cfg.CORS
+	header := w.Header()
+	header.Add("Vary", "Origin")
+	header.Add("Vary", "Access-Control-Request-Method")
+	header.Add("Vary", "Access-Control-Request-Headers")
+	header.Set("Content-Length", "0")
+	origin := corsOrigin(cfg, r.Header.Get("Origin"))
+	method := r.Header.Get("Access-Control-Request-Method")
+	headers := r.Header.Get("Access-Control-Request-Headers")
+	if origin == "" || !corsListed(cfg.Methods, method) || !corsHeadersAllowed(cfg.Headers, headers) {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if len(cfg.Methods) > 0 {
+		header.Set("Access-Control-Allow-Methods", strings.Join(cfg.Methods, ", "))
+	} else {
+		header.Set("Access-Control-Allow-Methods", method)
+	}
+	if len(cfg.Headers) > 0 {
+		header.Set("Access-Control-Allow-Headers", strings.Join(cfg.Headers, ", "))
+	} else if headers != "" {
+		header.Set("Access-Control-Allow-Headers", headers)
+	}
+	if cfg.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if cfg.MaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setCORSHeaders adds the CORS headers of an actual response to an allowed
+// origin, replacing the upstream's own.
+func (p *HttpProxy) setCORSHeaders(header http.Header, r *http.Request) {
+	cfg := p.cfg.CORS
+	header.Add("Vary", "Origin")
+	origin := corsOrigin(cfg, r.Header.Get("Origin"))
+	if origin == "" {
+		return
+	}
+	header.Set("Access-Control-Allow-Origin", origin)
+	if cfg.Credentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if len(cfg.ExposeHeaders) > 0 {
+		header.Set("Access-Control-Expose-Headers", strings.Join(cfg.ExposeHeaders, ", "))
+	}
+}
+
+// corsListed reports whether method is listed, any is when none are.
+func corsListed(methods []string, method string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHeadersAllowed reports whether every header of the comma separated
+// requested ones is allowed, any are when none are configured.
+func corsHeadersAllowed(allowed []string, requested string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+	for _, name := range strings.Split(requested, ",") {
+		if name = strings.TrimSpace(name); name != "" && !corsListed(allowed, name) {
+			return false
+		}
+	}
+	return true
+}
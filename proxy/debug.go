@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// DebugHeader asks for the debug capture of a request, from a client in
+// the DebugCapture trusted peers.
+const DebugHeader = "X-Httpctl-Debug"
+
+const defaultDebugBodyBytes = 64 << 10
+
+// debugRedacted replaces the values of credentials in debug captures.
+const debugRedacted = "REDACTED"
+
+// debugSecretHeaders are the fields whose values are never captured.
+var debugSecretHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// redactHeader returns a copy of header with the values of credentials
+// replaced, captures end up in logs shared more widely than the traffic.
+func redactHeader(header http.Header) http.Header {
+	redacted := header.Clone()
+	for _, name := range debugSecretHeaders {
+		// the values are those of the clone
+		values := redacted.Values(name)
+		for i := range values {
+			values[i] = debugRedacted
+		}
+	}
+	return redacted
+}
+
+// debugRequested returns true if the request asks for a debug capture and
+// comes from a trusted client.
+func (p *HttpProxy) debugRequested(r *http.Request) bool {
+	if len(p.debugPeers) == 0 || r.Header.Get(DebugHeader) != "1" {
+		return false
+	}
+	ip := net.ParseIP(p.clientIP(r))
+	return ip != nil && ipTrusted(p.debugPeers, ip)
+}
+
+// debugCapture collects the decoded response body of a debugged request,
+// up to max bytes.
+type debugCapture struct {
+	max       int64
+	body      []byte
+	truncated bool
+}
+
+func (d *debugCapture) Write(b []byte) (int, error) {
+	if left := d.max - int64(len(d.body)); int64(len(b)) > left {
+		d.body = append(d.body, b[:left]...)
+		d.truncated = true
+	} else {
+		d.body = append(d.body, b...)
+	}
+	return len(b), nil
+}
+
+// logDebug logs everything known of a debugged transaction, whatever the
+// log level. Streamed response bodies aren't captured.
+func (p *HttpProxy) logDebug(d *debugCapture, c *core.Context, r, req *http.Request, response *http.Response) {
+	p.log.Info("debug capture",
+		zap.String("client", p.clientIP(r)),
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.String("uri", r.RequestURI),
+		zap.Any("request_headers", redactHeader(r.Header)),
+		zap.Any("upstream_headers", redactHeader(req.Header)),
+		zap.ByteString("request_body", c.RequestBody),
+		zap.String("addr", c.UpstreamAddr),
+		zap.Int("status", response.StatusCode),
+		zap.Any("response_headers", redactHeader(response.Header)),
+		zap.ByteString("body", d.body),
+		zap.Bool("body_truncated", d.truncated),
+		zap.Duration("dns", c.Timings.DNS),
+		zap.Duration("connect", c.Timings.Connect),
+		zap.Duration("tls", c.Timings.TLS),
+		zap.Duration("ttfb", c.Timings.TTFB),
+		zap.Duration("total", c.Timings.Total))
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/andybalholm/brotli"
+)
+
+// DecoderFactory creates the decoding reader of a content encoding.
+type DecoderFactory func(io.Reader) (io.Reader, error)
+
+// decodersMu guards decoders against registrations while serving.
+var decodersMu sync.RWMutex
+
+// decoders create the decoding reader of a content encoding.
+var decoders = map[string]DecoderFactory{
+	"br": (&decoderPool{new: func(r io.Reader) (ResettableDecoder, error) {
+		return brotli.NewReader(r), nil
+	}}).get,
+	"gzip": (&decoderPool{new: func(r io.Reader) (ResettableDecoder, error) {
+		return gzip.NewReader(r)
+	}}).get,
+}
+
+// ResettableDecoder is a decoding reader reusable for another stream, such
+// as the gzip, brotli and zstd readers.
+type ResettableDecoder interface {
+	io.Reader
+	Reset(io.Reader) error
+}
+
+// RegisterPooledDecoder registers the decoder of a content encoding like
+// RegisterDecoder, the decoders created by new are reused across bodies.
+func RegisterPooledDecoder(encoding string, new func(io.Reader) (ResettableDecoder, error)) {
+	RegisterDecoder(encoding, (&decoderPool{new: new}).get)
+}
+
+// decoderPool reuses the decoders of an encoding, a decoder goes back to
+// the pool once its body is read to the end or failed. Decoders of bodies
+// abandoned halfway are left to the GC.
+type decoderPool struct {
+	pool sync.Pool
+	new  func(io.Reader) (ResettableDecoder, error)
+}
+
+func (d *decoderPool) get(r io.Reader) (io.Reader, error) {
+	if dec, ok := d.pool.Get().(ResettableDecoder); ok {
+		if err := dec.Reset(r); err != nil {
+			d.put(dec)
+			return nil, err
+		}
+		return &pooledDecoder{dec: dec, pool: d}, nil
+	}
+	dec, err := d.new(r)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledDecoder{dec: dec, pool: d}, nil
+}
+
+// put returns dec to the pool, reset so it holds on to no body.
+func (d *decoderPool) put(dec ResettableDecoder) {
+	dec.Reset(eofReader{})
+	d.pool.Put(dec)
+}
+
+// pooledDecoder hands its decoder back at the end of the body, reads
+// after it return the final error again.
+type pooledDecoder struct {
+	dec  ResettableDecoder
+	pool *decoderPool
+	err  error
+}
+
+func (p *pooledDecoder) Read(b []byte) (int, error) {
+	if p.dec == nil {
+		return 0, p.err
+	}
+	n, err := p.dec.Read(b)
+	if err != nil {
+		p.pool.put(p.dec)
+		p.dec, p.err = nil, err
+	}
+	return n, err
+}
+
+// eofReader is an empty body, a byte reader so gzip doesn't buffer it.
+type eofReader struct{}
+
+func (eofReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (eofReader) ReadByte() (byte, error) { return 0, io.EOF }
+
+// RegisterDecoder registers the decoder of a content encoding, replacing
+// the built-in one of the same name. Encodings are case-insensitive.
+func RegisterDecoder(encoding string, factory DecoderFactory) {
+	decodersMu.Lock()
+	decoders[strings.ToLower(encoding)] = factory
+	decodersMu.Unlock()
+}
+
+// decoderInitError is returned when a decoder panicked while it was created,
+// such as a decoder library which isn't usable in this build.
+type decoderInitError struct {
+	encoding string
+	cause    interface{}
+}
+
+func (e *decoderInitError) Error() string {
+	return fmt.Sprintf("%s decoder unavailable: %v", e.encoding, e.cause)
+}
+
+// decodeBody returns a reader decoding body according to the content
+// encoding, unknown encodings are returned as is. A panicking decoder
+// factory returns a *decoderInitError.
+func decodeBody(encoding string, body io.Reader) (reader io.Reader, err error) {
+	decodersMu.RLock()
+	decoder, found := decoders[strings.ToLower(encoding)]
+	decodersMu.RUnlock()
+	if !found {
+		return body, nil
+	}
+	defer func() {
+		if cause := recover(); cause != nil {
+			reader, err = nil, &decoderInitError{encoding: strings.ToLower(encoding), cause: cause}
+		}
+	}()
+	return decoder(body)
+}
+
+// truncateReader reads at most max bytes through an io.LimitReader of one
+// byte more, calling onTruncate when that extra byte shows r holds more.
+type truncateReader struct {
+	r          io.Reader
+	max, n     int64
+	onTruncate func()
+}
+
+func newTruncateReader(r io.Reader, max int64, onTruncate func()) *truncateReader {
+	return &truncateReader{
+		r:          io.LimitReader(r, max+1),
+		max:        max,
+		onTruncate: onTruncate,
+	}
+}
+
+func (t *truncateReader) Read(b []byte) (int, error) {
+	if t.n > t.max {
+		return 0, io.EOF
+	}
+	if rest := t.max - t.n + 1; int64(len(b)) > rest {
+		b = b[:rest]
+	}
+	n, err := t.r.Read(b)
+	t.n += int64(n)
+	if t.n > t.max {
+		t.onTruncate()
+		return n - 1, io.EOF
+	}
+	return n, err
+}
+
+// countingReader counts the bytes read through it, the count may be read
+// while another goroutine reads.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+func (c *countingReader) count() int64 {
+	return atomic.LoadInt64(&c.n)
+}
+
+// countingReadCloser counts the bytes read from a body.
+type countingReadCloser struct {
+	countingReader
+	io.Closer
+}
+
+func newCountingReadCloser(body io.ReadCloser) *countingReadCloser {
+	return &countingReadCloser{countingReader: countingReader{r: body}, Closer: body}
+}
+
+// minRatioCheckBytes is the decoded size the ratio is checked from, headers
+// and decoder read-ahead make it meaningless for the first bytes.
+const minRatioCheckBytes = 64 << 10
+
+// ratioReader stops decoding once more than ratio times the encoded bytes
+// read from in have been decoded, calling onExceed.
+type ratioReader struct {
+	r        io.Reader
+	in       *countingReader
+	ratio    float64
+	n        int64
+	exceeded bool
+	onExceed func()
+}
+
+func (r *ratioReader) Read(b []byte) (int, error) {
+	if r.exceeded {
+		return 0, io.EOF
+	}
+	n, err := r.r.Read(b)
+	r.n += int64(n)
+	if r.n >= minRatioCheckBytes && float64(r.n) > r.ratio*float64(r.in.count()) {
+		r.exceeded = true
+		r.onExceed()
+		return n, io.EOF
+	}
+	return n, err
+}
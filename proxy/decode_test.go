@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/require"
+)
+
+func gzipped(body []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func brotlied(body []byte) []byte {
+	var buf bytes.Buffer
+	w := brotli.NewWriter(&buf)
+	w.Write(body)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody_PooledReuse(t *testing.T) {
+	require := require.New(t)
+	for encoding, encode := range map[string]func([]byte) []byte{"gzip": gzipped, "br": brotlied} {
+		for i := 0; i < 5; i++ {
+			body := bytes.Repeat([]byte(fmt.Sprintf("body %d of %s\n", i, encoding)), 100*(i+1))
+			reader, err := decodeBody(encoding, bytes.NewReader(encode(body)))
+			require.NoError(err)
+			decoded, err := ioutil.ReadAll(reader)
+			require.NoError(err)
+			require.Equal(body, decoded, "%s body %d", encoding, i)
+			// the decoder is back in the pool, the reader stays at its end
+			n, err := reader.Read(make([]byte, 8))
+			require.Equal(0, n)
+			require.Equal(io.EOF, err)
+
+			// a corrupt body doesn't spoil the decoder for the next one
+			encoded := encode(body)
+			reader, err = decodeBody(encoding, bytes.NewReader(encoded[:len(encoded)/2]))
+			if err == nil {
+				_, err = ioutil.ReadAll(reader)
+			}
+			require.Error(err)
+		}
+	}
+}
+
+// BenchmarkDecodeBody decodes a small gzip body with a new reader each time
+// and with the pooled ones.
+func BenchmarkDecodeBody(b *testing.B) {
+	encoded := gzipped(bytes.Repeat([]byte("<p>lorem ipsum dolor sit amet</p>\n"), 200))
+	for _, bench := range []struct {
+		name   string
+		decode DecoderFactory
+	}{
+		{"new", func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) }},
+		{"pooled", func(r io.Reader) (io.Reader, error) { return decodeBody("gzip", r) }},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				reader, err := bench.decode(bytes.NewReader(encoded))
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(ioutil.Discard, reader)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/core"
+)
+
+// responseDelay returns the added latency and the throttle of the first
+// delay rule matching the request host and path prefix, the global ones
+// otherwise. An empty rule host or path matches any.
+func (p *HttpProxy) responseDelay(r *http.Request) (time.Duration, int64) {
+	delay := p.cfg.ResponseDelay
+	host := strings.ToLower(stripPort(r.Host))
+	for _, rule := range delay.Rules {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, rule.Path) {
+			core.MatchRule(r.Context(), rule.Name)
+			return rule.Latency, rule.BytesPerSecond
+		}
+	}
+	return delay.Latency, delay.BytesPerSecond
+}
+
+// sleep waits for d, false when ctx ended first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// throttle paces body writes to a rate in bytes per second, in chunks of
+// a tenth of a second so large writes trickle too.
+type throttle struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	sent  int64
+}
+
+func newThrottle(ctx context.Context, rate int64) *throttle {
+	return &throttle{ctx: ctx, rate: rate, start: time.Now()}
+}
+
+func (t *throttle) write(write func([]byte) (int, error), b []byte) (int, error) {
+	chunk := int(t.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
+	written := 0
+	for len(b) > 0 {
+		n := chunk
+		if n > len(b) {
+			n = len(b)
+		}
+		// the time the bytes sent so far are due at this rate
+		due := t.start.Add(time.Duration(t.sent * int64(time.Second) / t.rate))
+		if wait := time.Until(due); wait > 0 && !sleep(t.ctx, wait) {
+			return written, t.ctx.Err()
+		}
+		m, err := write(b[:n])
+		written += m
+		t.sent += int64(m)
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+const defaultErrorPage = `<!DOCTYPE html>
+<html><head><title>{{.Status}} {{.StatusText}}</title></head>
+<body><h1>{{.StatusText}}</h1>
+<p>The upstream {{.Host}} ({{.Addr}}) could not be reached: {{.Class}}.</p>
+</body></html>
+`
+
+// errorPageData is rendered by the error page template, it never carries
+// the raw error which may leak internals.
+type errorPageData struct {
+	Status     int
+	StatusText string
+	Host       string
+	Addr       string
+	Class      string
+}
+
+func (p *HttpProxy) parseErrorPage() *template.Template {
+	text := p.cfg.ErrorPage.Template
+	if text == "" {
+		text = defaultErrorPage
+	}
+	tmpl, err := template.New("error").Parse(text)
+	if err != nil {
+		p.log.Error("parse error page template", zap.Error(err))
+		tmpl = template.Must(template.New("error").Parse(defaultErrorPage))
+	}
+	return tmpl
+}
+
+// errorClass sanitizes an upstream error into a short class.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certErr x509.CertificateInvalidError
+	var authErr x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var pinErr *certPinError
+	switch {
+	case requestTooLarge(err):
+		return "request body too large"
+	case errors.As(err, &pinErr):
+		return "certificate pin mismatch"
+	case malformedResponse(err):
+		return "malformed response"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "connection reset"
+	case errors.As(err, &dnsErr):
+		return "dns resolution failed"
+	case errors.As(err, &certErr), errors.As(err, &authErr), errors.As(err, &hostErr):
+		return "tls certificate error"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "upstream error"
+}
+
+// requestTooLarge reports whether err comes from a request body growing
+// beyond MaxRequestBytes.
+func requestTooLarge(err error) bool {
+	var maxErr *http.MaxBytesError
+	return errors.As(err, &maxErr)
+}
+
+// upstreamError answers a failed upstream exchange of req, with the error
+// page when enabled.
+func (p *HttpProxy) upstreamError(w http.ResponseWriter, req *http.Request, err error) {
+	status := http.StatusBadGateway
+	class := errorClass(err)
+	switch class {
+	case "timeout":
+		status = http.StatusGatewayTimeout
+	case "request body too large":
+		status = http.StatusRequestEntityTooLarge
+	}
+	if !p.cfg.ErrorPage.Enable {
+		switch class {
+		case "timeout", "request body too large":
+			http.Error(w, http.StatusText(status), status)
+		case "malformed response":
+			http.Error(w, http.StatusText(status)+": malformed upstream response", status)
+		case "certificate pin mismatch":
+			http.Error(w, http.StatusText(status)+": upstream certificate pin mismatch", status)
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	data := errorPageData{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Host:       req.Host,
+		Addr:       upstreamAddr(req),
+		Class:      class,
+	}
+	if err := p.errorPage.Execute(w, data); err != nil {
+		p.log.Error("render error page", zap.Error(err))
+	}
+}
+
+// upstreamTruncated handles an upstream failing in the middle of the body.
+// A body held back wasn't sent, the client gets a 502 instead. Otherwise
+// the status is out already, the connection is aborted so the client can't
+// take the truncated body for a whole one, chunked ones included.
+func (p *HttpProxy) upstreamTruncated(w http.ResponseWriter, c *core.Context, n int64, err error, sent bool) {
+	p.log.Warn("upstream failed, partial transfer",
+		zap.ByteString("host", c.RequestHeader.Host()),
+		zap.ByteString("uri", c.RequestHeader.RequestURI()),
+		zap.Int64("bytes", n), zap.Error(err))
+	if !sent {
+		header := w.Header()
+		for k := range header {
+			delete(header, k)
+		}
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	// net/http closes the connection without ending the response
+	panic(http.ErrAbortHandler)
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+)
+
+// faultInjector applies the first fault rule matching the request host and
+// path prefix to the configured share of requests, for chaos testing.
+type faultInjector struct {
+	rules []config.FaultRule
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newFaultInjector(rules []config.FaultRule) *faultInjector {
+	return &faultInjector{
+		rules: rules,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (f *faultInjector) roll() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rand.Float64()
+}
+
+// inject applies the matching fault and reports whether it answered the
+// request, a delay alone lets the request be proxied afterwards.
+func (f *faultInjector) inject(w http.ResponseWriter, r *http.Request) bool {
+	rule, found := f.match(r)
+	if !found || f.roll() >= rule.Probability {
+		return false
+	}
+	core.MatchRule(r.Context(), rule.Name)
+	if rule.Delay > 0 {
+		timer := time.NewTimer(rule.Delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return true
+		}
+	}
+	switch {
+	case rule.Drop:
+		// net/http closes the connection without a response
+		panic(http.ErrAbortHandler)
+	case rule.Status > 0:
+		http.Error(w, http.StatusText(rule.Status), rule.Status)
+		return true
+	}
+	return false
+}
+
+// match returns the first rule matching the request, an empty rule host or
+// path matches any.
+func (f *faultInjector) match(r *http.Request) (config.FaultRule, bool) {
+	host := strings.ToLower(stripPort(r.Host))
+	for _, rule := range f.rules {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(r.URL.Path, rule.Path) {
+			continue
+		}
+		return rule, true
+	}
+	return config.FaultRule{}, false
+}
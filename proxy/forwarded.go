@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// forwardedNode formats ip as a RFC 7239 node, IPv6 is bracketed and quoted.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
+
+// forwardedValue quotes v unless it is a token.
+func forwardedValue(v string) string {
+	for _, r := range v {
+		if !strings.ContainsRune("!#$%&'*+-.^_`|~", r) &&
+			(r < '0' || r > '9') && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+// setForwarded appends the element describing the client hop of r to the
+// Forwarded header of req, an inbound header is only kept from trusted peers.
+func (p *HttpProxy) setForwarded(req, r *http.Request) {
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+	element := "for=" + forwardedNode(stripPort(r.RemoteAddr)) +
+		";host=" + forwardedValue(r.Host) + ";proto=" + proto
+	if inbound := r.Header["Forwarded"]; len(inbound) > 0 && p.peerTrusted(r) {
+		element = strings.Join(inbound, ", ") + ", " + element
+	}
+	req.Header.Set("Forwarded", element)
+}
+
+func (p *HttpProxy) peerTrusted(r *http.Request) bool {
+	ip := net.ParseIP(stripPort(r.RemoteAddr))
+	return ip != nil && ipTrusted(p.forwarders, ip)
+}
+
+// clientIP returns the client address, from the inbound Forwarded header,
+// or X-Forwarded-For without it, when sent by a trusted peer: the rightmost
+// hop not being a trusted proxy.
+func (p *HttpProxy) clientIP(r *http.Request) string {
+	client := stripPort(r.RemoteAddr)
+	if !p.peerTrusted(r) {
+		return client
+	}
+	hops := parseForwardedFor(r.Header["Forwarded"])
+	if len(hops) == 0 {
+		hops = parseXForwardedFor(r.Header["X-Forwarded-For"])
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// unknown or obfuscated, nothing beyond can be trusted
+			break
+		}
+		client = hops[i]
+		if !ipTrusted(p.forwarders, ip) {
+			break
+		}
+	}
+	return client
+}
+
+// parseXForwardedFor returns the hops of X-Forwarded-For, without brackets
+// and port.
+func parseXForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, strings.Trim(stripPort(hop), "[]"))
+			}
+		}
+	}
+	return hops
+}
+
+// parseForwardedFor returns the for= node of each Forwarded element, without
+// quotes, brackets and port.
+func parseForwardedFor(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, element := range splitQuoted(value, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				eq := strings.IndexByte(pair, '=')
+				if eq < 0 || !strings.EqualFold(strings.TrimSpace(pair[:eq]), "for") {
+					continue
+				}
+				node = strings.Trim(strings.TrimSpace(pair[eq+1:]), `"`)
+				if strings.HasPrefix(node, "[") {
+					if end := strings.IndexByte(node, ']'); end > 0 {
+						node = node[1:end]
+					}
+				} else if h, _, err := net.SplitHostPort(node); err == nil {
+					node = h
+				}
+			}
+			hops = append(hops, node)
+		}
+	}
+	return hops
+}
+
+// splitQuoted splits s at sep outside of quoted strings.
+func splitQuoted(s string, sep byte) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && quoted:
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"net/textproto"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+)
+
+// headerFilter decides which header names are forwarded, names ending with
+// "*" match by prefix. With an allow list only matching names pass, the
+// deny list is applied afterwards.
+type headerFilter struct {
+	allow headerMatcher
+	deny  headerMatcher
+}
+
+type headerMatcher struct {
+	exact    map[string]bool
+	prefixes []string
+}
+
+func newHeaderFilter(cfg config.HeaderFilter) *headerFilter {
+	return &headerFilter{
+		allow: newHeaderMatcher(cfg.Allow),
+		deny:  newHeaderMatcher(cfg.Deny),
+	}
+}
+
+func newHeaderMatcher(names []string) headerMatcher {
+	m := headerMatcher{exact: make(map[string]bool)}
+	for _, name := range names {
+		if strings.HasSuffix(name, "*") {
+			m.prefixes = append(m.prefixes, textproto.CanonicalMIMEHeaderKey(strings.TrimSuffix(name, "*")))
+		} else {
+			m.exact[textproto.CanonicalMIMEHeaderKey(name)] = true
+		}
+	}
+	return m
+}
+
+func (m headerMatcher) empty() bool {
+	return len(m.exact) == 0 && len(m.prefixes) == 0
+}
+
+func (m headerMatcher) match(name string) bool {
+	if m.exact[name] {
+		return true
+	}
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether the canonical header name is forwarded.
+func (f *headerFilter) allowed(name string) bool {
+	if !f.allow.empty() && !f.allow.match(name) {
+		return false
+	}
+	return !f.deny.match(name)
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// headerOrderDial wraps dial so requests are written with their header
+// fields in the configured order.
+func headerOrderDial(dial dialFunc, order []string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newHeaderOrderConn(conn, order), nil
+	}
+}
+
+// headerOrderConn reorders the header fields of the HTTP/1.x requests
+// written to it, net/http sorts them by name. It follows the request
+// framing so every request of a kept-alive connection is reordered, bodies
+// pass through untouched.
+type headerOrderConn struct {
+	net.Conn
+	rank map[string]int
+
+	head      []byte
+	inBody    bool
+	left      int64
+	chunked   bool
+	chunkLine []byte
+	// chunkCRLF is the CRLF left to pass after the chunk data, trailer
+	// is set once the last chunk was seen
+	chunkCRLF int
+	trailer   bool
+}
+
+func newHeaderOrderConn(conn net.Conn, order []string) *headerOrderConn {
+	rank := make(map[string]int, len(order))
+	for i, name := range order {
+		rank[strings.ToLower(name)] = i
+	}
+	return &headerOrderConn{Conn: conn, rank: rank}
+}
+
+// ConnectionState lets the transport see the state of wrapped TLS
+// connections.
+func (c *headerOrderConn) ConnectionState() tls.ConnectionState {
+	if tlsConn, ok := c.Conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
+func (c *headerOrderConn) Write(b []byte) (int, error) {
+	n := len(b)
+	var out []byte
+	for len(b) > 0 {
+		if !c.inBody {
+			c.head = append(c.head, b...)
+			b = nil
+			i := bytes.Index(c.head, []byte("\r\n\r\n"))
+			if i < 0 {
+				break
+			}
+			head, rest := c.head[:i+4], c.head[i+4:]
+			out = append(out, c.reorder(head)...)
+			c.head, b = nil, append([]byte(nil), rest...)
+			continue
+		}
+		m := c.body(b)
+		out = append(out, b[:m]...)
+		b = b[m:]
+	}
+	if len(out) > 0 {
+		if _, err := c.Conn.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// reorder returns head with its fields in the configured order, unlisted
+// ones follow in their original order. It also picks up the body framing.
+func (c *headerOrderConn) reorder(head []byte) []byte {
+	lines := strings.Split(string(head[:len(head)-4]), "\r\n")
+	fields := lines[1:]
+	c.left, c.chunked = 0, false
+	for _, field := range fields {
+		i := strings.IndexByte(field, ':')
+		if i < 0 {
+			continue
+		}
+		value := strings.TrimSpace(field[i+1:])
+		switch strings.ToLower(field[:i]) {
+		case "content-length":
+			c.left, _ = strconv.ParseInt(value, 10, 64)
+		case "transfer-encoding":
+			c.chunked = strings.EqualFold(value, "chunked")
+		}
+	}
+	sort.SliceStable(fields, func(i, j int) bool {
+		return c.fieldRank(fields[i]) < c.fieldRank(fields[j])
+	})
+	c.inBody = c.chunked || c.left > 0
+	c.chunkLine, c.chunkCRLF, c.trailer = nil, 0, false
+	return []byte(strings.Join(lines, "\r\n") + "\r\n\r\n")
+}
+
+func (c *headerOrderConn) fieldRank(field string) int {
+	name := field
+	if i := strings.IndexByte(field, ':'); i >= 0 {
+		name = field[:i]
+	}
+	if rank, ok := c.rank[strings.ToLower(name)]; ok {
+		return rank
+	}
+	return len(c.rank)
+}
+
+// body returns how many bytes of b belong to the current body, the next
+// request starts once it ended.
+func (c *headerOrderConn) body(b []byte) int {
+	if !c.chunked {
+		m := int64(len(b))
+		if m > c.left {
+			m = c.left
+		}
+		c.left -= m
+		c.inBody = c.left > 0
+		return int(m)
+	}
+	n := 0
+	for n < len(b) && c.inBody {
+		switch {
+		case c.left > 0:
+			m := int64(len(b) - n)
+			if m > c.left {
+				m = c.left
+			}
+			c.left -= m
+			n += int(m)
+			if c.left == 0 {
+				c.chunkCRLF = 2
+			}
+		case c.chunkCRLF > 0:
+			c.chunkCRLF--
+			n++
+		default:
+			// a chunk size line, or a trailer line after the last chunk
+			c.chunkLine = append(c.chunkLine, b[n])
+			n++
+			if b[n-1] != '\n' {
+				continue
+			}
+			line := strings.TrimSpace(string(c.chunkLine))
+			c.chunkLine = nil
+			if c.trailer {
+				c.inBody = line != ""
+				continue
+			}
+			if i := strings.IndexByte(line, ';'); i >= 0 {
+				line = line[:i]
+			}
+			size, _ := strconv.ParseInt(strings.TrimSpace(line), 16, 64)
+			if size == 0 {
+				c.trailer = true
+			}
+			c.left = size
+		}
+	}
+	return n
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/core"
+)
+
+// HostBytes aggregates the transactions of a host.
+type HostBytes struct {
+	Requests int64
+	// RequestBytes is the number of request body bytes sent upstream.
+	RequestBytes int64
+	// ResponseBytes is the number of response body bytes received, as
+	// encoded by the origin.
+	ResponseBytes int64
+	// DecodedBytes is the number of decoded response body bytes handed to
+	// the executors.
+	DecodedBytes int64
+	// Tunnels is the number of CONNECT tunnels, relaying TunnelBytesUp
+	// from the clients and TunnelBytesDown to them over TunnelDuration.
+	Tunnels         int64
+	TunnelBytesUp   int64
+	TunnelBytesDown int64
+	TunnelDuration  time.Duration
+}
+
+type hostStats struct {
+	mu    sync.Mutex
+	hosts map[string]*HostBytes
+}
+
+func (h *hostStats) add(c *core.Context) {
+	host := strings.ToLower(stripPort(string(c.RequestHeader.Host())))
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.host(host)
+	stats.Requests++
+	stats.RequestBytes += c.RequestBytes
+	stats.ResponseBytes += c.ResponseBytes
+	stats.DecodedBytes += c.DecodedBytes
+}
+
+func (h *hostStats) addTunnel(host string, up, down int64, duration time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := h.host(host)
+	stats.Tunnels++
+	stats.TunnelBytesUp += up
+	stats.TunnelBytesDown += down
+	stats.TunnelDuration += duration
+}
+
+// host returns the stats of host, h.mu held.
+func (h *hostStats) host(host string) *HostBytes {
+	if h.hosts == nil {
+		h.hosts = make(map[string]*HostBytes)
+	}
+	stats := h.hosts[host]
+	if stats == nil {
+		stats = &HostBytes{}
+		h.hosts[host] = stats
+	}
+	return stats
+}
+
+// HostStats returns the byte counts per host name of the proxied
+// transactions, empty unless HostStats is enabled.
+func (p *HttpProxy) HostStats() map[string]HostBytes {
+	p.hostStats.mu.Lock()
+	defer p.hostStats.mu.Unlock()
+	hosts := make(map[string]HostBytes, len(p.hostStats.hosts))
+	for host, stats := range p.hostStats.hosts {
+		hosts[host] = *stats
+	}
+	return hosts
+}
@@ -2,135 +2,1263 @@ package proxy
 
 import (
 	"bytes"
-	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/andybalholm/brotli"
+	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/core"
 	"github.com/millken/httpctl/executor"
 	"github.com/millken/httpctl/log"
-
-	"github.com/millken/httpctl/resolver"
 	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
+// defaultAllow lists the methods announced when any is allowed.
+const defaultAllow = "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS"
+
 type HttpProxy struct {
-	execute    *executor.Execute
-	resolver   *resolver.Resolver
-	bufferPool *core.BufferPool
-	log        *zap.Logger
+	cfg            config.Proxy
+	execute        *executor.Execute
+	resolver       Resolver
+	bufferPool     *core.BufferPool
+	poolRules      []core.PoolRule
+	log            *zap.Logger
+	accessLog      *zap.Logger
+	auditLog       *zap.Logger
+	allowedMethods map[string]bool
+	allow          string
+	transport      *http.Transport
+	dial           dialFunc
+	client         *http.Client
+	resHeaders     *headerFilter
+	active         activeRegistry
+	connStats      connStats
+	hostStats      hostStats
+	slots          chan struct{}
+	connLimit      *connLimiter
+	metrics        *upstreamMetrics
+	faults         *faultInjector
+	mirror         *mirror
+	latency        *latencyTracker
+	weights        *weightedSelector
+	stale          *staleCache
+	limiter        *rateLimiter
+	flights        flightGroup
+	badDecoders    sync.Map
+	forwarders     []*net.IPNet
+	debugPeers     []*net.IPNet
+	originalDst    func(net.Conn) (string, error)
+	aclAllow       []*net.IPNet
+	aclDeny        []*net.IPNet
+	ssrfBlock      []*net.IPNet
+	ssrfAllow      []*net.IPNet
+	errorPage      *template.Template
+	minTLSVersion  uint16
+	cipherSuites   []uint16
+	serversMu      sync.Mutex
+	servers        []*trackedServer
+	certsMu        sync.Mutex
+	certs          map[certFiles]*certStore
+	tunnelsMu      sync.Mutex
+	tunnels        map[net.Conn]net.Conn
 }
 
-func NewHttpProxy(resolver *resolver.Resolver, execute *executor.Execute) *HttpProxy {
+func NewHttpProxy(cfg config.Proxy, resolver Resolver, execute *executor.Execute) (*HttpProxy, error) {
+	cfg = lowerRuleHosts(cfg)
 	p := &HttpProxy{
+		cfg:        cfg,
 		execute:    execute,
 		resolver:   resolver,
 		bufferPool: core.BufferPool4k,
 		log:        log.Logger("http"),
+		accessLog:  log.Logger("access"),
+		auditLog:   log.Logger("audit"),
+		resHeaders: newHeaderFilter(cfg.ResponseHeaders),
+	}
+	if len(cfg.AllowedMethods) > 0 {
+		methods := make([]string, 0, len(cfg.AllowedMethods))
+		p.allowedMethods = make(map[string]bool, len(cfg.AllowedMethods))
+		for _, method := range cfg.AllowedMethods {
+			method = strings.ToUpper(method)
+			if !p.allowedMethods[method] {
+				p.allowedMethods[method] = true
+				methods = append(methods, method)
+			}
+		}
+		p.allow = strings.Join(methods, ", ")
+	} else {
+		p.allow = defaultAllow
+		if cfg.AllowTrace {
+			p.allow += ", " + http.MethodTrace
+		}
+	}
+	// pins are looked up by the lowercased host name
+	if len(cfg.CertPins) > 0 {
+		p.cfg.CertPins = make(map[string][]string, len(cfg.CertPins))
+		for host, pins := range cfg.CertPins {
+			host = strings.ToLower(host)
+			p.cfg.CertPins[host] = append(p.cfg.CertPins[host], pins...)
+		}
+	}
+	if cfg.SSRFProtection.Enable {
+		ranges := cfg.SSRFProtection.Ranges
+		if len(ranges) == 0 {
+			ranges = DefaultBlockedRanges
+		}
+		block, err := parseTrustedPeers(ranges)
+		if err != nil {
+			return nil, fmt.Errorf("ssrf protection ranges: %w", err)
+		}
+		allow, err := parseTrustedPeers(cfg.SSRFProtection.Allow)
+		if err != nil {
+			return nil, fmt.Errorf("ssrf protection allow: %w", err)
+		}
+		p.ssrfBlock, p.ssrfAllow = block, allow
+	}
+	if trusted, err := parseTrustedPeers(cfg.Forwarded.TrustedPeers); err != nil {
+		p.log.Error("forwarded", zap.Error(err))
+	} else {
+		p.forwarders = trusted
+	}
+	if trusted, err := parseTrustedPeers(cfg.DebugCapture.TrustedPeers); err != nil {
+		p.log.Error("debug capture", zap.Error(err))
+	} else {
+		p.debugPeers = trusted
+	}
+	p.poolRules = core.DefaultPoolRules
+	if len(cfg.BufferPools) > 0 {
+		p.poolRules = make([]core.PoolRule, 0, len(cfg.BufferPools))
+		for _, rule := range cfg.BufferPools {
+			p.poolRules = append(p.poolRules, core.PoolRule{
+				ContentType: strings.ToLower(rule.ContentType),
+				Pool:        core.PoolOfSize(rule.Size),
+			})
+		}
+	}
+	var err error
+	// a list partly understood would let in clients meant to be kept out
+	if p.aclAllow, err = parseTrustedPeers(cfg.ClientACL.Allow); err != nil {
+		return nil, fmt.Errorf("client acl allow: %w", err)
+	}
+	if p.aclDeny, err = parseTrustedPeers(cfg.ClientACL.Deny); err != nil {
+		return nil, fmt.Errorf("client acl deny: %w", err)
+	}
+	// serving with the defaults would quietly accept what the policy rules out
+	if p.minTLSVersion, err = parseTLSVersion(cfg.MinTLSVersion); err != nil {
+		return nil, fmt.Errorf("min tls version: %w", err)
+	}
+	if p.cipherSuites, err = parseCipherSuites(cfg.CipherSuites); err != nil {
+		return nil, fmt.Errorf("cipher suites: %w", err)
+	}
+	if err = checkCORS(cfg.CORS); err != nil {
+		return nil, fmt.Errorf("cors: %w", err)
+	}
+	if err = checkConflictingLength(cfg.ConflictingLength); err != nil {
+		return nil, fmt.Errorf("conflicting length: %w", err)
+	}
+	if cfg.ErrorPage.Enable {
+		p.errorPage = p.parseErrorPage()
+	}
+	if len(cfg.Faults) > 0 {
+		p.faults = newFaultInjector(cfg.Faults)
+	}
+	if cfg.Mirror.Upstream != "" {
+		if p.mirror, err = newMirror(cfg.Mirror, p.log); err != nil {
+			p.log.Error("mirror", zap.Error(err))
+		}
+	}
+	if cfg.RateLimit.RequestsPerSecond > 0 {
+		p.limiter = newRateLimiter(cfg.RateLimit)
+	}
+	if cfg.StaleIfError.Enable {
+		p.stale = newStaleCache(cfg.StaleIfError)
+	}
+	if cfg.UpstreamSelection.Mode == UpstreamSelectionLatency {
+		p.latency = newLatencyTracker(cfg.UpstreamSelection)
+	}
+	if cfg.UpstreamSelection.Mode == UpstreamSelectionWeighted {
+		p.weights = newWeightedSelector(cfg.UpstreamSelection)
+	}
+	if cfg.MaxConcurrentRequests > 0 {
+		p.slots = make(chan struct{}, cfg.MaxConcurrentRequests)
+	}
+	if cfg.UpstreamMetrics.Enable {
+		p.metrics = newUpstreamMetrics(cfg.UpstreamMetrics.MaxSeries)
+	}
+	if cfg.MaxConnsPerIP > 0 {
+		p.connLimit = newConnLimiter(cfg.MaxConnsPerIP)
+	}
+	p.originalDst = originalDestination
+	p.transport = p.newTransport()
+	p.client = &http.Client{
+		Transport: p.transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
 	}
-	return p
+	return p, nil
 }
 
 func (p *HttpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	r = r.WithContext(core.WithMatchedRules(r.Context()))
+	sw := &statusWriter{ResponseWriter: w}
+	id := p.active.add(r, sw, start)
+	// deferred, an injected connection drop aborts serve with a panic
+	defer func() {
+		p.active.remove(id)
+		p.logAccess(sw, r, start)
+	}()
+	p.serve(sw, r)
+}
+
+func (p *HttpProxy) serve(w http.ResponseWriter, r *http.Request) {
 	var writer io.Writer
 	var buffer *bytes.Buffer
+	if p.slots != nil {
+		select {
+		case p.slots <- struct{}{}:
+			defer func() { <-p.slots }()
+		default:
+			p.log.Warn("too many concurrent requests", zap.Int("limit", cap(p.slots)))
+			http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	// HTTP/1.0 requests may come without a Host
+	if r.Host == "" {
+		http.Error(w, "missing Host header", http.StatusBadRequest)
+		return
+	}
+	// the captured request keeps the path the client sent
+	clientURI := r.URL.RequestURI()
+	if p.cfg.NormalizePath.Enable {
+		r = normalizedRequest(r, p.cfg.NormalizePath)
+	}
+	if rule, denied := p.clientDenied(r); denied {
+		p.audit(r, AuditACLDenied, rule)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if p.limiter != nil {
+		if wait, ok := p.limiter.allow(p.clientIP(r)); !ok {
+			p.audit(r, AuditRateLimited, "")
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+	}
+	ja3 := requestJA3(r)
+	if rule, blocked := p.ja3Blocked(ja3); blocked {
+		p.audit(r, AuditJA3Blocked, rule)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if rule, blocked := p.hostBlocked(r); blocked {
+		p.audit(r, AuditHostBlocked, rule)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	// the overridden method is the one allowed, forwarded and captured
+	if p.cfg.MethodOverride {
+		var err error
+		if r, err = overrideMethod(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if p.cfg.CORS.Enable && corsPreflight(r) {
+		p.preflight(w, r)
+		return
+	}
+	if !p.methodAllowed(r.Method) {
+		p.audit(r, AuditMethodNotAllowed, p.allow)
+		w.Header().Set("Allow", p.allow)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if r.Method == http.MethodConnect && p.cfg.Tunnels {
+		p.tunnel(w, r)
+		return
+	}
+	if max := p.cfg.MaxRequestBytes; max > 0 {
+		if r.ContentLength > max {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		// uploads of unknown length fail once they grow beyond
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+		}
+	}
+	if r.Method == http.MethodOptions && r.RequestURI == "*" && !p.cfg.ForwardOptionsAsterisk {
+		p.optionsAsterisk(w)
+		return
+	}
+	if p.faults != nil && p.faults.inject(w, r) {
+		return
+	}
+	if p.pacRequest(r) {
+		p.servePAC(w, r)
+		return
+	}
+	if route, found := p.staticRoute(r); found {
+		core.MatchRule(r.Context(), route.Name)
+		p.serveStatic(w, r, route)
+		return
+	}
+	c := &core.Context{RequestHeader: p.requestHeader(r, clientURI), JA3: ja3}
+	// the client going away is told apart from the upstream deadline
+	clientCtx := r.Context()
+	var ctx context.Context
+	var cancel context.CancelFunc
+	var deadline *headerDeadline
+	if timeout := p.upstreamTimeout(r); timeout > 0 {
+		deadline, cancel = withHeaderDeadline(r.Context(), timeout)
+		ctx = deadline
+	} else {
+		ctx, cancel = context.WithCancel(r.Context())
+	}
+	defer cancel()
+	r = r.WithContext(ctx)
+	exchangeStart := time.Now()
 	req, err := p.modifyRequest(r)
 	if err != nil {
 		p.log.Error("modify request", zap.Error(err))
+		// a lookup running out of time is a gateway timeout
+		if errorClass(err) == "timeout" {
+			p.upstreamError(w, r, err)
+			return
+		}
+		var blocked *blockedAddrError
+		if errors.As(err, &blocked) {
+			p.audit(r, AuditAddrBlocked, blocked.addr)
+			http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	client := &http.Client{
-		Transport: core.CreateHTTPTransport(nil),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	if err = p.rewriteRequestBody(c, req); err != nil {
+		p.log.Error("rewrite request body", zap.Error(err))
+		if requestTooLarge(err) {
+			http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if max := p.cfg.InspectRequestBodies; max > 0 {
+		if err = p.inspectRequestBody(c, req, max); err != nil {
+			p.log.Error("inspect request body", zap.Error(err))
+			if requestTooLarge(err) {
+				http.Error(w, http.StatusText(http.StatusRequestEntityTooLarge), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if p.mirror != nil {
+		p.mirror.mirror(req)
+	}
+	var reqBody *countingReadCloser
+	if req.Body != nil && req.Body != http.NoBody {
+		reqBody = newCountingReadCloser(req.Body)
+		req.Body = reqBody
+	}
+	var capture *rawCapture
+	if p.captureBytes() > 0 {
+		capture = &rawCapture{}
+		req = req.WithContext(context.WithValue(req.Context(), rawCaptureKey, capture))
+	}
+	timer := &phaseTimer{start: time.Now()}
+	req = req.WithContext(context.WithValue(req.Context(), phaseTimerKey, timer))
+	// added latency holds back the first byte, throttling paces the body,
+	// the rule is looked up ahead so its name is among the matched ones
+	latency, rate := p.responseDelay(r)
+	c.MatchedRules = core.MatchedRules(r.Context())
+	// HTTP/1.0 clients can't take a 1xx response
+	var informational *informationalRelay
+	if !p.cfg.DropInformational && r.ProtoAtLeast(1, 1) {
+		informational = &informationalRelay{w: w, filter: p.resHeaders}
+		req = req.WithContext(context.WithValue(req.Context(), informationalKey, informational))
+	}
+	response, err := p.do(c, req)
+	if informational != nil {
+		informational.finish()
 	}
-
-	response, err := client.Do(req)
 	if err != nil {
 		p.log.Error("client do request", zap.Error(err))
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		if capture != nil && p.cfg.LogMalformedBytes > 0 && malformedResponse(err) {
+			p.log.Warn("malformed upstream response", zap.String("host", req.Host),
+				zap.String("addr", c.UpstreamAddr), zap.ByteString("raw", capture.captured()))
+		}
+		if p.stale != nil && !requestTooLarge(err) && p.serveStale(w, r, req) {
+			p.log.Warn("upstream failed, served stale", zap.String("host", req.Host), zap.Error(err))
+			return
+		}
+		p.upstreamError(w, req, err)
 		return
 	}
+	resolve, _ := req.Context().Value(resolveDurationKey).(time.Duration)
+	c.Timings = timer.timings(resolve)
+	// the body outlives the observers unless one of them takes it over
+	defer c.CloseResponseBody()
+	defer p.execute.ObserveTransaction(c)
+	defer p.logSlow(c)
+	var debug *debugCapture
+	if p.debugRequested(r) {
+		debug = &debugCapture{max: p.cfg.DebugCapture.MaxBodyBytes}
+		if debug.max <= 0 {
+			debug.max = defaultDebugBodyBytes
+		}
+		defer p.logDebug(debug, c, r, req, response)
+	}
+	if p.latency != nil {
+		p.latency.observe(c.UpstreamAddr, time.Since(timer.start))
+	}
+	if p.metrics != nil {
+		p.metrics.add(string(c.RequestHeader.Host()), c.UpstreamAddr, response.StatusCode)
+	}
+	if reqBody != nil {
+		c.RequestBytes = reqBody.count()
+	}
+	if p.cfg.HostStats {
+		defer func() {
+			if reqBody != nil {
+				c.RequestBytes = reqBody.count()
+			}
+			p.hostStats.add(c)
+		}()
+	}
 	defer response.Body.Close()
-	for k, v := range response.Header {
-		if len(v) < 2 {
-			w.Header().Set(k, v[0])
-		} else {
-			w.Header().Set(k, strings.Join(v, ""))
+	if p.stale != nil && response.StatusCode >= 500 && p.serveStale(w, r, req) {
+		p.log.Warn("upstream failed, served stale", zap.String("host", req.Host), zap.Int("status", response.StatusCode))
+		return
+	}
+	// RFC 7230 section 3.3.3, Transfer-Encoding overrides Content-Length,
+	// net/http already drops the latter, never relay both. Only the raw
+	// bytes of plaintext responses tell there was a conflict
+	if len(response.TransferEncoding) > 0 {
+		if capture != nil && p.cfg.ConflictingLength == ConflictingLengthReject && conflictingLength(capture.captured()) {
+			p.log.Error("conflicting content length and transfer encoding",
+				zap.String("host", req.Host), zap.String("addr", c.UpstreamAddr))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
 		}
+		response.Header.Del("Content-Length")
 	}
-
-	buffer = p.bufferPool.Get()
-	writer = io.MultiWriter(w, buffer)
-
-	_, _ = io.Copy(writer, response.Body)
-	var reader io.Reader
-	switch response.Header.Get("Content-Encoding") {
-	case "br":
-		reader = brotli.NewReader(buffer)
-	case "gzip":
-		reader, err = gzip.NewReader(buffer)
-		if err != nil {
-			p.log.Error("gzip.NewReader", zap.Error(err))
+	if max := p.cfg.MaxResponseHeaders; max > 0 {
+		if fields := headerFields(response.Header); fields > max {
+			p.log.Error("too many response headers",
+				zap.String("host", req.Host), zap.Int("fields", fields), zap.Int("limit", max))
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+			return
 		}
-	default:
-		reader = buffer
 	}
-	//io.Copy(os.Stdout, reader)
-	reqHeader := &core.RequestHeader{}
-	reqHeader.SetHost(req.Host)
-	reqHeader.SetRequestURI(req.URL.RequestURI())
-	reqHeader.SetMethod(req.Method)
-	reqHeader.SetUserAgent(req.UserAgent())
-	reqHeader.SetContentType(req.Header.Get("Content-Type"))
-	if req.Header.Get("Connection") == "close" {
-		reqHeader.SetConnectionClose()
+	removeHopHeaders(response.Header)
+	p.transformResponse(r, response)
+	if p.cfg.RewriteLocation {
+		rewriteLocation(response.Header, r)
 	}
-	if req.URL.Scheme == "https" {
-		reqHeader.SetHTTPS()
+	if rule := p.cfg.Cookies; rule.Secure || rule.HttpOnly || rule.SameSite != "" {
+		rewriteCookies(response.Header, rule)
+	}
+	for k, v := range response.Header {
+		if !p.resHeaders.allowed(k) {
+			continue
+		}
+		// every field line is kept, a joined Set-Cookie is no cookie at all
+		w.Header()[k] = append([]string(nil), v...)
 	}
+	// stale copies keep the upstream's fields, not those of this client
+	var upstreamHeader http.Header
+	if p.stale != nil {
+		upstreamHeader = w.Header().Clone()
+	}
+	p.injectCookies(w.Header(), r, response)
+	if p.cfg.CORS.Enable {
+		p.setCORSHeaders(w.Header(), r)
+	}
+	if p.cfg.UpstreamAddrHeader {
+		w.Header().Set("X-Upstream-Addr", c.UpstreamAddr)
+	}
+
 	resHeader := &core.ResponseHeader{}
 	resHeader.SetContentType(response.Header.Get("Content-Type"))
 	resHeader.SetStatusCode(response.StatusCode)
+	c.ResponseHeader = resHeader
+	p.execute.RewriteResponseHeader(c.RequestHeader, c.ResponseHeader)
+
+	if latency > 0 && !sleep(ctx, latency) {
+		// the upstream deadline passed while holding back, nothing was sent
+		if clientCtx.Err() == nil {
+			header := w.Header()
+			for k := range header {
+				delete(header, k)
+			}
+			p.upstreamError(w, req, ctx.Err())
+		}
+		return
+	}
+	// the upstream deadline ends with the headers, a long download or
+	// event stream goes on
+	deadline.stop()
+	// bodies of unknown length are flushed as they arrive
+	client := &clientWriter{w: w, flush: response.ContentLength < 0}
+	if rate > 0 {
+		client.throttle = newThrottle(ctx, rate)
+	}
+	if p.streaming(response) {
+		client.flush = true
+		if p.filtersStream(response) {
+			w.Header().Del("Content-Length")
+		}
+		w.WriteHeader(resHeader.StatusCode())
+		p.stream(clientCtx, c, client, response, exchangeStart)
+		return
+	}
+	pool := core.SelectPool(p.poolRules, response.Header.Get("Content-Type"), p.bufferPool)
+	buffer = pool.Get()
+	writers := []io.Writer{client, buffer}
+	// with scanners the body is held back until every verdict is in, in
+	// strict mode until it decoded
+	var scan *bodyScan
+	// the transport decodes gzip bodies itself when it asked for them
+	strict := p.cfg.StrictDecompressionStatus > 0 && (p.contentEncoding(response) != "" || response.Uncompressed)
+	if scanners := p.execute.Scanners(); len(scanners) > 0 {
+		scan = p.startScan(ctx, scanners, response.Header.Get("Content-Type"), p.contentEncoding(response))
+		writers = append([]io.Writer{buffer}, scan.writers()...)
+	} else if strict {
+		writers = []io.Writer{buffer}
+	}
+	archives := newArchiveWriters(p.execute.ArchiveWriters(c.RequestHeader, c.ResponseHeader))
+	for _, archive := range archives {
+		writers = append(writers, archive)
+	}
+	writer = io.MultiWriter(writers...)
+
+	// held back bodies get their status once allowed
+	if scan == nil && !strict {
+		w.WriteHeader(resHeader.StatusCode())
+	}
+	n, err := io.Copy(writer, response.Body)
+	c.Timings.Total = time.Since(exchangeStart)
+	p.closeArchives(c, archives)
+	if scan != nil {
+		if scan.wait(err) == executor.VerdictBlock {
+			pool.Put(buffer)
+			p.audit(r, AuditScannerBlocked, "")
+			p.block(w, c)
+			return
+		}
+	}
+	if scan != nil || strict {
+		if strict && ctx.Err() == nil {
+			derr := err
+			if err == nil {
+				derr = p.checkDecoding(p.contentEncoding(response), buffer.Bytes())
+			}
+			if derr != nil && (err == nil || response.Uncompressed) {
+				pool.Put(buffer)
+				p.decodingFailed(w, c, derr)
+				return
+			}
+		}
+		// a truncated body held back isn't sent at all
+		if err == nil {
+			w.WriteHeader(resHeader.StatusCode())
+			_, err = client.Write(buffer.Bytes())
+		}
+	}
+	// the upstream deadline passing mid-body is an upstream failure
+	if err != nil && (client.err != nil || clientCtx.Err() != nil) {
+		cancel()
+		pool.Put(buffer)
+		p.log.Warn("client disconnected, partial transfer",
+			zap.ByteString("host", c.RequestHeader.Host()),
+			zap.ByteString("uri", c.RequestHeader.RequestURI()),
+			zap.Int64("bytes", n), zap.Error(err))
+		return
+	}
+	if err != nil {
+		pool.Put(buffer)
+		p.upstreamTruncated(w, c, n, err, scan == nil && !strict)
+		return
+	}
+	if p.stale != nil && err == nil {
+		p.stale.store(req, resHeader.StatusCode(), upstreamHeader, buffer.Bytes())
+	}
 
-	copyWriter := io.MultiWriter(p.execute.Writer(reqHeader, resHeader)...)
+	encoding := p.contentEncoding(response)
+	body := newPooledBody(pool, buffer, p.cfg.BodyIdleTimeout, func() {
+		p.log.Warn("response body idle, buffer detached",
+			zap.ByteString("host", c.RequestHeader.Host()),
+			zap.ByteString("uri", c.RequestHeader.RequestURI()),
+			zap.Duration("timeout", p.cfg.BodyIdleTimeout))
+	})
+	c.ResponseBytes = n
+	source := io.Reader(core.NewLazyReader(func() (io.Reader, error) {
+		return p.decodeReader(encoding, body, resHeader), nil
+	}))
+	// handlers are picked by the content type, sniffed before they are
+	source = p.sniffContentType(source, response.Header.Get("Content-Type"), resHeader)
+	decoded := &countingReader{r: source}
+	c.ResponseBody = &decodedBody{countingReader: decoded, body: body}
+	writers = p.execute.Writer(c.RequestHeader, c.ResponseHeader)
+	consumers := p.execute.BodyConsumers(c.RequestHeader, c.ResponseHeader)
+	for _, consumer := range consumers {
+		writers = append(writers, consumer)
+	}
+	if debug != nil {
+		writers = append(writers, debug)
+	}
+	if len(writers) > 0 {
+		io.Copy(io.MultiWriter(writers...), c.ResponseBody)
+	}
+	c.DecodedBytes = decoded.count()
+	for _, consumer := range consumers {
+		consumer.Close()
+	}
+}
 
-	io.Copy(copyWriter, reader)
-	p.bufferPool.Put(buffer)
+// clientWriter records the first error writing to the client, flushing
+// every write when flush is set.
+type clientWriter struct {
+	w        http.ResponseWriter
+	flush    bool
+	throttle *throttle
+	err      error
+}
 
+func (c *clientWriter) Write(b []byte) (int, error) {
+	if c.throttle != nil {
+		return c.throttle.write(c.write, b)
+	}
+	return c.write(b)
 }
 
-func (p *HttpProxy) modifyRequest(r *http.Request) (*http.Request, error) {
-	req := r.Clone(context.Background())
-	ips, err := p.resolver.Get(req.Host)
+func (c *clientWriter) write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err != nil && c.err == nil {
+		c.err = err
+	}
+	if err == nil && c.flush {
+		if flusher, ok := c.w.(http.Flusher); ok {
+			flusher.Flush()
+		}
+	}
+	return n, err
+}
+
+// archiveWriter keeps a failing archive from failing the transfer, the
+// archive takes nothing after its first error.
+type archiveWriter struct {
+	w   io.WriteCloser
+	err error
+}
+
+func newArchiveWriters(archives []io.WriteCloser) []*archiveWriter {
+	writers := make([]*archiveWriter, len(archives))
+	for i, archive := range archives {
+		writers[i] = &archiveWriter{w: archive}
+	}
+	return writers
+}
+
+func (a *archiveWriter) Write(b []byte) (int, error) {
+	if a.err == nil {
+		_, a.err = a.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// closeArchives closes the archives of c, logging those that failed.
+func (p *HttpProxy) closeArchives(c *core.Context, archives []*archiveWriter) {
+	for _, archive := range archives {
+		err := archive.w.Close()
+		if archive.err != nil {
+			err = archive.err
+		}
+		if err != nil {
+			p.log.Error("archive body",
+				zap.ByteString("host", c.RequestHeader.Host()),
+				zap.ByteString("uri", c.RequestHeader.RequestURI()), zap.Error(err))
+		}
+	}
+}
+
+// decodeReader returns the decoded body, stopping at the configured size
+// or ratio limit and marking resHeader as truncated when the decoded body
+// exceeds it.
+// The raw body is returned when it can't be decoded.
+func (p *HttpProxy) decodeReader(encoding string, body *pooledBody, resHeader *core.ResponseHeader) io.Reader {
+	if encoding == "" {
+		return body
+	}
+	in := &countingReader{r: body}
+	reader, err := decodeBody(encoding, in)
 	if err != nil {
-		return nil, fmt.Errorf("domain %s resolver err: %s", req.Host, err)
+		p.logDecodeError("decompress body", encoding, err)
+		body.rewind()
+		return body
+	}
+	if ratio := p.cfg.MaxDecompressionRatio; ratio > 0 {
+		reader = &ratioReader{r: reader, in: in, ratio: ratio, onExceed: func() {
+			resHeader.SetTruncated()
+			p.log.Warn("decompression ratio exceeds limit, truncated", zap.String("encoding", encoding), zap.Float64("ratio", ratio))
+		}}
+	}
+	if max := p.cfg.MaxDecompressedBytes; max > 0 {
+		reader = newTruncateReader(reader, max, func() {
+			resHeader.SetTruncated()
+			p.log.Warn("decompressed body exceeds limit, truncated", zap.String("encoding", encoding), zap.Int64("limit", max))
+		})
+	}
+	return reader
+}
+
+// logDecodeError logs a failure to decode a body. An unavailable decoder
+// fails alike for every body, it is logged once.
+func (p *HttpProxy) logDecodeError(msg, encoding string, err error) {
+	initErr, ok := err.(*decoderInitError)
+	if !ok {
+		p.log.Error(msg, zap.String("encoding", encoding), zap.Error(err))
+		return
+	}
+	if _, logged := p.badDecoders.LoadOrStore(initErr.encoding, true); !logged {
+		p.log.Error("decoder unavailable, bodies passed through raw", zap.String("encoding", encoding), zap.Error(err))
+	}
+}
+
+// contentEncoding returns the encoding the body is decoded from, none in
+// raw body mode where handlers see the bytes sent by the origin and for
+// bodyless responses.
+func (p *HttpProxy) contentEncoding(response *http.Response) string {
+	if p.cfg.RawBody || !hasBody(response) {
+		return ""
+	}
+	return response.Header.Get("Content-Encoding")
+}
+
+// hasBody reports whether the response may carry a body, a 304 keeps the
+// Content-Encoding of the cached representation without one.
+func hasBody(response *http.Response) bool {
+	switch {
+	case response.StatusCode == http.StatusNotModified,
+		response.StatusCode == http.StatusNoContent,
+		response.StatusCode < 200,
+		response.Request != nil && response.Request.Method == http.MethodHead:
+		return false
+	}
+	return true
+}
+
+// headerFields returns the number of header fields, counting every value.
+func headerFields(header http.Header) int {
+	n := 0
+	for _, v := range header {
+		n += len(v)
+	}
+	return n
+}
+
+// lowerRuleHosts returns cfg with the hosts of its rules lowercased, as the
+// request hosts they are compared with. The rules are copied, those of the
+// caller are left alone.
+func lowerRuleHosts(cfg config.Proxy) config.Proxy {
+	cfg.Faults = append([]config.FaultRule(nil), cfg.Faults...)
+	for i := range cfg.Faults {
+		cfg.Faults[i].Host = strings.ToLower(cfg.Faults[i].Host)
+	}
+	cfg.StaticRoutes = append([]config.StaticRoute(nil), cfg.StaticRoutes...)
+	for i := range cfg.StaticRoutes {
+		cfg.StaticRoutes[i].Host = strings.ToLower(cfg.StaticRoutes[i].Host)
+	}
+	cfg.Timeouts = append([]config.TimeoutRule(nil), cfg.Timeouts...)
+	for i := range cfg.Timeouts {
+		cfg.Timeouts[i].Host = strings.ToLower(cfg.Timeouts[i].Host)
 	}
+	cfg.ResponseDelay.Rules = append([]config.ResponseDelayRule(nil), cfg.ResponseDelay.Rules...)
+	for i := range cfg.ResponseDelay.Rules {
+		cfg.ResponseDelay.Rules[i].Host = strings.ToLower(cfg.ResponseDelay.Rules[i].Host)
+	}
+	cfg.Mirror.Rules = append([]config.MirrorRule(nil), cfg.Mirror.Rules...)
+	for i := range cfg.Mirror.Rules {
+		cfg.Mirror.Rules[i].Host = strings.ToLower(cfg.Mirror.Rules[i].Host)
+	}
+	cfg.SetCookies = append([]config.SetCookie(nil), cfg.SetCookies...)
+	for i := range cfg.SetCookies {
+		cfg.SetCookies[i].Host = strings.ToLower(cfg.SetCookies[i].Host)
+	}
+	cfg.PAC.Host = strings.ToLower(cfg.PAC.Host)
+	return cfg
+}
+
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// methodAllowed reports whether method may be proxied, all methods are
+// allowed when no allowed methods are configured.
+func (p *HttpProxy) methodAllowed(method string) bool {
+	if p.allowedMethods == nil {
+		// TRACE echoes the request back, credentials included (XST)
+		return method != http.MethodTrace || p.cfg.AllowTrace
+	}
+	return p.allowedMethods[method]
+}
+
+// optionsAsterisk answers a server wide "OPTIONS *" request locally with
+// the allowed methods.
+func (p *HttpProxy) optionsAsterisk(w http.ResponseWriter) {
+	w.Header().Set("Allow", p.allow)
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+// requestHeader captures the request as received from the client, before
+// any executor rewrites it, uri being the request URI the client sent.
+func (p *HttpProxy) requestHeader(r *http.Request, uri string) *core.RequestHeader {
+	reqHeader := &core.RequestHeader{}
+	reqHeader.SetHost(r.Host)
+	reqHeader.SetRequestURI(uri)
+	reqHeader.SetMethod(r.Method)
+	reqHeader.SetUserAgent(r.UserAgent())
+	// the Referer as the client sent it, whatever the referer policy
+	reqHeader.SetReferer(r.Referer())
+	reqHeader.SetAcceptLanguage(r.Header.Get("Accept-Language"))
+	reqHeader.SetContentType(r.Header.Get("Content-Type"))
+	// set for a Connection: close and a HTTP/1.0 request without keep-alive
+	if r.Close {
+		reqHeader.SetConnectionClose()
+	}
+	if r.TLS != nil {
+		reqHeader.SetHTTPS()
+	}
+	return reqHeader
+}
+
+func (p *HttpProxy) modifyRequest(r *http.Request) (*http.Request, error) {
+	req := r.Clone(r.Context())
 	if req.TLS == nil {
 		req.URL.Scheme = "http"
 	} else {
 		req.URL.Scheme = "https"
 	}
+	req.URL.Host = req.Host
+	req.RequestURI = ""
+	// asterisk-form has no path, Opaque keeps the transport from adding one
+	if r.RequestURI == "*" {
+		req.URL.Path, req.URL.RawPath, req.URL.Opaque = "", "", "*"
+	}
+	removeHopHeaders(req.Header)
+	collapseHeaders(req.Header, p.cfg.CollapseRequestHeaders)
+	applyRefererPolicy(req.Header, p.cfg.Referer)
+	if p.cfg.AcceptLanguage != "" {
+		req.Header.Set("Accept-Language", p.cfg.AcceptLanguage)
+	}
+	// debug requests are a matter between the client and the proxy
+	if len(p.debugPeers) > 0 {
+		req.Header.Del(DebugHeader)
+	}
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Del("Content-Length")
+	}
+	if p.cfg.Forwarded.Enable {
+		p.setForwarded(req, r)
+	}
+	p.execute.RewriteRequest(req)
+	req.Host = req.URL.Host
+
+	resolveStart := time.Now()
+	var ips []string
+	var err error
+	// redirected connections go where they were headed, unless rewritten
+	if dst, ok := r.Context().Value(originalDstKey).(string); ok && req.Host == r.Host {
+		ips = []string{dst}
+	} else {
+		ips, err = p.resolver.Get(req.Host)
+	}
+	resolve := time.Since(resolveStart)
+	if err != nil {
+		if p.cfg.FallbackUpstream == "" {
+			return nil, fmt.Errorf("domain %s resolver err: %w", req.Host, err)
+		}
+		p.log.Warn("resolve failed, using fallback upstream", zap.String("host", req.Host),
+			zap.String("fallback", p.cfg.FallbackUpstream), zap.Error(err))
+		ips = []string{p.cfg.FallbackUpstream}
+	} else if ips, err = p.allowedAddrs(req.Host, ips); err != nil {
+		return nil, err
+	}
 	//req.Header.Set("Accept-Encoding", "deflate")
-	//req.Header.Set("Connection", "close")
 	p.log.Debug("resolver request host", zap.String("host", req.Host), zap.Any("ip", ips))
-	req.URL.Host = ips[0]
-	req.RequestURI = ""
+	ctx := context.WithValue(req.Context(), upstreamHostKey, stripPort(req.Host))
+	ctx = context.WithValue(ctx, resolveDurationKey, resolve)
+	port := p.upstreamPort(req)
+	if p.latency != nil {
+		ips = p.latency.order(ips, port)
+	}
+	if p.weights != nil {
+		ips = p.weights.order(ips, port)
+	}
+	req = req.WithContext(context.WithValue(ctx, upstreamAddrsKey, ips))
+	// connections are pooled by URL.Host, a TLS connection is bound to the
+	// SNI and pins of its host though, so hosts sharing an address don't
+	// share them, the dial still goes to the resolved addresses
+	if req.URL.Scheme == "https" {
+		req.URL.Host = net.JoinHostPort(strings.Trim(stripPort(req.Host), "[]"), port)
+	} else if _, _, err := net.SplitHostPort(ips[0]); err == nil {
+		req.URL.Host = ips[0]
+	} else {
+		req.URL.Host = net.JoinHostPort(ips[0], port)
+	}
 	return req, nil
 }
 
+// rewriteRequestBody buffers the request body for the body rewriters and
+// forwards the result with its length, chunked bodies are sent sized.
+// Multipart uploads stream through unbuffered, not rewritten.
+func (p *HttpProxy) rewriteRequestBody(c *core.Context, req *http.Request) error {
+	if req.Body == nil || req.Body == http.NoBody || !p.execute.HasRequestBodyRewriters() || isMultipart(req) {
+		return nil
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	body = p.execute.RewriteRequestBody(c.RequestHeader, body)
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.ContentLength = int64(len(body))
+	req.TransferEncoding = nil
+	req.Header.Del("Transfer-Encoding")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// inspectRequestBody sets the decoded request body on c when the raw body
+// fits max, it is forwarded as received. Larger bodies stream on unread,
+// multipart ones with their prefix inspected.
+func (p *HttpProxy) inspectRequestBody(c *core.Context, req *http.Request, max int64) error {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		req.Body.Close()
+		return err
+	}
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(raw), req.Body), req.Body}
+	encoding := req.Header.Get("Content-Encoding")
+	if int64(len(raw)) > max {
+		// the upload streams on, its prefix is all that is inspected
+		if encoding == "" && isMultipart(req) {
+			c.RequestBody, c.RequestBodyTruncated = raw[:max], true
+		}
+		return nil
+	}
+	if encoding == "" {
+		c.RequestBody = raw
+		return nil
+	}
+	reader, err := decodeBody(encoding, bytes.NewReader(raw))
+	if err != nil {
+		p.logDecodeError("decompress request body", encoding, err)
+		return nil
+	}
+	truncated := false
+	decoded, err := ioutil.ReadAll(newTruncateReader(reader, max, func() { truncated = true }))
+	if err != nil {
+		p.log.Error("decompress request body", zap.String("encoding", encoding), zap.Error(err))
+		return nil
+	}
+	if truncated {
+		p.log.Warn("decompressed request body exceeds limit, not inspected", zap.String("encoding", encoding), zap.Int64("limit", max))
+		return nil
+	}
+	c.RequestBody = decoded
+	return nil
+}
+
+// isMultipart reports whether req uploads a multipart/form-data body, of
+// files usually, which isn't buffered.
+func isMultipart(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// upstreamPort returns the port of the request host, falling back to the
+// configured default port and then to the scheme default.
+func (p *HttpProxy) upstreamPort(req *http.Request) string {
+	if _, port, err := net.SplitHostPort(req.Host); err == nil && port != "" {
+		return port
+	}
+	if p.cfg.DefaultPort > 0 {
+		return strconv.Itoa(p.cfg.DefaultPort)
+	}
+	if req.URL.Scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// listen announces on addr, accepting the PROXY protocol from trusted
+// peers when enabled.
+func (p *HttpProxy) listen(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if p.cfg.ProxyProtocol.Enable {
+		return newProxyProtoListener(ln, p.cfg.ProxyProtocol, p.log)
+	}
+	return ln, nil
+}
+
 func (p *HttpProxy) ListenAndServe(addr string) error {
+	return p.ListenAndServeAll(addr)
+}
+
+// ListenAndServeAll listens on every address and serves them together, see
+// Serve.
+func (p *HttpProxy) ListenAndServeAll(addrs ...string) error {
+	listeners := make([]net.Listener, 0, len(addrs))
+	for _, addr := range addrs {
+		ln, err := p.listen(addr)
+		if err != nil {
+			for _, ln := range listeners {
+				ln.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, ln)
+	}
+	return p.Serve(listeners...)
+}
+
+// Serve serves plaintext connections on every listener with one server,
+// until Shutdown or the first listener failing, which closes the others.
+// The first error is returned.
+func (p *HttpProxy) Serve(listeners ...net.Listener) error {
+	if len(listeners) == 0 {
+		return errors.New("no listener to serve")
+	}
+	server := p.trackServer(&http.Server{
+		Handler:                      p.h2cHandler(),
+		DisableGeneralOptionsHandler: true,
+	})
+	if p.cfg.Transparent {
+		server.ConnContext = p.transparentConnContext
+	}
+	if len(p.cfg.Prewarm.Hosts) > 0 {
+		done := make(chan struct{})
+		defer close(done)
+		go p.keepWarm(done)
+	}
+	errs := make(chan error, len(listeners))
+	for _, ln := range listeners {
+		go func(ln net.Listener) {
+			errs <- server.Serve(ln)
+		}(ln)
+	}
+	var first error
+	for range listeners {
+		err := <-errs
+		if first == nil {
+			first = err
+			if err != http.ErrServerClosed {
+				server.Close()
+			}
+		}
+	}
+	return first
+}
+
+// trackedServer counts the open client connections of a server, for the
+// connections left to close once the drain timeout is over.
+type trackedServer struct {
+	*http.Server
+	conns int64
+}
+
+// trackServer registers server to be stopped by Shutdown.
+func (p *HttpProxy) trackServer(server *http.Server) *http.Server {
+	tracked := &trackedServer{Server: server}
+	connState := server.ConnState
+	server.ConnState = func(conn net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&tracked.conns, 1)
+			if p.connLimit == nil {
+				break
+			}
+			if ip, ok := p.connLimit.acquire(conn); !ok {
+				p.log.Warn("too many connections", zap.String("ip", ip), zap.Int("limit", p.connLimit.limit))
+				conn.Close()
+			}
+		case http.StateHijacked:
+			// a tunnel holds on to its slot until it ends, see trackTunnel
+			atomic.AddInt64(&tracked.conns, -1)
+		case http.StateClosed:
+			atomic.AddInt64(&tracked.conns, -1)
+			if p.connLimit != nil {
+				p.connLimit.release(conn)
+			}
+		}
+		if connState != nil {
+			connState(conn, state)
+		}
+	}
+	p.serversMu.Lock()
+	p.servers = append(p.servers, tracked)
+	p.serversMu.Unlock()
+	return server
+}
+
+// Shutdown gracefully stops every server started by the proxy, see
+// http.Server.Shutdown. With a DrainTimeout, connections still active once
+// it is over are closed and Shutdown returns, with the error of ctx if it
+// ended first.
+func (p *HttpProxy) Shutdown(ctx context.Context) error {
+	p.serversMu.Lock()
+	servers := p.servers
+	p.servers = nil
+	p.serversMu.Unlock()
+	drain := ctx
+	if timeout := p.cfg.DrainTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		drain, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	// every listener stops at once, none keeps accepting while another
+	// one drains
+	errs := make([]error, len(servers))
+	var closed int64
+	var wg sync.WaitGroup
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *trackedServer) {
+			defer wg.Done()
+			err := server.Shutdown(drain)
+			if err != nil && p.cfg.DrainTimeout > 0 && drain.Err() != nil {
+				atomic.AddInt64(&closed, atomic.LoadInt64(&server.conns))
+				server.Close()
+				err = ctx.Err()
+			}
+			errs[i] = err
+		}(i, server)
+	}
+	wg.Wait()
+	var first error
+	for _, err := range errs {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	// hijacked tunnels are unknown to the servers, they don't end by
+	// themselves
+	if tunnels := p.closeTunnels(); tunnels > 0 {
+		p.log.Warn("shutdown, tunnels closed", zap.Int("tunnels", tunnels))
+	}
+	if closed > 0 {
+		p.log.Warn("drain timeout, connections closed",
+			zap.Duration("timeout", p.cfg.DrainTimeout), zap.Int64("connections", closed))
+	}
+	return first
+}
 
-	return http.ListenAndServe(addr, p)
+// h2cHandler serves clients sending the HTTP/2 connection preface with prior
+// knowledge over plaintext, which would otherwise reach ServeHTTP as a
+// bogus "PRI *" request.
+func (p *HttpProxy) h2cHandler() http.Handler {
+	return h2c.NewHandler(p, &http2.Server{})
 }
 
 func (p *HttpProxy) ListenAndServeTLS(addr string, certFile string, keyFile string) error {
+	ln, err := p.listen(addr)
+	if err != nil {
+		return err
+	}
+	return p.serveTLS(ln, certFile, keyFile)
+}
 
-	return http.ListenAndServeTLS(addr, certFile, keyFile, p)
+// ListenAndServeMux serves plaintext and TLS connections on one address,
+// telling them apart by their first bytes.
+func (p *HttpProxy) ListenAndServeMux(addr string, certFile string, keyFile string) error {
+	ln, err := p.listen(addr)
+	if err != nil {
+		return err
+	}
+	mux := NewMux(ln, muxPeekBytes, p.log)
+	tlsLn, plainLn := mux.Listener(MatchTLS), mux.Listener(MatchHTTP)
+	go mux.Serve()
+	defer mux.Close()
+	errs := make(chan error, 2)
+	go func() { errs <- p.serveTLS(tlsLn, certFile, keyFile) }()
+	go func() { errs <- p.Serve(plainLn) }()
+	first := <-errs
+	// the other server goes down with the mux
+	mux.Close()
+	if err := <-errs; first == errMuxClosed {
+		first = err
+	}
+	return first
+}
+
+func (p *HttpProxy) serveTLS(ln net.Listener, certFile string, keyFile string) error {
+	certs, err := p.certStore(certFile, keyFile)
+	if err != nil {
+		ln.Close()
+		return err
+	}
+	server := p.trackServer(&http.Server{
+		Handler:     p,
+		TLSConfig:   p.serverTLSConfig(certs.GetCertificate),
+		ConnContext: tlsConnContext,
+		// "OPTIONS *" is answered by ServeHTTP
+		DisableGeneralOptionsHandler: true,
+	})
+	return server.ServeTLS(ln, "", "")
+}
+
+// ListenAndServeMITM serves TLS connections with leaf certificates issued by
+// the given generator for the SNI of each client.
+func (p *HttpProxy) ListenAndServeMITM(addr string, certs *CertGenerator) error {
+	ln, err := p.listen(addr)
+	if err != nil {
+		return err
+	}
+	server := p.trackServer(&http.Server{
+		Handler:     p,
+		TLSConfig:   p.serverTLSConfig(certs.GetCertificate),
+		ConnContext: tlsConnContext,
+		// "OPTIONS *" is answered by ServeHTTP
+		DisableGeneralOptionsHandler: true,
+	})
+	return server.ServeTLS(ln, "", "")
 }
@@ -0,0 +1,3890 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/millken/httpctl/resolver"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/net/http2"
+)
+
+type testResolver map[string][]string
+
+func (r testResolver) Get(host string) ([]string, error) {
+	if idx := strings.Index(host, ":"); idx > -1 {
+		host = host[:idx]
+	}
+	ips, found := r[host]
+	if !found {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	return ips, nil
+}
+
+type testExecutor func(*core.RequestHeader, *core.ResponseHeader) io.Writer
+
+func (e testExecutor) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return e(req, res)
+}
+
+// testHost returns host with the port of backend.
+func testHost(backend *httptest.Server, host string) string {
+	u, _ := url.Parse(backend.URL)
+	return host + ":" + u.Port()
+}
+
+// testURL returns the url of path on host served by backend.
+func testURL(backend *httptest.Server, host, path string) string {
+	u, _ := url.Parse(backend.URL)
+	return u.Scheme + "://" + testHost(backend, host) + path
+}
+
+func testProxy(cfg config.Proxy, resolver Resolver) *HttpProxy {
+	return newTestProxy(cfg, resolver, executor.NewExecutor(context.Background(), config.Executor{}))
+}
+
+// newTestProxy creates a proxy from a config the test knows to be valid.
+func newTestProxy(cfg config.Proxy, resolver Resolver, execute *executor.Execute) *HttpProxy {
+	p, err := NewHttpProxy(cfg, resolver, execute)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func TestHttpProxy_AllowedMethods(t *testing.T) {
+	require := require.New(t)
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{AllowedMethods: []string{"get", "HEAD"}},
+		testResolver{"example.com": {"127.0.0.1"}})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", testURL(backend, "example.com", "/"), strings.NewReader("data")))
+	require.Equal(http.StatusMethodNotAllowed, w.Code)
+	require.Equal("GET, HEAD", w.Header().Get("Allow"))
+	require.Equal(int32(0), atomic.LoadInt32(&hits))
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("ok", w.Body.String())
+	require.Equal(int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestHttpProxy_RewriteRequest(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(stripPort(r.Host) + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	p := newTestProxy(config.Proxy{}, testResolver{"new.example": {"127.0.0.1"}},
+		executor.NewExecutor(context.Background(), config.Executor{
+			Rewrite: config.RewriteExecutor{Enable: true, Rules: []config.RewriteRule{
+				{Host: "Old.Example", Path: "/v1/", ToHost: "new.example", ToPath: "/v2/"},
+			}},
+		}))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "old.example", "/v1/users"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("new.example/v2/users", w.Body.String())
+}
+
+func TestHttpProxy_RewriteQuery(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.RequestURI()))
+	}))
+	defer backend.Close()
+
+	var queries []url.Values
+	execute := executor.NewExecutor(context.Background(), config.Executor{
+		Rewrite: config.RewriteExecutor{Enable: true, Rules: []config.RewriteRule{
+			{Path: "/api/", Query: []config.QueryMatch{{Name: "debug", Value: "1"}},
+				ToPath: "/debug/", DelQuery: []string{"debug"}},
+			{Path: "/api/", Query: []config.QueryMatch{{Name: "v", Regex: `^2\.\d+$`}},
+				ToPath: "/v2/", SetQuery: map[string]string{"compat": "1"}},
+			{Path: "/api/", Query: []config.QueryMatch{{Name: "beta"}}, ToPath: "/beta/"},
+		}},
+	})
+	execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		queries = append(queries, req.QueryArgs())
+		return nil
+	}))
+	p := newTestProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}, execute)
+	for path, want := range map[string]string{
+		"/api/users?debug=1&id=7": "/debug/users?id=7",
+		"/api/users?debug=0":      "/api/users?debug=0",
+		"/api/users?v=2.1":        "/v2/users?compat=1&v=2.1",
+		"/api/users?v=3.1":        "/api/users?v=3.1",
+		"/api/users?beta":         "/beta/users?beta",
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", path), nil))
+		require.Equal(want, w.Body.String(), path)
+	}
+	require.Contains(queries, url.Values{"debug": {"1"}, "id": {"7"}})
+}
+
+func TestHttpProxy_RewriteHeader(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	execute := executor.NewExecutor(context.Background(), config.Executor{
+		Rewrite: config.RewriteExecutor{Enable: true, Rules: []config.RewriteRule{
+			{Path: "/api/", Header: []config.QueryMatch{{Name: "x-api-version", Value: "1"}}, ToPath: "/v1/"},
+			{Path: "/api/", Header: []config.QueryMatch{{Name: "X-Api-Version", Regex: `^2\.\d+$`}}, ToPath: "/v2/"},
+			{Path: "/api/", Header: []config.QueryMatch{{Name: "X-Beta"}}, ToPath: "/beta/"},
+		}},
+	})
+	p := newTestProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}, execute)
+	serve := func(header http.Header) string {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/api/users"), nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	require.Equal("/v1/users", serve(http.Header{"X-Api-Version": {"1"}}))
+	require.Equal("/v2/users", serve(http.Header{"X-Api-Version": {"2.3"}}))
+	require.Equal("/api/users", serve(http.Header{"X-Api-Version": {"3"}}))
+	require.Equal("/beta/users", serve(http.Header{"X-Beta": {""}}))
+	require.Equal("/api/users", serve(http.Header{}))
+}
+
+func TestHttpProxy_CollapseRequestHeaders(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q %q", r.Header["Accept"], r.Header["Cookie"])
+	}))
+	defer backend.Close()
+
+	serve := func(cfg config.Proxy) string {
+		p := testProxy(cfg, testResolver{"example.com": {"127.0.0.1"}})
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		r.Header.Add("Accept", "text/html")
+		r.Header.Add("Accept", "application/json;q=0.9")
+		r.Header.Add("Cookie", "a=1")
+		r.Header.Add("Cookie", "b=2")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String()
+	}
+	require.Equal(`["text/html" "application/json;q=0.9"] ["a=1" "b=2"]`, serve(config.Proxy{}))
+	require.Equal(`["text/html, application/json;q=0.9"] ["a=1; b=2"]`,
+		serve(config.Proxy{CollapseRequestHeaders: []string{"accept", "Cookie"}}))
+}
+
+func TestHttpProxy_ServeListeners(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		listeners = append(listeners, ln)
+	}
+	done := make(chan error, 1)
+	go func() { done <- p.Serve(listeners...) }()
+
+	for _, ln := range listeners {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+		req.Host = testHost(backend, "example.com")
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		body, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.Equal("ok", string(body))
+	}
+
+	require.NoError(p.Shutdown(context.Background()))
+	require.Equal(http.ErrServerClosed, <-done)
+	for _, ln := range listeners {
+		_, err := net.Dial("tcp", ln.Addr().String())
+		require.Error(err)
+	}
+}
+
+func TestHttpProxy_ShutdownDrainTimeout(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer close(release)
+
+	p := testProxy(config.Proxy{DrainTimeout: 100 * time.Millisecond}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	done := make(chan error, 1)
+	go func() { done <- p.Serve(ln) }()
+
+	hung := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+		req.Host = testHost(backend, "example.com")
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		hung <- err
+	}()
+	require.Eventually(func() bool { return len(p.ActiveConnections()) == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	start := time.Now()
+	require.NoError(p.Shutdown(context.Background()))
+	require.True(time.Since(start) < time.Second)
+	require.Equal(http.ErrServerClosed, <-done)
+	require.Error(<-hung)
+	entries := logs.FilterMessage("drain timeout, connections closed").AllUntimed()
+	require.Len(entries, 1)
+	require.Equal(int64(1), entries[0].ContextMap()["connections"])
+}
+
+func TestHttpProxy_ShutdownStopsListenersTogether(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer backend.Close()
+	defer func() {
+		select {
+		case <-release:
+		default:
+			close(release)
+		}
+	}()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var listeners []net.Listener
+	for i := 0; i < 2; i++ {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		listeners = append(listeners, ln)
+	}
+	// a server each, the first one registered drains first
+	servers := func(n int) func() bool {
+		return func() bool {
+			p.serversMu.Lock()
+			defer p.serversMu.Unlock()
+			return len(p.servers) == n
+		}
+	}
+	go p.Serve(listeners[0])
+	require.Eventually(servers(1), 5*time.Second, 5*time.Millisecond)
+	go p.Serve(listeners[1])
+	require.Eventually(servers(2), 5*time.Second, 5*time.Millisecond)
+
+	// a request hangs on the first listener
+	hung := make(chan error, 1)
+	go func() {
+		req, _ := http.NewRequest("GET", "http://"+listeners[0].Addr().String()+"/", nil)
+		req.Host = testHost(backend, "example.com")
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		hung <- err
+	}()
+	require.Eventually(func() bool { return len(p.ActiveConnections()) == 1 }, 5*time.Second, 5*time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+	// the second listener is closed while the first one drains
+	require.Eventually(func() bool {
+		conn, err := net.Dial("tcp", listeners[1].Addr().String())
+		if err == nil {
+			conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 5*time.Millisecond)
+	select {
+	case <-shutdown:
+		t.Fatal("shutdown returned before the drain")
+	default:
+	}
+	close(release)
+	require.NoError(<-shutdown)
+	require.NoError(<-hung)
+}
+
+func TestHttpProxy_H2CPriorKnowledge(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	front := httptest.NewServer(p.h2cHandler())
+	defer front.Close()
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http2.Transport{
+			AllowHTTP: true,
+			DialTLS: func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				return net.Dial(network, addr)
+			},
+		},
+	}
+	req, err := http.NewRequest("GET", front.URL+"/", nil)
+	require.NoError(err)
+	req.Host = testHost(backend, "example.com")
+	res, err := client.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal(2, res.ProtoMajor)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("ok", string(body))
+}
+
+func TestHttpProxy_MaxDecompressedBytes(t *testing.T) {
+	require := require.New(t)
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(bomb.Bytes())
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxDecompressedBytes: 4096}, testResolver{"example.com": {"127.0.0.1"}})
+	var seen bytes.Buffer
+	var resHeader *core.ResponseHeader
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		resHeader = res
+		return &seen
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	p.ServeHTTP(w, r)
+	require.Equal(bomb.Len(), w.Body.Len())
+	require.True(resHeader.Truncated())
+	require.Equal(4096, seen.Len())
+}
+
+func TestHttpProxy_RegisterDecoder(t *testing.T) {
+	require := require.New(t)
+	rot13 := func(b []byte) []byte {
+		out := make([]byte, len(b))
+		for i, c := range b {
+			switch {
+			case c >= 'a' && c <= 'z':
+				c = 'a' + (c-'a'+13)%26
+			case c >= 'A' && c <= 'Z':
+				c = 'A' + (c-'A'+13)%26
+			}
+			out[i] = c
+		}
+		return out
+	}
+	RegisterDecoder("X-Rot13", func(r io.Reader) (io.Reader, error) {
+		body, err := ioutil.ReadAll(r)
+		return bytes.NewReader(rot13(body)), err
+	})
+	defer func() {
+		decodersMu.Lock()
+		delete(decoders, "x-rot13")
+		decodersMu.Unlock()
+	}()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "x-rot13")
+		w.Write(rot13([]byte("Hello, World")))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var seen bytes.Buffer
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return &seen
+	}))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal("Uryyb, Jbeyq", w.Body.String())
+	require.Equal("Hello, World", seen.String())
+}
+
+func TestHttpProxy_MaxDecompressionRatio(t *testing.T) {
+	require := require.New(t)
+	var bomb bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&bomb, gzip.BestCompression)
+	zw.Write(make([]byte, 16<<20))
+	zw.Close()
+	require.Greater(16<<20/bomb.Len(), 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(bomb.Bytes())
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxDecompressionRatio: 100}, testResolver{"example.com": {"127.0.0.1"}})
+	var seen countWriter
+	var resHeader *core.ResponseHeader
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		resHeader = res
+		return &seen
+	}))
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	p.ServeHTTP(w, r)
+	require.Equal(bomb.Len(), w.Body.Len())
+	require.True(resHeader.Truncated())
+	require.LessOrEqual(int64(seen), int64(100*bomb.Len()+32<<10))
+}
+
+// countWriter counts the bytes written to it.
+type countWriter int64
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	*c += countWriter(len(b))
+	return len(b), nil
+}
+
+func TestHttpProxy_TLSSessionResumption(t *testing.T) {
+	require := require.New(t)
+	var serverName string
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverName = r.TLS.ServerName
+		fmt.Fprint(w, r.TLS.DidResume)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	handshake := func() string {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		require.Equal(http.StatusOK, w.Code)
+		p.transport.CloseIdleConnections()
+		return w.Body.String()
+	}
+	require.Equal("false", handshake())
+	require.Equal("example.com", serverName)
+	require.Equal("true", handshake())
+}
+
+func TestHttpProxy_SNIPerHost(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.ServerName)
+	}))
+	defer backend.Close()
+
+	// both hosts resolve to the backend, each keeps its own name on the
+	// connections kept alive in between
+	p := testProxy(config.Proxy{}, testResolver{"a.example.com": {"127.0.0.1"}, "b.example.com": {"127.0.0.1"}})
+	for _, host := range []string{"a.example.com", "b.example.com", "a.example.com", "b.example.com"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, host, "/"), nil))
+		require.Equal(http.StatusOK, w.Code)
+		require.Equal(host, w.Body.String())
+	}
+}
+
+func TestHttpProxy_RateLimit(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		RateLimit: config.RateLimit{RequestsPerSecond: 1, Burst: 2},
+		Forwarded: config.Forwarded{TrustedPeers: []string{"10.0.0.0/8"}},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	now := time.Now()
+	p.limiter.now = func() time.Time { return now }
+	serve := func(remote, xff string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		r.RemoteAddr = remote
+		if xff != "" {
+			r.Header.Set("X-Forwarded-For", xff)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	require.Equal(http.StatusOK, serve("192.0.2.1:1000", "").Code)
+	require.Equal(http.StatusOK, serve("192.0.2.1:1001", "").Code)
+	w := serve("192.0.2.1:1002", "")
+	require.Equal(http.StatusTooManyRequests, w.Code)
+	require.Equal("1", w.Header().Get("Retry-After"))
+	// clients behind a trusted proxy have buckets of their own
+	require.Equal(http.StatusOK, serve("10.0.0.1:1000", "198.51.100.7").Code)
+	require.Equal(http.StatusOK, serve("10.0.0.1:1000", "198.51.100.7").Code)
+	require.Equal(http.StatusTooManyRequests, serve("10.0.0.1:1000", "198.51.100.7").Code)
+	require.Equal(http.StatusOK, serve("10.0.0.1:1000", "198.51.100.8").Code)
+
+	now = now.Add(time.Second)
+	require.Equal(http.StatusOK, serve("192.0.2.1:1003", "").Code)
+	require.Equal(http.StatusTooManyRequests, serve("192.0.2.1:1004", "").Code)
+
+	// idle buckets are evicted once refilled
+	now = now.Add(time.Minute)
+	require.Equal(http.StatusOK, serve("192.0.2.2:1000", "").Code)
+	require.Len(p.limiter.buckets, 1)
+}
+
+func TestHttpProxy_StaleIfError(t *testing.T) {
+	require := require.New(t)
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "good "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{StaleIfError: config.StaleIfError{Enable: true, Window: time.Minute}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", path), nil))
+		return w
+	}
+	w := get("/page")
+	require.Equal(http.StatusOK, w.Code)
+	require.Empty(w.Header().Get("Warning"))
+
+	atomic.StoreInt32(&failing, 1)
+	w = get("/page")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("good /page", w.Body.String())
+	require.Equal("text/plain", w.Header().Get("Content-Type"))
+	require.Equal([]string{`110 - "Response is Stale"`, `111 - "Revalidation Failed"`}, w.Header().Values("Warning"))
+	require.Equal(http.StatusServiceUnavailable, get("/other").Code)
+
+	backend.Close()
+	w = get("/page")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("good /page", w.Body.String())
+	require.NotEmpty(w.Header().Get("Warning"))
+}
+
+func TestHttpProxy_StaleVariants(t *testing.T) {
+	require := require.New(t)
+	var failing int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&failing) == 1 {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Path == "/agent" {
+			w.Header().Set("Vary", "User-Agent")
+			io.WriteString(w, r.UserAgent())
+			return
+		}
+		w.Header().Set("Vary", "Accept")
+		io.WriteString(w, r.Header.Get("Accept"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		StaleIfError:       config.StaleIfError{Enable: true, Window: time.Minute},
+		CORS:               config.CORS{Enable: true, Origins: []string{"https://a.example", "https://b.example"}},
+		UpstreamAddrHeader: true,
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	get := func(path, origin, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", path), nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	require.Equal(http.StatusOK, get("/page", "https://a.example", "application/json").Code)
+	require.Equal(http.StatusOK, get("/agent", "https://a.example", "").Code)
+
+	atomic.StoreInt32(&failing, 1)
+	w := get("/page", "https://b.example", "application/json")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("application/json", w.Body.String())
+	require.NotEmpty(w.Header().Get("Warning"))
+	// the fields added for the first client aren't replayed to the next
+	require.Equal("https://b.example", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Empty(w.Header().Get("X-Upstream-Addr"))
+	// neither are other variants served
+	require.Equal(http.StatusServiceUnavailable, get("/page", "https://b.example", "text/html").Code)
+	require.Equal(http.StatusServiceUnavailable, get("/agent", "https://b.example", "").Code)
+}
+
+func TestHttpProxy_CertPins(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pinned")
+	}))
+	defer backend.Close()
+	pin := "sha256/" + spkiHash(backend.Certificate().RawSubjectPublicKeyInfo)
+
+	serve := func(pins []string) *httptest.ResponseRecorder {
+		p := testProxy(config.Proxy{CertPins: map[string][]string{"example.com": pins}},
+			testResolver{"example.com": {"127.0.0.1"}})
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		return w
+	}
+	w := serve([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=", pin})
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("pinned", w.Body.String())
+
+	w = serve([]string{"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="})
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.Contains(w.Body.String(), "upstream certificate pin mismatch")
+
+	// the pins are keyed case-insensitively, and a connection pooled for one
+	// host isn't reused for another host on the same address
+	p := testProxy(config.Proxy{CertPins: map[string][]string{
+		"Example.COM": {pin},
+		"other.com":   {"sha256/AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="},
+	}}, testResolver{"example.com": {"127.0.0.1"}, "other.com": {"127.0.0.1"}})
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "other.com", "/"), nil))
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.Contains(w.Body.String(), "upstream certificate pin mismatch")
+}
+
+func TestHttpProxy_UpstreamAddrFailover(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	p := testProxy(config.Proxy{UpstreamAddrHeader: true},
+		testResolver{"example.com": {"127.0.0.2", "127.0.0.1"}})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(backend.Listener.Addr().String(), w.Header().Get("X-Upstream-Addr"))
+}
+
+func TestHttpProxy_UpstreamSelectionLatencyDialFailure(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+
+	// nothing listens on 127.0.0.2, the dial fails over to 127.0.0.1
+	p := testProxy(config.Proxy{
+		UpstreamSelection: config.UpstreamSelection{Mode: UpstreamSelectionLatency},
+		DisableKeepAlives: true,
+	}, testResolver{"example.com": {"127.0.0.2", "127.0.0.1"}})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	// the failed address goes last for the retry period
+	refused := net.JoinHostPort("127.0.0.2", port)
+	p.latency.mu.Lock()
+	require.False(p.latency.addrs[refused].failedAt.IsZero())
+	p.latency.mu.Unlock()
+	for i := 0; i < 20; i++ {
+		require.Equal([]string{"127.0.0.1", "127.0.0.2"}, p.latency.order([]string{"127.0.0.2", "127.0.0.1"}, port))
+	}
+}
+
+func TestHttpProxy_UpstreamSelectionLatency(t *testing.T) {
+	require := require.New(t)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fast"))
+	}))
+	defer fast.Close()
+	_, port, _ := net.SplitHostPort(fast.Listener.Addr().String())
+	ln, err := net.Listen("tcp", net.JoinHostPort("127.0.0.2", port))
+	require.NoError(err)
+	slow := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	slow.Listener.Close()
+	slow.Listener = ln
+	slow.Start()
+	defer slow.Close()
+
+	p := testProxy(config.Proxy{UpstreamSelection: config.UpstreamSelection{
+		Mode:       UpstreamSelectionLatency,
+		ProbeEvery: 5,
+	}}, testResolver{"example.com": {"127.0.0.2", "127.0.0.1"}})
+	hits := map[string]int{}
+	for i := 0; i < 30; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(fast, "example.com", "/"), nil))
+		require.Equal(http.StatusOK, w.Code)
+		if i >= 10 {
+			hits[w.Body.String()]++
+		}
+	}
+	// only the periodic probes still reach the slow address
+	require.Equal(map[string]int{"fast": 16, "slow": 4}, hits)
+	require.Equal([]string{"127.0.0.1", "127.0.0.2"}, p.latency.order([]string{"127.0.0.2", "127.0.0.1"}, port))
+}
+
+func TestHttpProxy_FallbackUpstream(t *testing.T) {
+	require := require.New(t)
+	maintenance := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "maintenance %s%s", r.Host, r.URL.RequestURI())
+	}))
+	defer maintenance.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://unknown.example/a/b?c=d", nil))
+	require.Equal(http.StatusInternalServerError, w.Code)
+
+	p = testProxy(config.Proxy{FallbackUpstream: maintenance.Listener.Addr().String()}, testResolver{})
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://unknown.example/a/b?c=d", nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Equal("maintenance unknown.example/a/b?c=d", w.Body.String())
+}
+
+func TestHttpProxy_UpstreamPort(t *testing.T) {
+	require := require.New(t)
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"10.0.0.1"}})
+
+	req, err := p.modifyRequest(httptest.NewRequest("GET", "http://example.com:8443/", nil))
+	require.NoError(err)
+	require.Equal("10.0.0.1:8443", req.URL.Host)
+	require.Equal("10.0.0.1:8443", upstreamAddr(req))
+
+	req, err = p.modifyRequest(httptest.NewRequest("GET", "https://example.com/", nil))
+	require.NoError(err)
+	require.Equal("example.com:443", req.URL.Host)
+	require.Equal("10.0.0.1:443", upstreamAddr(req))
+	require.Equal("example.com", req.Host)
+
+	p = testProxy(config.Proxy{DefaultPort: 8080}, testResolver{"example.com": {"10.0.0.1"}})
+	req, err = p.modifyRequest(httptest.NewRequest("GET", "http://example.com/", nil))
+	require.NoError(err)
+	require.Equal("10.0.0.1:8080", req.URL.Host)
+}
+
+func TestHttpProxy_Archive(t *testing.T) {
+	require := require.New(t)
+	body := strings.Repeat("archived body\n", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	}))
+	defer backend.Close()
+
+	dir := t.TempDir()
+	p := newTestProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}},
+		executor.NewExecutor(context.Background(), config.Executor{
+			Archive: config.ArchiveExecutor{Enable: true, Hosts: []string{"example.com"}, OutputPath: dir, Template: "{host}{path}"},
+		}))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/files/a.txt"), nil))
+	require.Equal(body, w.Body.String())
+
+	archived, err := ioutil.ReadFile(filepath.Join(dir, "example.com", "files", "a.txt"))
+	require.NoError(err)
+	require.Equal(w.Body.String(), string(archived))
+}
+
+func TestHttpProxy_ClientDisconnect(t *testing.T) {
+	require := require.New(t)
+	cancelled := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chunk := bytes.Repeat([]byte("x"), 4096)
+		for {
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(5 * time.Millisecond):
+				w.Write(chunk)
+				w.(http.Flusher).Flush()
+			}
+		}
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	served := make(chan struct{})
+	front := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.ServeHTTP(w, r)
+		close(served)
+	}))
+	defer front.Close()
+
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	require.NoError(err)
+	fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", testHost(backend, "example.com"))
+	_, err = io.ReadFull(conn, make([]byte, 8192))
+	require.NoError(err)
+	conn.Close()
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("proxy handler did not return")
+	}
+}
+
+func TestHttpProxy_ResponseHeaderFilter(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "origin/1.0")
+		w.Header().Set("X-Trace-Id", "abc")
+		w.Header().Set("X-Trace-Span", "def")
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	resolver := testResolver{"example.com": {"127.0.0.1"}}
+
+	p := testProxy(config.Proxy{ResponseHeaders: config.HeaderFilter{Deny: []string{"server", "X-Trace-*"}}}, resolver)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Empty(w.Header().Get("Server"))
+	require.Empty(w.Header().Get("X-Trace-Id"))
+	require.Empty(w.Header().Get("X-Trace-Span"))
+	require.Equal("no-cache", w.Header().Get("Cache-Control"))
+
+	p = testProxy(config.Proxy{ResponseHeaders: config.HeaderFilter{Allow: []string{"Content-Type"}}}, resolver)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal("text/plain", w.Header().Get("Content-Type"))
+	require.Empty(w.Header().Get("Server"))
+	require.Empty(w.Header().Get("Cache-Control"))
+	require.Empty(w.Header().Get("Date"))
+}
+
+func TestHttpProxy_DisableKeepAlives(t *testing.T) {
+	require := require.New(t)
+	var conns int32
+	var connection string
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		connection = r.Header.Get("Connection")
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	resolver := testResolver{"example.com": {"127.0.0.1"}}
+
+	for _, disable := range []bool{false, true} {
+		atomic.StoreInt32(&conns, 0)
+		p := testProxy(config.Proxy{DisableKeepAlives: disable}, resolver)
+		for i := 0; i < 3; i++ {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+			require.Equal(http.StatusOK, w.Code)
+		}
+		if disable {
+			require.Equal(int32(3), atomic.LoadInt32(&conns))
+			require.Equal("close", connection)
+		} else {
+			require.Equal(int32(1), atomic.LoadInt32(&conns))
+		}
+	}
+}
+
+func TestHttpProxy_ActiveConnections(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", testURL(backend, "example.com", fmt.Sprintf("/%d", i)), nil))
+		}(i)
+	}
+	require.Eventually(func() bool { return len(p.ActiveConnections()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	for _, conn := range p.ActiveConnections() {
+		require.Equal("GET", conn.Method)
+		require.Equal(testHost(backend, "example.com"), conn.Host)
+		require.False(conn.Start.IsZero())
+	}
+	close(release)
+	wg.Wait()
+	require.Empty(p.ActiveConnections())
+}
+
+type testBodyRewriter func(*core.RequestHeader, []byte) []byte
+
+func (e testBodyRewriter) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (e testBodyRewriter) RewriteRequestBody(req *core.RequestHeader, body []byte) []byte {
+	return e(req, body)
+}
+
+func TestHttpProxy_RewriteRequestBody(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "%d %s", r.ContentLength, body)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	p.execute.Register(testBodyRewriter(func(req *core.RequestHeader, body []byte) []byte {
+		return bytes.Replace(body, []byte(`"password":"secret"`), []byte(`"password":"***"`), 1)
+	}))
+
+	for _, contentLength := range []int64{-1, 0} {
+		r := httptest.NewRequest("POST", testURL(backend, "example.com", "/login"),
+			strings.NewReader(`{"user":"bob","password":"secret"}`))
+		if contentLength < 0 {
+			r.ContentLength = -1
+			r.TransferEncoding = []string{"chunked"}
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(`31 {"user":"bob","password":"***"}`, w.Body.String())
+	}
+}
+
+func TestHttpProxy_MaxConcurrentRequests(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	var waiting int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			atomic.AddInt32(&waiting, 1)
+			<-release
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxConcurrentRequests: 2}, testResolver{"example.com": {"127.0.0.1"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", testURL(backend, "example.com", "/slow"), nil))
+		}()
+	}
+	require.Eventually(func() bool { return atomic.LoadInt32(&waiting) == 2 }, 5*time.Second, 5*time.Millisecond)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+
+	close(release)
+	wg.Wait()
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+}
+
+func TestHttpProxy_UpstreamNextProtos(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Proto))
+	}))
+	backend.EnableHTTP2 = true
+	backend.StartTLS()
+	defer backend.Close()
+	resolver := testResolver{"example.com": {"127.0.0.1"}}
+
+	for protos, expected := range map[string]string{"h2,http/1.1": "HTTP/2.0", "http/1.1": "HTTP/1.1"} {
+		p := testProxy(config.Proxy{UpstreamNextProtos: strings.Split(protos, ",")}, resolver)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		require.Equal(http.StatusOK, w.Code)
+		require.Equal(expected, w.Body.String())
+	}
+}
+
+func TestHttpProxy_LazyDecompression(t *testing.T) {
+	require := require.New(t)
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte("decoded body"))
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body.Bytes())
+	}))
+	defer backend.Close()
+
+	var decoded int32
+	gunzip := decoders["gzip"]
+	decoders["gzip"] = func(r io.Reader) (io.Reader, error) {
+		atomic.AddInt32(&decoded, 1)
+		return gunzip(r)
+	}
+	defer func() { decoders["gzip"] = gunzip }()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	serve := func() {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(body.Bytes(), w.Body.Bytes())
+	}
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return nil
+	}))
+	serve()
+	require.Equal(int32(0), atomic.LoadInt32(&decoded))
+
+	var seen bytes.Buffer
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return &seen
+	}))
+	serve()
+	require.Equal(int32(1), atomic.LoadInt32(&decoded))
+	require.Equal("decoded body", seen.String())
+}
+
+func TestHttpProxy_ConflictingLength(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				conn.Close()
+				continue
+			}
+			// a 1xx response has a header block of its own
+			io.WriteString(conn, "HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n")
+			if req.URL.Path == "/conflict" {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n")
+			} else {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n")
+			}
+			io.WriteString(conn, "b\r\nhello world\r\n0\r\n\r\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	get := func(p *HttpProxy, path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "http://example.com:"+port+path, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	w := get(p, "/conflict")
+	require.Equal("hello world", w.Body.String())
+	require.Empty(w.Header().Get("Content-Length"))
+
+	// rejected when configured, chunked responses without a length pass,
+	// the 1xx dropped here is still among the raw bytes
+	p = testProxy(config.Proxy{ConflictingLength: ConflictingLengthReject, DropInformational: true},
+		testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.ErrorLevel)
+	p.log = zap.New(obs)
+	w = get(p, "/conflict")
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.NotContains(w.Body.String(), "hello world")
+	require.Len(logs.FilterMessage("conflicting content length and transfer encoding").AllUntimed(), 1)
+	w = get(p, "/chunked")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("hello world", w.Body.String())
+}
+
+func TestHttpProxy_ConflictingRequestLength(t *testing.T) {
+	require := require.New(t)
+	var body string
+	var length int64
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		body, length = string(b), r.ContentLength
+	}))
+	defer backend.Close()
+
+	front := httptest.NewServer(testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}))
+	defer front.Close()
+	conn, err := net.Dial("tcp", front.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	io.WriteString(conn, "POST / HTTP/1.1\r\nHost: "+testHost(backend, "example.com")+
+		"\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\nb\r\nhello world\r\n0\r\n\r\n")
+	res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal("hello world", body)
+	require.Equal(int64(-1), length)
+}
+
+type testScanner string
+
+func (s testScanner) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (s testScanner) Scan(ctx context.Context, contentType string, body io.Reader) (executor.Verdict, error) {
+	b, err := ioutil.ReadAll(body)
+	if err != nil {
+		return executor.VerdictAllow, err
+	}
+	if bytes.Contains(b, []byte(s)) {
+		return executor.VerdictBlock, nil
+	}
+	return executor.VerdictAllow, nil
+}
+
+func TestHttpProxy_Scanner(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Origin", "backend")
+		io.WriteString(w, "body of "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		Blocked: config.BlockedResponse{Status: http.StatusUnavailableForLegalReasons, Body: "blocked"},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	p.execute.Register(testScanner("/infected"))
+
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/clean"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("body of /clean", w.Body.String())
+
+	r = httptest.NewRequest("GET", testURL(backend, "example.com", "/infected"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusUnavailableForLegalReasons, w.Code)
+	require.Equal("blocked", w.Body.String())
+	require.Empty(w.Header().Get("X-Origin"))
+}
+
+func TestHttpProxy_FaultInjection(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{Faults: []config.FaultRule{
+		{Host: "example.com", Path: "/api/", Probability: 0.3, Status: http.StatusServiceUnavailable},
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+	p.faults.rand = rand.New(rand.NewSource(1))
+
+	faulted := 0
+	for i := 0; i < 1000; i++ {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/api/users"), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		if w.Code == http.StatusServiceUnavailable {
+			faulted++
+			continue
+		}
+		require.Equal(http.StatusOK, w.Code)
+		require.Equal("ok", w.Body.String())
+	}
+	require.InDelta(300, faulted, 50)
+
+	for i := 0; i < 100; i++ {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/static/app.js"), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(http.StatusOK, w.Code)
+	}
+}
+
+func TestHttpProxy_FaultInjectionDrop(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{Faults: []config.FaultRule{
+		{Path: "/drop", Probability: 1, Delay: 50 * time.Millisecond, Drop: true},
+		{Path: "/slow", Probability: 1, Delay: 50 * time.Millisecond},
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	get := func(path string) (*http.Response, error) {
+		req, _ := http.NewRequest("GET", front.URL+path, nil)
+		req.Host = testHost(backend, "example.com")
+		return http.DefaultClient.Do(req)
+	}
+	start := time.Now()
+	_, err := get("/drop")
+	require.Error(err)
+	require.True(time.Since(start) >= 50*time.Millisecond)
+
+	start = time.Now()
+	res, err := get("/slow")
+	require.NoError(err)
+	b, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal("ok", string(b))
+	require.True(time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestHttpProxy_CoalesceRequests(t *testing.T) {
+	require := require.New(t)
+	var upstream int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		<-release
+		io.WriteString(w, "shared body")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{CoalesceRequests: true}, testResolver{"example.com": {"127.0.0.1"}})
+	const clients = 50
+	var wg sync.WaitGroup
+	bodies := make(chan string, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", testURL(backend, "example.com", "/hot"), nil)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			bodies <- w.Body.String()
+		}()
+	}
+	require.Eventually(func() bool {
+		p.flights.mu.Lock()
+		defer p.flights.mu.Unlock()
+		for _, call := range p.flights.calls {
+			return call.dups == clients-1
+		}
+		return false
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(bodies)
+
+	require.Equal(int32(1), atomic.LoadInt32(&upstream))
+	for body := range bodies {
+		require.Equal("shared body", body)
+	}
+}
+
+func TestHttpProxy_CoalesceMaxBytes(t *testing.T) {
+	require := require.New(t)
+	var upstream int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		<-release
+		io.WriteString(w, "body larger than the limit")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{CoalesceRequests: true, CoalesceMaxBytes: 8}, testResolver{"example.com": {"127.0.0.1"}})
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", testURL(backend, "example.com", "/big"), nil)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			require.Equal("body larger than the limit", w.Body.String())
+		}()
+	}
+	require.Eventually(func() bool {
+		p.flights.mu.Lock()
+		defer p.flights.mu.Unlock()
+		for _, call := range p.flights.calls {
+			return call.dups == 1
+		}
+		return false
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(int32(2), atomic.LoadInt32(&upstream))
+}
+
+func TestHttpProxy_CoalesceVary(t *testing.T) {
+	require := require.New(t)
+	var upstream int32
+	release := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		<-release
+		if r.URL.Path == "/agent" {
+			w.Header().Set("Vary", "Accept-Encoding, User-Agent")
+			io.WriteString(w, r.UserAgent())
+			return
+		}
+		w.Header().Set("Vary", "Accept")
+		io.WriteString(w, r.Header.Get("Accept"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{CoalesceRequests: true}, testResolver{"example.com": {"127.0.0.1"}})
+	var wg sync.WaitGroup
+	serve := func(path, name, value string) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", testURL(backend, "example.com", path), nil)
+			r.Header.Set(name, value)
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, r)
+			require.Equal(value, w.Body.String())
+		}()
+	}
+	// different Accept fields are different fetches
+	serve("/page", "Accept", "text/html")
+	serve("/page", "Accept", "application/json")
+	require.Eventually(func() bool {
+		return atomic.LoadInt32(&upstream) == 2
+	}, 5*time.Second, time.Millisecond)
+	p.flights.mu.Lock()
+	require.Len(p.flights.calls, 2)
+	p.flights.mu.Unlock()
+
+	// a response varying on a field outside the key isn't shared
+	serve("/agent", "User-Agent", "agent-a")
+	serve("/agent", "User-Agent", "agent-b")
+	require.Eventually(func() bool {
+		p.flights.mu.Lock()
+		defer p.flights.mu.Unlock()
+		for key, call := range p.flights.calls {
+			if strings.Contains(key, "/agent") {
+				return call.dups == 1
+			}
+		}
+		return false
+	}, 5*time.Second, time.Millisecond)
+	close(release)
+	wg.Wait()
+	require.Equal(int32(4), atomic.LoadInt32(&upstream))
+}
+
+func TestHttpProxy_Forwarded(t *testing.T) {
+	require := require.New(t)
+	var forwarded []string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header["Forwarded"]
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{Forwarded: config.Forwarded{Enable: true, TrustedPeers: []string{"10.0.0.0/8"}}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	host := testHost(backend, "example.com")
+
+	r := httptest.NewRequest("GET", "http://"+host+"/", nil)
+	r.RemoteAddr = "192.0.2.60:40000"
+	r.Header.Set("Forwarded", "for=198.51.100.1")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal([]string{`for=192.0.2.60;host="` + host + `";proto=http`}, forwarded)
+	require.Equal("192.0.2.60", p.clientIP(r))
+
+	r = httptest.NewRequest("GET", "http://"+host+"/", nil)
+	r.RemoteAddr = "10.0.0.2:40000"
+	r.Header.Add("Forwarded", `for="[2001:db8::1]:4711";proto=https`)
+	r.Header.Add("Forwarded", "for=10.0.0.1")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal([]string{`for="[2001:db8::1]:4711";proto=https, for=10.0.0.1, for=10.0.0.2;host="` + host + `";proto=http`}, forwarded)
+	require.Equal("2001:db8::1", p.clientIP(r))
+}
+
+func TestHttpProxy_StaticRoutes(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "upstream "+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "static")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	page := filepath.Join(dir, "health.html")
+	require.NoError(ioutil.WriteFile(page, []byte("<p>healthy</p>"), 0644))
+
+	p := testProxy(config.Proxy{StaticRoutes: []config.StaticRoute{
+		{Host: "Example.COM", Path: "/status", Headers: map[string]string{"Content-Type": "application/json"}, Body: `{"status":"ok"}`},
+		{Path: "/health", File: page},
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/status"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	require.JSONEq(`{"status":"ok"}`, w.Body.String())
+
+	r = httptest.NewRequest("GET", testURL(backend, "other.com", "/health"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal("<p>healthy</p>", w.Body.String())
+
+	r = httptest.NewRequest("GET", testURL(backend, "example.com", "/status/other"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal("upstream /status/other", w.Body.String())
+}
+
+type chanWriter chan string
+
+func (w chanWriter) Write(b []byte) (int, error) {
+	w <- string(b)
+	return len(b), nil
+}
+
+func TestHttpProxy_PAC(t *testing.T) {
+	require := require.New(t)
+	p := testProxy(config.Proxy{PAC: config.PAC{
+		Enable:  true,
+		Host:    "proxy.internal",
+		Include: []string{"*.example.com"},
+		Exclude: []string{"intranet.example.com"},
+	}}, testResolver{})
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://proxy.internal:8080/proxy.pac", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("application/x-ns-proxy-autoconfig", w.Header().Get("Content-Type"))
+	require.Equal("function FindProxyForURL(url, host) {\n"+
+		"\tif (shExpMatch(host, \"intranet.example.com\")) return \"DIRECT\";\n"+
+		"\tif (shExpMatch(host, \"*.example.com\")) return \"PROXY proxy.internal:8080\";\n"+
+		"\treturn \"DIRECT\";\n"+
+		"}\n", w.Body.String())
+
+	p.cfg.PAC = config.PAC{Enable: true, Proxy: "10.0.0.1:3128"}
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/proxy.pac", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Contains(w.Body.String(), "return \"PROXY 10.0.0.1:3128\";")
+}
+
+func TestHttpProxy_StreamEvents(t *testing.T) {
+	require := require.New(t)
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: one\n\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "data: two\n\n")
+	}))
+	defer backend.Close()
+	defer func() {
+		select {
+		case <-next:
+		default:
+			close(next)
+		}
+	}()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	handler := make(chanWriter, 8)
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return handler
+	}))
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/events", nil)
+	req.Host = testHost(backend, "example.com")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	events := bufio.NewReader(res.Body)
+	line, err := events.ReadString('\n')
+	require.NoError(err)
+	require.Equal("data: one\n", line)
+	select {
+	case chunk := <-handler:
+		require.Equal("data: one\n\n", chunk)
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not fed before the stream ended")
+	}
+
+	close(next)
+	rest, err := ioutil.ReadAll(events)
+	require.NoError(err)
+	require.Equal("\ndata: two\n\n", string(rest))
+}
+
+func TestHttpProxy_MaxResponseHeaders(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := 10
+		if r.URL.Path == "/many" {
+			n = 5000
+		}
+		for i := 0; i < n; i++ {
+			w.Header().Add(fmt.Sprintf("X-Header-%d", i), "v")
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxResponseHeaders: 100}, testResolver{"example.com": {"127.0.0.1"}})
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/many"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.Empty(w.Header().Get("X-Header-0"))
+
+	r = httptest.NewRequest("GET", testURL(backend, "example.com", "/few"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("ok", w.Body.String())
+}
+
+type testStatusRewriter map[int]int
+
+func (e testStatusRewriter) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (e testStatusRewriter) RewriteResponseHeader(req *core.RequestHeader, res *core.ResponseHeader) {
+	if status, found := e[res.StatusCode()]; found {
+		res.SetStatusCode(status)
+	}
+}
+
+func TestHttpProxy_StatusCode(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		io.WriteString(w, "short and stout")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusTeapot, w.Code)
+
+	p.execute.Register(testStatusRewriter{http.StatusTeapot: http.StatusOK})
+	r = httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("short and stout", w.Body.String())
+}
+
+func TestHttpProxy_RouteTimeouts(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		RequestTimeout: 50 * time.Millisecond,
+		Timeouts: []config.TimeoutRule{
+			{Host: "example.com", Path: "/api/", Timeout: 20 * time.Millisecond},
+			{Host: "example.com", Path: "/download/", Timeout: 5 * time.Second},
+		},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	get := func(path string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", path), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+
+	start := time.Now()
+	require.Equal(http.StatusGatewayTimeout, get("/api/users").Code)
+	require.True(time.Since(start) < 200*time.Millisecond)
+
+	w := get("/download/file.iso?v=1")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("done", w.Body.String())
+
+	require.Equal(http.StatusGatewayTimeout, get("/other").Code)
+
+	// an event stream outlasting the timeout isn't cut once its headers came
+	events := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for i := 0; i < 5; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			time.Sleep(40 * time.Millisecond)
+		}
+	}))
+	defer events.Close()
+	r := httptest.NewRequest("GET", testURL(events, "example.com", "/events"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("data: 0\n\ndata: 1\n\ndata: 2\n\ndata: 3\n\ndata: 4\n\n", w.Body.String())
+}
+
+func TestHttpProxy_MalformedResponse(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	garbage := "\x00\x01garbage " + strings.Repeat("x", 1000) + "\r\n\r\n"
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			http.ReadRequest(bufio.NewReader(conn))
+			io.WriteString(conn, garbage)
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	p := testProxy(config.Proxy{LogMalformedBytes: 64}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com:"+port+"/", nil))
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.Contains(w.Body.String(), "malformed upstream response")
+
+	entries := logs.FilterMessage("malformed upstream response").All()
+	require.Len(entries, 1)
+	require.Equal(garbage[:64], entries[0].ContextMap()["raw"])
+}
+
+func TestHttpProxy_ErrorPage(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	ln.Close()
+
+	p := testProxy(config.Proxy{ErrorPage: config.ErrorPage{
+		Enable:   true,
+		Template: `<p>{{.Status}} {{.Host}} via {{.Addr}}: {{.Class}}</p>`,
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+	r := httptest.NewRequest("GET", "http://example.com:"+port+"/", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusBadGateway, w.Code)
+	require.Equal("text/html; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal("<p>502 example.com:"+port+" via 127.0.0.1:"+port+": connection refused</p>", w.Body.String())
+}
+
+func TestHttpProxy_RawBody(t *testing.T) {
+	require := require.New(t)
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	zw.Write([]byte("exact origin bytes"))
+	zw.Close()
+	var acceptEncoding string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		acceptEncoding = r.Header.Get("Accept-Encoding")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(body.Bytes())
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{RawBody: true}, testResolver{"example.com": {"127.0.0.1"}})
+	var seen bytes.Buffer
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return &seen
+	}))
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Empty(acceptEncoding)
+	require.Equal("gzip", w.Header().Get("Content-Encoding"))
+	require.Equal(body.Bytes(), w.Body.Bytes())
+	require.Equal(body.Bytes(), seen.Bytes())
+}
+
+func TestHttpProxy_HTTP10(t *testing.T) {
+	require := require.New(t)
+	var upstreamConnection string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamConnection = r.Header.Get("Connection") + r.Header.Get("Keep-Alive")
+		w.Header().Set("Connection", "close")
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	front := httptest.NewServer(testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}))
+	defer front.Close()
+	host := testHost(backend, "example.com")
+
+	dial := func() (net.Conn, *bufio.Reader) {
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		require.NoError(err)
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn, bufio.NewReader(conn)
+	}
+	get := func(conn net.Conn, br *bufio.Reader, headers string) *http.Response {
+		io.WriteString(conn, "GET / HTTP/1.0\r\n"+headers+"\r\n")
+		res, err := http.ReadResponse(br, nil)
+		require.NoError(err)
+		b, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		res.Body = ioutil.NopCloser(bytes.NewReader(b))
+		return res
+	}
+
+	conn, br := dial()
+	res := get(conn, br, "Host: "+host+"\r\n")
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.True(res.Close)
+	_, err := br.ReadByte()
+	require.Equal(io.EOF, err)
+	conn.Close()
+
+	conn, br = dial()
+	defer conn.Close()
+	for i := 0; i < 2; i++ {
+		res = get(conn, br, "Host: "+host+"\r\nConnection: keep-alive\r\nKeep-Alive: timeout=5\r\n")
+		require.Equal(http.StatusOK, res.StatusCode)
+		require.False(res.Close)
+		require.Empty(upstreamConnection)
+	}
+
+	res = get(conn, br, "")
+	require.Equal(http.StatusBadRequest, res.StatusCode)
+}
+
+func TestHttpProxy_SyslogAccessLog(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+	syslog, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer syslog.Close()
+
+	zapCfg := zap.NewProductionConfig()
+	zapCfg.OutputPaths = []string{"syslog+udp://" + syslog.LocalAddr().String() + "?facility=local0&tag=httpctl"}
+	accessLog, err := zapCfg.Build()
+	require.NoError(err)
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	p.accessLog = accessLog
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/page"), nil))
+	require.Equal(http.StatusOK, w.Code)
+
+	buf := make([]byte, 4096)
+	syslog.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := syslog.ReadFrom(buf)
+	require.NoError(err)
+	// <local0.info>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	require.Regexp(`^<134>1 \S+ \S+ httpctl \d+ - - \{.*"msg":"access".*"uri":"http://example.com:\d+/page".*\}$`, string(buf[:n]))
+}
+
+func TestHttpProxy_AuditLog(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		ClientACL:    config.ClientACL{Deny: []string{"192.0.2.0/24"}},
+		BlockedHosts: []string{"tracker.com"},
+	}, testResolver{"example.com": {"127.0.0.1"}, "ads.tracker.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.auditLog = zap.New(obs)
+
+	serve := func(host, remote string) int {
+		r := httptest.NewRequest("GET", testURL(backend, host, "/page"), nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Code
+	}
+	require.Equal(http.StatusForbidden, serve("example.com", "192.0.2.7:5000"))
+	require.Equal(http.StatusForbidden, serve("ads.tracker.com", "198.51.100.1:5000"))
+	require.Equal(http.StatusOK, serve("example.com", "198.51.100.1:5000"))
+
+	entries := logs.AllUntimed()
+	require.Len(entries, 2)
+	acl := entries[0].ContextMap()
+	require.Equal(AuditACLDenied, acl["reason"])
+	require.Equal("192.0.2.7", acl["client"])
+	require.Equal("deny 192.0.2.0/24", acl["rule"])
+	require.Equal(testHost(backend, "example.com")+"/page", acl["target"])
+	blocked := entries[1].ContextMap()
+	require.Equal(AuditHostBlocked, blocked["reason"])
+	require.Equal("198.51.100.1", blocked["client"])
+	require.Equal("tracker.com", blocked["rule"])
+}
+
+func TestHttpProxy_InvalidConfig(t *testing.T) {
+	require := require.New(t)
+	for _, cfg := range []config.Proxy{
+		{ClientACL: config.ClientACL{Allow: []string{"10.0.0.0/8", "192.0.2.0/33"}}},
+		{ClientACL: config.ClientACL{Deny: []string{"not-an-ip"}}},
+		{SSRFProtection: config.SSRFProtection{Enable: true, Ranges: []string{"10.0.0.0/8", "fc00::/7x"}}},
+		{SSRFProtection: config.SSRFProtection{Enable: true, Allow: []string{"10.1.0.0/16/"}}},
+		{MinTLSVersion: "1.4"},
+		{CipherSuites: []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", "TLS_NO_SUCH_SUITE"}},
+		{CORS: config.CORS{Enable: true, Origins: []string{"https://app.example", "*"}, Credentials: true}},
+		{ConflictingLength: "drop"},
+	} {
+		_, err := NewHttpProxy(cfg, testResolver{}, executor.NewExecutor(context.Background(), config.Executor{}))
+		require.Error(err, "%+v", cfg)
+	}
+}
+
+func TestHttpProxy_NotModified(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		w.Header().Set("Content-Encoding", "gzip")
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		zw := gzip.NewWriter(w)
+		zw.Write([]byte("fresh"))
+		zw.Close()
+	}))
+	defer backend.Close()
+
+	var decoded int32
+	gunzip := decoders["gzip"]
+	decoders["gzip"] = func(r io.Reader) (io.Reader, error) {
+		atomic.AddInt32(&decoded, 1)
+		return gunzip(r)
+	}
+	defer func() { decoders["gzip"] = gunzip }()
+
+	p := testProxy(config.Proxy{CoalesceRequests: true}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.ErrorLevel)
+	p.log = zap.New(obs)
+	var seen bytes.Buffer
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return &seen
+	}))
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	r.Header.Set("If-None-Match", `"v1"`)
+	r.Header.Set("If-Modified-Since", "Mon, 02 Jan 2006 15:04:05 GMT")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusNotModified, w.Code)
+	require.Equal(`"v1"`, w.Header().Get("ETag"))
+	require.Equal("Mon, 02 Jan 2006 15:04:05 GMT", w.Header().Get("Last-Modified"))
+	require.Equal(0, w.Body.Len())
+	require.Equal(0, seen.Len())
+	require.Equal(int32(0), atomic.LoadInt32(&decoded))
+	require.Equal(0, logs.Len())
+}
+
+func TestHttpProxy_TransportStats(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal("ok", w.Body.String())
+	}
+	require.Equal(TransportStats{Created: 1, Reused: 2}, p.TransportStats())
+
+	p.transport.CloseIdleConnections()
+	require.Equal(TransportStats{Created: 1, Reused: 2, IdleClosed: 1}, p.TransportStats())
+}
+
+func TestHttpProxy_RewriteLocation(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", r.URL.Query().Get("to"))
+		w.WriteHeader(http.StatusFound)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{RewriteLocation: true}, testResolver{"example.com": {"127.0.0.1"}})
+	_, port, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	for to, want := range map[string]string{
+		"https://other.com/x?y=1": "http://other.com:" + port + "/x?y=1",
+		"http://other.com:8443/x": "http://other.com:" + port + "/x",
+		"/relative":               "/relative",
+	} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/?to="+url.QueryEscape(to)), nil))
+		require.Equal(http.StatusFound, w.Code)
+		require.Equal(want, w.Header().Get("Location"))
+	}
+}
+
+func TestHttpProxy_Cookies(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/; Max-Age=60")
+		w.Header().Add("Set-Cookie", "pref=dark; secure; SameSite=None; Partitioned")
+		w.Header().Add("Vary", "Accept")
+		w.Header().Add("Vary", "Cookie")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal([]string{"session=abc; Path=/; Max-Age=60", "pref=dark; secure; SameSite=None; Partitioned"},
+		w.Header().Values("Set-Cookie"))
+	require.Equal([]string{"Accept", "Cookie"}, w.Header().Values("Vary"))
+
+	p = testProxy(config.Proxy{Cookies: config.CookieRewrite{Secure: true, SameSite: "Lax"}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal([]string{
+		"session=abc; Path=/; Max-Age=60; Secure; SameSite=Lax",
+		"pref=dark; secure; Partitioned; SameSite=Lax",
+	}, w.Header().Values("Set-Cookie"))
+}
+
+func TestHttpProxy_UpstreamKeepAlive(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		UpstreamKeepAlive:   time.Second,
+		UpstreamIdleTimeout: time.Minute,
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	for i := 0; i < 2; i++ {
+		if i > 0 {
+			// idle past the probe interval
+			time.Sleep(1500 * time.Millisecond)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		require.Equal("ok", w.Body.String())
+	}
+	require.Equal(TransportStats{Created: 1, Reused: 1}, p.TransportStats())
+}
+
+// testObserver hands the ended transactions to a func.
+type testObserver func(c *core.Context)
+
+func (o testObserver) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (o testObserver) ObserveTransaction(c *core.Context) {
+	o(c)
+}
+
+func TestHttpProxy_Timings(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.(http.Flusher).Flush()
+		time.Sleep(10 * time.Millisecond)
+		io.WriteString(w, "timed")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var timings []core.Timings
+	p.execute.Register(testObserver(func(c *core.Context) {
+		timings = append(timings, c.Timings)
+	}))
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		require.Equal("timed", w.Body.String())
+	}
+	require.Len(timings, 2)
+	first, reused := timings[0], timings[1]
+	require.True(first.Connect > 0)
+	require.True(first.TLS > 0)
+	require.True(first.TTFB >= 10*time.Millisecond)
+	require.True(first.Total >= first.TTFB+10*time.Millisecond)
+	// the second request reuses the connection
+	require.Zero(reused.Connect)
+	require.Zero(reused.TLS)
+	require.True(reused.TTFB >= 10*time.Millisecond)
+	require.True(reused.Total >= reused.TTFB)
+}
+
+func TestHttpProxy_HostStats(t *testing.T) {
+	require := require.New(t)
+	plain := strings.Repeat("counted body ", 100)
+	var encoded bytes.Buffer
+	zw := gzip.NewWriter(&encoded)
+	io.WriteString(zw, plain)
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded.Bytes())
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{HostStats: true}, testResolver{"example.com": {"127.0.0.1"}, "other.com": {"127.0.0.1"}})
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return ioutil.Discard
+	}))
+	for _, host := range []string{"example.com", "example.com", "other.com"} {
+		r := httptest.NewRequest("POST", testURL(backend, host, "/"), strings.NewReader(strings.Repeat("x", 300)))
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(http.StatusOK, w.Code)
+	}
+	require.Equal(map[string]HostBytes{
+		"example.com": {Requests: 2, RequestBytes: 600, ResponseBytes: 2 * int64(encoded.Len()), DecodedBytes: 2 * int64(len(plain))},
+		"other.com":   {Requests: 1, RequestBytes: 300, ResponseBytes: int64(encoded.Len()), DecodedBytes: int64(len(plain))},
+	}, p.HostStats())
+}
+
+func TestHttpProxy_Prefetch(t *testing.T) {
+	require := require.New(t)
+	var mu sync.Mutex
+	prefetched := map[string]string{}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			io.WriteString(w, `<html><head><link rel="preload" href="/style.css" as="style">`+
+				`<script src="app.js?v=2"></script></head><body><a href="/next">next</a></body></html>`)
+		default:
+			mu.Lock()
+			prefetched[r.URL.RequestURI()] = r.UserAgent()
+			mu.Unlock()
+			w.Header().Set("Content-Type", "text/html")
+			io.WriteString(w, `<script src="/depth2.js"></script>`)
+		}
+	}))
+	defer backend.Close()
+
+	front := httptest.NewUnstartedServer(nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	execute := executor.NewExecutor(ctx, config.Executor{Prefetch: config.PrefetchExecutor{
+		Enable: true,
+		Proxy:  "http://" + front.Listener.Addr().String(),
+		Rate:   100,
+	}})
+	front.Config.Handler = newTestProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}, execute)
+	front.Start()
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/", nil)
+	req.Host = testHost(backend, "example.com")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	ioutil.ReadAll(res.Body)
+	res.Body.Close()
+
+	require.Eventually(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(prefetched) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(map[string]string{
+		"/style.css":  executor.PrefetchUserAgent,
+		"/app.js?v=2": executor.PrefetchUserAgent,
+	}, prefetched)
+}
+
+func TestHttpProxy_RecorderCompress(t *testing.T) {
+	require := require.New(t)
+	body := strings.Repeat("<p>recorded transaction</p>", 4096)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		io.WriteString(w, body+r.URL.Path)
+	}))
+	defer backend.Close()
+
+	execute := executor.NewExecutor(context.Background(), config.Executor{Recorder: config.RecorderExecutor{
+		Enable:   true,
+		Compress: true,
+	}})
+	proxy := newTestProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}, execute)
+	for _, path := range []string{"/a", "/b"} {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Host = testHost(backend, "example.com")
+		w := httptest.NewRecorder()
+		proxy.ServeHTTP(w, req)
+		require.Equal(http.StatusOK, w.Code)
+	}
+
+	recorder := execute.Recorder()
+	require.NotNil(recorder)
+	require.Less(recorder.Size(), int64(len(body)/10))
+	txs := recorder.Export()
+	require.Len(txs, 2)
+	for i, path := range []string{"/a", "/b"} {
+		require.True(strings.HasSuffix(txs[i].URL, path))
+		require.Equal(http.StatusOK, txs[i].Status)
+		require.Equal("text/html", txs[i].ContentType)
+		require.Equal(body+path, string(txs[i].Body))
+	}
+}
+
+func TestHttpProxy_TraceBlocked(t *testing.T) {
+	require := require.New(t)
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	r := httptest.NewRequest("TRACE", testURL(backend, "example.com", "/"), nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusMethodNotAllowed, w.Code)
+	require.NotContains(w.Header().Get("Allow"), "TRACE")
+	require.Equal(int32(0), atomic.LoadInt32(&hits))
+
+	p = testProxy(config.Proxy{AllowTrace: true}, testResolver{"example.com": {"127.0.0.1"}})
+	r = httptest.NewRequest("TRACE", testURL(backend, "example.com", "/"), nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(int32(1), atomic.LoadInt32(&hits))
+}
+
+func TestHttpProxy_OptionsAsterisk(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	uris := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if req, err := http.ReadRequest(bufio.NewReader(conn)); err == nil {
+				uris <- req.Method + " " + req.RequestURI
+			}
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nAllow: GET\r\nContent-Length: 0\r\n\r\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	options := func(p *HttpProxy) *http.Response {
+		front := httptest.NewUnstartedServer(p)
+		front.Config.DisableGeneralOptionsHandler = true
+		front.Start()
+		defer front.Close()
+		conn, err := net.Dial("tcp", front.Listener.Addr().String())
+		require.NoError(err)
+		defer conn.Close()
+		io.WriteString(conn, "OPTIONS * HTTP/1.1\r\nHost: example.com:"+port+"\r\n\r\n")
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(err)
+		res.Body.Close()
+		return res
+	}
+
+	res := options(testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}}))
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal(defaultAllow, res.Header.Get("Allow"))
+	require.Len(uris, 0)
+
+	res = options(testProxy(config.Proxy{ForwardOptionsAsterisk: true}, testResolver{"example.com": {"127.0.0.1"}}))
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("GET", res.Header.Get("Allow"))
+	require.Equal("OPTIONS *", <-uris)
+}
+
+func TestHttpProxy_TakeResponseBody(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "pooled body")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	var (
+		buffer *bytes.Buffer
+		taken  io.ReadCloser
+	)
+	take := true
+	p.execute.Register(testObserver(func(c *core.Context) {
+		buffer = c.ResponseBody.(*decodedBody).body.buf
+		if take {
+			taken = c.TakeResponseBody()
+			require.Nil(c.TakeResponseBody())
+		}
+	}))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal("pooled body", w.Body.String())
+
+	// the taken body is still held after the transaction ended
+	require.Equal("pooled body", buffer.String())
+	b, err := ioutil.ReadAll(taken)
+	require.NoError(err)
+	require.Equal("pooled body", string(b))
+	require.Equal("pooled body", buffer.String())
+	require.NoError(taken.Close())
+	// recycled buffers are reset by the pool
+	require.Equal(0, buffer.Len())
+
+	// untaken bodies are recycled once the observers returned
+	take = false
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal("pooled body", w.Body.String())
+	require.Equal(0, buffer.Len())
+}
+
+func TestHttpProxy_SetCookies(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/api" {
+			w.Header().Set("Content-Type", "application/json")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		if r.URL.Query().Get("own") != "" {
+			http.SetCookie(w, &http.Cookie{Name: "variant", Value: "origin"})
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{SetCookies: []config.SetCookie{{
+		Host:        "example.com",
+		ContentType: "text/html",
+		Status:      []int{http.StatusOK},
+		Name:        "variant",
+		Value:       "b",
+		CookiePath:  "/",
+		MaxAge:      60,
+		HttpOnly:    true,
+		SameSite:    "Lax",
+	}}}, testResolver{"example.com": {"127.0.0.1"}, "other.com": {"127.0.0.1"}})
+	get := func(host, path string, cookie string) []string {
+		r := httptest.NewRequest("GET", testURL(backend, host, path), nil)
+		if cookie != "" {
+			r.Header.Set("Cookie", cookie)
+		}
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal("ok", w.Body.String())
+		return w.Header().Values("Set-Cookie")
+	}
+	require.Equal([]string{"variant=b; Path=/; Max-Age=60; HttpOnly; SameSite=Lax"}, get("example.com", "/", ""))
+	// other content types and hosts don't match
+	require.Empty(get("example.com", "/api", ""))
+	require.Empty(get("other.com", "/", ""))
+	// existing cookies aren't duplicated
+	require.Empty(get("example.com", "/", "variant=a"))
+	require.Equal([]string{"variant=origin"}, get("example.com", "/?own=1", ""))
+}
+
+func TestHttpProxy_DecoderUnavailable(t *testing.T) {
+	require := require.New(t)
+	RegisterDecoder("x-broken", func(r io.Reader) (io.Reader, error) {
+		panic("not compiled in")
+	})
+	defer func() {
+		decodersMu.Lock()
+		delete(decoders, "x-broken")
+		decodersMu.Unlock()
+	}()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "x-broken")
+		io.WriteString(w, "raw bytes")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.ErrorLevel)
+	p.log = zap.New(obs)
+	var seen bytes.Buffer
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		return &seen
+	}))
+	for i := 0; i < 2; i++ {
+		seen.Reset()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+		require.Equal("raw bytes", w.Body.String())
+		// handlers get the identity body
+		require.Equal("raw bytes", seen.String())
+	}
+	require.Equal(1, logs.FilterMessage("decoder unavailable, bodies passed through raw").Len())
+}
+
+func TestHttpProxy_HeaderOrder(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	requests := make(chan []string, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		br := bufio.NewReader(conn)
+		// kept alive, each request is read raw up to its body
+		for {
+			var names []string
+			var length int
+			if _, err := br.ReadString('\n'); err != nil {
+				return
+			}
+			for {
+				line, err := br.ReadString('\n')
+				if err != nil {
+					return
+				}
+				line = strings.TrimRight(line, "\r\n")
+				if line == "" {
+					break
+				}
+				name := line[:strings.IndexByte(line, ':')]
+				if name == "Content-Length" {
+					length, _ = strconv.Atoi(strings.TrimSpace(line[len(name)+1:]))
+				}
+				names = append(names, name)
+			}
+			io.CopyN(ioutil.Discard, br, int64(length))
+			requests <- names
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	p := testProxy(config.Proxy{HeaderOrder: []string{"User-Agent", "X-B", "Host", "X-A"}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	send := func(method string, body io.Reader) []string {
+		r := httptest.NewRequest(method, "http://example.com:"+port+"/", body)
+		r.Header.Set("X-A", "a")
+		r.Header.Set("X-B", "b")
+		r.Header.Set("User-Agent", "ordered")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal("ok", w.Body.String())
+		return <-requests
+	}
+	// the body of the first request doesn't confuse the second one
+	names := send("POST", strings.NewReader("posted body"))
+	require.Equal([]string{"User-Agent", "X-B", "Host", "X-A"}, names[:4])
+	require.Contains(names[4:], "Content-Length")
+	names = send("GET", nil)
+	require.Equal([]string{"User-Agent", "X-B", "Host", "X-A"}, names[:4])
+}
+
+func TestHttpProxy_InspectRequestBodies(t *testing.T) {
+	require := require.New(t)
+	var received []byte
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received, _ = ioutil.ReadAll(r.Body)
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{InspectRequestBodies: 1024}, testResolver{"example.com": {"127.0.0.1"}})
+	var inspected []byte
+	p.execute.Register(testObserver(func(c *core.Context) {
+		inspected = c.RequestBody
+	}))
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, "plain form=1")
+	zw.Close()
+
+	r := httptest.NewRequest("POST", testURL(backend, "example.com", "/"), bytes.NewReader(gz.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal("ok", w.Body.String())
+	require.Equal("plain form=1", string(inspected))
+	require.Equal(gz.Bytes(), received)
+
+	// bodies over the limit are forwarded without inspection
+	large := bytes.Repeat([]byte("x"), 2048)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("POST", testURL(backend, "example.com", "/"), bytes.NewReader(large)))
+	require.Equal("ok", w.Body.String())
+	require.Nil(inspected)
+	require.Equal(large, received)
+}
+
+func TestHttpProxy_SlowRequestThreshold(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			time.Sleep(60 * time.Millisecond)
+		}
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{SlowRequestThreshold: 40 * time.Millisecond}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	for _, path := range []string{"/fast", "/slow?q=1"} {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", path), nil))
+		require.Equal("ok", w.Body.String())
+	}
+	slow := logs.FilterMessage("slow upstream request").All()
+	require.Len(slow, 1)
+	fields := slow[0].ContextMap()
+	require.Equal(testHost(backend, "example.com"), fields["host"])
+	require.Equal("/slow", fields["path"])
+	require.True(fields["duration"].(time.Duration) >= 60*time.Millisecond)
+}
+
+func TestHttpProxy_TransformAccept(t *testing.T) {
+	require := require.New(t)
+	RegisterTransformer("application/xml", "application/json", func(body []byte) ([]byte, error) {
+		var item struct {
+			Name string `xml:"name" json:"name"`
+		}
+		if err := xml.Unmarshal(body, &item); err != nil {
+			return nil, err
+		}
+		return json.Marshal(item)
+	})
+	defer func() {
+		transformersMu.Lock()
+		delete(transformers, transformerKey{"application/xml", "application/json"})
+		transformersMu.Unlock()
+	}()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		io.WriteString(w, "<item><name>gopher</name></item>")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	get := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := get("application/json")
+	require.Equal("application/json", w.Header().Get("Content-Type"))
+	require.Equal(`{"name":"gopher"}`, w.Body.String())
+	require.Equal("Accept", w.Header().Get("Vary"))
+
+	// clients accepting xml at least as much get it as is
+	for _, accept := range []string{"application/xml", "*/*", "application/json;q=0.5, application/*"} {
+		w = get(accept)
+		require.Equal("application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+		require.Equal("<item><name>gopher</name></item>", w.Body.String())
+	}
+
+	// bodies beyond the default limit are relayed untransformed
+	defer func(max int64) { DefaultTransformMaxBytes = max }(DefaultTransformMaxBytes)
+	DefaultTransformMaxBytes = 16
+	w = get("application/json")
+	require.Equal("application/xml; charset=utf-8", w.Header().Get("Content-Type"))
+	require.Equal("<item><name>gopher</name></item>", w.Body.String())
+}
+
+func TestHttpProxy_MaxRequestBytes(t *testing.T) {
+	require := require.New(t)
+	var hits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		ioutil.ReadAll(r.Body)
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxRequestBytes: 1024}, testResolver{"example.com": {"127.0.0.1"}})
+	post := func(body io.Reader, length int64) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", testURL(backend, "example.com", "/"), body)
+		r.ContentLength = length
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := post(strings.NewReader(strings.Repeat("x", 512)), 512)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(int32(1), atomic.LoadInt32(&hits))
+
+	// declared too large, rejected before anything is sent upstream
+	w = post(strings.NewReader(strings.Repeat("x", 2048)), 2048)
+	require.Equal(http.StatusRequestEntityTooLarge, w.Code)
+	require.Equal(int32(1), atomic.LoadInt32(&hits))
+
+	// of unknown length, aborted once it grows beyond
+	w = post(io.MultiReader(strings.NewReader(strings.Repeat("x", 2048))), -1)
+	require.Equal(http.StatusRequestEntityTooLarge, w.Code)
+}
+
+func TestHttpProxy_LookupTimeout(t *testing.T) {
+	require := require.New(t)
+	// a DNS server which never answers
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	defer pc.Close()
+	r := resolver.NewResolver(pc.LocalAddr().String())
+	r.SetLookupTimeout(100 * time.Millisecond)
+
+	p := testProxy(config.Proxy{}, r)
+	start := time.Now()
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "http://slow.example/", nil))
+	require.Equal(http.StatusGatewayTimeout, w.Code)
+	require.True(time.Since(start) < time.Second)
+}
+
+// testStreamFilter filters streamed units with a func.
+type testStreamFilter func(unit []byte) []byte
+
+func (f testStreamFilter) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (f testStreamFilter) FilterStream(req *core.RequestHeader, res *core.ResponseHeader, unit []byte) []byte {
+	return f(unit)
+}
+
+func TestHttpProxy_StreamFilter(t *testing.T) {
+	require := require.New(t)
+	next := make(chan struct{})
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		io.WriteString(w, "{\"n\":1}\n{\"drop\":true}\n")
+		w.(http.Flusher).Flush()
+		<-next
+		io.WriteString(w, "{\"n\":2}\n{\"n\":3}")
+	}))
+	defer backend.Close()
+	defer func() {
+		select {
+		case <-next:
+		default:
+			close(next)
+		}
+	}()
+
+	p := testProxy(config.Proxy{StreamContentTypes: []string{"application/x-ndjson"}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	p.execute.Register(testStreamFilter(func(unit []byte) []byte {
+		if bytes.Contains(unit, []byte("drop")) {
+			return nil
+		}
+		return bytes.Replace(unit, []byte(`"n"`), []byte(`"seq"`), 1)
+	}))
+	front := httptest.NewServer(p)
+	defer front.Close()
+
+	req, _ := http.NewRequest("GET", front.URL+"/stream", nil)
+	req.Host = testHost(backend, "example.com")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+
+	// the first line arrives transformed while the origin holds the rest
+	lines := bufio.NewReader(res.Body)
+	line, err := lines.ReadString('\n')
+	require.NoError(err)
+	require.Equal("{\"seq\":1}\n", line)
+
+	close(next)
+	rest, err := ioutil.ReadAll(lines)
+	require.NoError(err)
+	// the trailing line without newline is filtered at the end of the stream
+	require.Equal("{\"seq\":2}\n{\"seq\":3}", string(rest))
+}
+
+func TestLineWriter_Events(t *testing.T) {
+	require := require.New(t)
+	var out bytes.Buffer
+	var units []string
+	lines := &lineWriter{w: &out, events: true, filter: func(unit []byte) []byte {
+		units = append(units, string(unit))
+		return unit
+	}}
+	io.WriteString(lines, "event: a\ndata: 1\n\nda")
+	io.WriteString(lines, "ta: 2\r\n\r\n")
+	require.Equal([]string{"event: a\ndata: 1\n\n", "data: 2\r\n\r\n"}, units)
+	require.Equal("event: a\ndata: 1\n\ndata: 2\r\n\r\n", out.String())
+}
+
+func TestLineWriter_MaxUnit(t *testing.T) {
+	require := require.New(t)
+	for _, events := range []bool{false, true} {
+		var out bytes.Buffer
+		var units []string
+		lines := &lineWriter{w: &out, events: events, max: 8, filter: func(unit []byte) []byte {
+			units = append(units, string(unit))
+			return bytes.ToUpper(unit)
+		}}
+		// the long unit goes out unfiltered as it arrives, the next is
+		// filtered again
+		io.WriteString(lines, "data: ")
+		io.WriteString(lines, "0123456789")
+		require.Equal("data: 0123456789", out.String(), "events %v", events)
+		io.WriteString(lines, "\n\nok\n\n")
+		require.Equal("data: 0123456789\n\nOK\n\n", out.String(), "events %v", events)
+		if events {
+			require.Equal([]string{"ok\n\n"}, units)
+		} else {
+			require.Equal([]string{"\n", "ok\n", "\n"}, units)
+		}
+	}
+}
+
+func TestHttpProxy_Prewarm(t *testing.T) {
+	require := require.New(t)
+	var conns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.StartTLS()
+	defer backend.Close()
+
+	host := testHost(backend, "example.com")
+	p := testProxy(config.Proxy{Prewarm: config.Prewarm{Hosts: []string{"https://" + host}}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	var handshakes int32
+	p.execute.Register(testObserver(func(c *core.Context) {
+		if c.Timings.TLS > 0 {
+			atomic.AddInt32(&handshakes, 1)
+		}
+	}))
+	p.prewarm(context.Background())
+	require.Equal(int32(1), atomic.LoadInt32(&conns))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", "https://"+host+"/", nil))
+	require.Equal("ok", w.Body.String())
+	// the first request went over the warm connection
+	require.Equal(int32(1), atomic.LoadInt32(&conns))
+	require.Equal(int32(0), atomic.LoadInt32(&handshakes))
+}
+
+func TestHttpProxy_SSRFProtection(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	// the backend listens on loopback, allowed here to stand in for a
+	// public address
+	p := testProxy(config.Proxy{SSRFProtection: config.SSRFProtection{
+		Enable: true,
+		Allow:  []string{"127.0.0.1/32"},
+	}}, testResolver{"example.com": {"127.0.0.1"}, "rebind.example.com": {"169.254.169.254"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.auditLog = zap.New(obs)
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "rebind.example.com", "/latest/meta-data/"), nil))
+	require.Equal(http.StatusForbidden, w.Code)
+	entries := logs.AllUntimed()
+	require.Len(entries, 1)
+	require.Equal(AuditAddrBlocked, entries[0].ContextMap()["reason"])
+	require.Equal("169.254.169.254", entries[0].ContextMap()["rule"])
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("ok", w.Body.String())
+
+	addrs, err := p.allowedAddrs("public.example.com", []string{"93.184.216.34", "10.0.0.1"})
+	require.NoError(err)
+	require.Equal([]string{"93.184.216.34"}, addrs)
+	_, err = p.allowedAddrs("internal.example.com", []string{"[fd00::1]:443"})
+	require.Error(err)
+}
+
+func TestHttpProxy_SniffContentType(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/declared" {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `<html>{}</html>`)
+			return
+		}
+		// keep net/http from sniffing it first
+		w.Header()["Content-Type"] = nil
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, "<!DOCTYPE html><html><body>hi</body></html>")
+		zw.Close()
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{SniffContentType: "missing"}, testResolver{"example.com": {"127.0.0.1"}})
+	var contentType string
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		contentType = string(res.ContentType())
+		return nil
+	}))
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("text/html; charset=utf-8", contentType)
+
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/declared"), nil))
+	require.Equal("application/json", contentType)
+	require.Equal(`<html>{}</html>`, w.Body.String())
+}
+
+func TestHttpProxy_TunnelBytes(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf := make([]byte, 4)
+		io.ReadFull(conn, buf)
+		io.WriteString(conn, "pong!!")
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	p := testProxy(config.Proxy{Tunnels: true, TunnelPorts: []int{portNum}, HostStats: true},
+		testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.accessLog = zap.New(obs)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT example.com:%s HTTP/1.1\r\nHost: example.com:%s\r\n\r\nping", port, port)
+	reply, err := ioutil.ReadAll(conn)
+	require.NoError(err)
+	require.Equal("HTTP/1.1 200 Connection established\r\n\r\npong!!", string(reply))
+
+	require.Eventually(func() bool { return logs.Len() == 1 }, 5*time.Second, 5*time.Millisecond)
+	entry := logs.AllUntimed()[0].ContextMap()
+	require.Equal("CONNECT", entry["method"])
+	require.Equal(int64(200), entry["status"])
+	require.Equal(int64(4), entry["bytes_up"])
+	require.Equal(int64(6), entry["bytes"])
+	stats := p.HostStats()["example.com"]
+	require.Equal(int64(1), stats.Tunnels)
+	require.Equal(int64(4), stats.TunnelBytesUp)
+	require.Equal(int64(6), stats.TunnelBytesDown)
+	require.True(stats.TunnelDuration > 0)
+}
+
+func TestHttpProxy_TunnelPolicy(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	connect := func(p *HttpProxy, port string) (net.Conn, string) {
+		server := httptest.NewServer(p)
+		t.Cleanup(server.Close)
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		require.NoError(err)
+		fmt.Fprintf(conn, "CONNECT example.com:%s HTTP/1.1\r\nHost: example.com:%s\r\n\r\n", port, port)
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		return conn, line
+	}
+	resolver := testResolver{"example.com": {"127.0.0.1"}}
+
+	// only the listed ports, 443 by default, are tunneled to
+	conn, line := connect(testProxy(config.Proxy{Tunnels: true}, resolver), port)
+	conn.Close()
+	require.Equal("HTTP/1.1 403 Forbidden\r\n", line)
+
+	// CONNECT is a method like any, it has to be allowed too
+	conn, line = connect(testProxy(config.Proxy{
+		Tunnels: true, TunnelPorts: []int{portNum}, AllowedMethods: []string{"GET"},
+	}, resolver), port)
+	conn.Close()
+	require.Equal("HTTP/1.1 405 Method Not Allowed\r\n", line)
+
+	// shutting down closes the tunnels still open
+	p := testProxy(config.Proxy{Tunnels: true, TunnelPorts: []int{portNum}}, resolver)
+	conn, line = connect(p, port)
+	defer conn.Close()
+	require.Equal("HTTP/1.1 200 Connection established\r\n", line)
+	upstream := <-accepted
+	defer upstream.Close()
+	require.NoError(p.Shutdown(context.Background()))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = ioutil.ReadAll(conn)
+	require.NoError(err)
+}
+
+func TestHttpProxy_RefererPolicy(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%q", r.Header["Referer"])
+	}))
+	defer backend.Close()
+
+	serve := func(policy config.RefererPolicy) (string, string) {
+		p := testProxy(config.Proxy{Referer: policy}, testResolver{"example.com": {"127.0.0.1"}})
+		var captured string
+		p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+			captured = string(req.Referer())
+			return nil
+		}))
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+		r.Header.Set("Referer", "https://search.example/results?q=secret")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w.Body.String(), captured
+	}
+	sent, captured := serve(config.RefererPolicy{})
+	require.Equal(`["https://search.example/results?q=secret"]`, sent)
+	require.Equal("https://search.example/results?q=secret", captured)
+	sent, captured = serve(config.RefererPolicy{Mode: RefererStrip})
+	require.Equal(`[]`, sent)
+	require.Equal("https://search.example/results?q=secret", captured)
+	sent, _ = serve(config.RefererPolicy{Mode: RefererOrigin})
+	require.Equal(`["https://search.example/"]`, sent)
+	sent, captured = serve(config.RefererPolicy{Mode: RefererRewrite, Value: "https://example.com/"})
+	require.Equal(`["https://example.com/"]`, sent)
+	require.Equal("https://search.example/results?q=secret", captured)
+}
+
+func TestHttpProxy_DebugCapture(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Debug", r.Header.Get(DebugHeader))
+		w.Header().Set("X-Seen-Authorization", r.Header.Get("Authorization"))
+		io.WriteString(w, "hello debug")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{DebugCapture: config.DebugCapture{TrustedPeers: []string{"192.0.2.0/24"}, MaxBodyBytes: 5}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.log = zap.New(obs)
+	serve := func(remote, debug string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/page?q=1"), nil)
+		r.RemoteAddr = remote
+		if debug != "" {
+			r.Header.Set(DebugHeader, debug)
+		}
+		r.Header.Set("X-Token", "abc")
+		r.Header.Set("Authorization", "Bearer secret-token")
+		r.Header.Set("Cookie", "session=secret-session")
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("192.0.2.7:5000", "1")
+	require.Equal("hello debug", w.Body.String())
+	require.Empty(w.Header().Get("X-Seen-Debug"))
+	entries := logs.FilterMessage("debug capture").AllUntimed()
+	require.Len(entries, 1)
+	fields := entries[0].ContextMap()
+	require.Equal("192.0.2.7", fields["client"])
+	require.Equal(int64(200), fields["status"])
+	require.Equal("hello", fields["body"])
+	require.Equal(true, fields["body_truncated"])
+	require.Contains(fmt.Sprint(fields["request_headers"]), "abc")
+	// credentials are kept out of the capture, not out of the request
+	for _, name := range []string{"request_headers", "upstream_headers"} {
+		require.NotContains(fmt.Sprint(fields[name]), "secret", name)
+		require.Contains(fmt.Sprint(fields[name]), debugRedacted, name)
+	}
+	require.Equal("Bearer secret-token", w.Header().Get("X-Seen-Authorization"))
+	require.Contains(fmt.Sprint(fields["response_headers"]), "X-Seen-Debug")
+
+	serve("192.0.2.7:5000", "")
+	serve("198.51.100.1:5000", "1")
+	require.Equal(1, logs.FilterMessage("debug capture").Len())
+}
+
+func TestHttpProxy_WeightedUpstreams(t *testing.T) {
+	require := require.New(t)
+	var hits [2]int32
+	var addrs []string
+	for i := range hits {
+		i := i
+		backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+		}))
+		defer backend.Close()
+		addrs = append(addrs, backend.Listener.Addr().String())
+	}
+
+	p := testProxy(config.Proxy{UpstreamSelection: config.UpstreamSelection{
+		Mode:    UpstreamSelectionWeighted,
+		Weights: map[string]int{addrs[0]: 9, addrs[1]: 1},
+	}}, testResolver{"example.com": addrs})
+	serve := func(n int) {
+		atomic.StoreInt32(&hits[0], 0)
+		atomic.StoreInt32(&hits[1], 0)
+		for i := 0; i < n; i++ {
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, httptest.NewRequest("GET", "http://example.com/", nil))
+			require.Equal(http.StatusOK, w.Code)
+		}
+	}
+	// within 6 standard deviations of the expected counts
+	serve(1000)
+	require.InDelta(900, atomic.LoadInt32(&hits[0]), 60)
+	require.InDelta(100, atomic.LoadInt32(&hits[1]), 60)
+
+	p.SetUpstreamWeights(config.UpstreamSelection{Canary: []string{addrs[1]}, CanaryPercent: 30})
+	serve(1000)
+	require.InDelta(700, atomic.LoadInt32(&hits[0]), 90)
+	require.InDelta(300, atomic.LoadInt32(&hits[1]), 90)
+}
+
+func TestHttpProxy_MethodOverride(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %q", r.Method, r.Header.Get(MethodOverrideHeader))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MethodOverride: true}, testResolver{"example.com": {"127.0.0.1"}})
+	var captured string
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		captured = string(req.Method())
+		return nil
+	}))
+	serve := func(method, override string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, testURL(backend, "example.com", "/items/7"), nil)
+		r.Header.Set(MethodOverrideHeader, override)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("POST", "delete")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(`DELETE ""`, w.Body.String())
+	require.Equal("DELETE", captured)
+
+	// only POST requests are overridden
+	require.Equal(`GET "DELETE"`, serve("GET", "DELETE").Body.String())
+	require.Equal(http.StatusBadRequest, serve("POST", "DEL ETE").Code)
+	require.Equal(http.StatusBadRequest, serve("POST", "CONNECT").Code)
+	// the override is subject to the allowed methods
+	require.Equal(http.StatusMethodNotAllowed, serve("POST", "TRACE").Code)
+}
+
+func TestHttpProxy_StrictDecompression(t *testing.T) {
+	require := require.New(t)
+	var valid bytes.Buffer
+	zw := gzip.NewWriter(&valid)
+	io.WriteString(zw, "hello gzip")
+	zw.Close()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		switch r.URL.Path {
+		case "/valid":
+			w.Write(valid.Bytes())
+		case "/truncated":
+			w.Write(valid.Bytes()[:valid.Len()-6])
+		default:
+			io.WriteString(w, "not gzip at all")
+		}
+	}))
+	defer backend.Close()
+
+	serve := func(cfg config.Proxy, path, acceptEncoding string) *httptest.ResponseRecorder {
+		p := testProxy(cfg, testResolver{"example.com": {"127.0.0.1"}})
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", path), nil)
+		r.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := serve(config.Proxy{}, "/malformed", "gzip")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("not gzip at all", w.Body.String())
+
+	strict := config.Proxy{StrictDecompressionStatus: 599}
+	// relayed encoded, or decoded by the transport for clients without
+	// Accept-Encoding
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		for _, path := range []string{"/malformed", "/truncated"} {
+			w = serve(strict, path, acceptEncoding)
+			require.Equal(599, w.Code, path)
+			require.Empty(w.Header().Get("Content-Encoding"), path)
+		}
+	}
+	w = serve(strict, "/valid", "gzip")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(valid.Bytes(), w.Body.Bytes())
+	w = serve(strict, "/valid", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("hello gzip", w.Body.String())
+}
+
+func TestHttpProxy_RecompressLevels(t *testing.T) {
+	require := require.New(t)
+	var text strings.Builder
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"gopher", "proxy", "upstream", "header", "body", "level", "brotli", "gzip"}
+	for text.Len() < 64<<10 {
+		text.WriteString(words[rnd.Intn(len(words))])
+		text.WriteString(strconv.Itoa(rnd.Intn(100)))
+		text.WriteByte(' ')
+	}
+	RegisterTransformer("application/x-words", "text/plain", func(body []byte) ([]byte, error) {
+		return []byte(text.String()), nil
+	})
+	defer func() {
+		transformersMu.Lock()
+		delete(transformers, transformerKey{"application/x-words", "text/plain"})
+		transformersMu.Unlock()
+	}()
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-words")
+		encoding := r.URL.Query().Get("encoding")
+		w.Header().Set("Content-Encoding", encoding)
+		var ew io.WriteCloser
+		if encoding == "br" {
+			ew = brotli.NewWriter(w)
+		} else {
+			ew = gzip.NewWriter(w)
+		}
+		io.WriteString(ew, "words")
+		ew.Close()
+	}))
+	defer backend.Close()
+
+	size := func(encoding string, cfg config.Recompress) int {
+		p := testProxy(config.Proxy{Recompress: cfg}, testResolver{"example.com": {"127.0.0.1"}})
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", "/?encoding="+encoding), nil)
+		r.Header.Set("Accept", "text/plain")
+		r.Header.Set("Accept-Encoding", encoding)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(encoding, w.Header().Get("Content-Encoding"))
+		encoded := w.Body.Len()
+		decoded, err := decodeBody(encoding, w.Body)
+		require.NoError(err)
+		body, err := ioutil.ReadAll(decoded)
+		require.NoError(err)
+		require.Equal(text.String(), string(body))
+		return encoded
+	}
+	require.True(size("gzip", config.Recompress{Enable: true, GzipLevel: 1}) >
+		size("gzip", config.Recompress{Enable: true, GzipLevel: 9}))
+	require.True(size("br", config.Recompress{Enable: true, BrotliLevel: 1}) >
+		size("br", config.Recompress{Enable: true, BrotliLevel: 11}))
+	// the defaults compress
+	require.True(size("gzip", config.Recompress{Enable: true}) < text.Len()/2)
+}
+
+func TestHttpProxy_Transparent(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{Transparent: true}, testResolver{"example.com": {"127.0.0.1"}})
+	redirected := int32(1)
+	// stands in for the SO_ORIGINAL_DST of an iptables REDIRECT
+	p.originalDst = func(conn net.Conn) (string, error) {
+		if atomic.LoadInt32(&redirected) == 0 {
+			return conn.LocalAddr().String(), nil
+		}
+		return backend.Listener.Addr().String(), nil
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go p.Serve(ln)
+	defer p.Shutdown(context.Background())
+
+	get := func(host string) string {
+		req, _ := http.NewRequest("GET", "http://"+ln.Addr().String()+"/", nil)
+		req.Host = host
+		req.Close = true
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		body, _ := ioutil.ReadAll(res.Body)
+		return string(body)
+	}
+	// the original destination is used whatever the Host resolves to
+	require.Equal("unresolvable.example", get("unresolvable.example"))
+	atomic.StoreInt32(&redirected, 0)
+	require.Equal(testHost(backend, "example.com"), get(testHost(backend, "example.com")))
+}
+
+func TestHttpProxy_MultipartStreaming(t *testing.T) {
+	require := require.New(t)
+	const size = 64 << 20
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reader, err := r.MultipartReader()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		part, err := reader.NextPart()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n, _ := io.Copy(ioutil.Discard, part)
+		fmt.Fprintf(w, "%s %d", part.FileName(), n)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{InspectRequestBodies: 1 << 10}, testResolver{"example.com": {"127.0.0.1"}})
+	rewrites := 0
+	p.execute.Register(testBodyRewriter(func(req *core.RequestHeader, body []byte) []byte {
+		rewrites++
+		return body
+	}))
+	var inspected []byte
+	var truncated bool
+	p.execute.Register(testObserver(func(c *core.Context) {
+		inspected, truncated = c.RequestBody, c.RequestBodyTruncated
+	}))
+
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		part, _ := mw.CreateFormFile("upload", "big.bin")
+		io.CopyN(part, zeroReader{}, size)
+		mw.Close()
+		pw.Close()
+	}()
+	r := httptest.NewRequest("POST", testURL(backend, "example.com", "/upload"), pr)
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	runtime.ReadMemStats(&after)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal(fmt.Sprintf("big.bin %d", size), w.Body.String())
+	// streamed, nowhere near the upload was allocated
+	require.True(after.TotalAlloc-before.TotalAlloc < size/4, "allocated %d", after.TotalAlloc-before.TotalAlloc)
+	require.Zero(rewrites)
+	require.Len(inspected, 1<<10)
+	require.True(truncated)
+	require.True(bytes.HasPrefix(inspected, []byte("--"+mw.Boundary())))
+}
+
+// zeroReader reads zeros forever.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestHttpProxy_NormalizePath(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.RequestURI)
+	}))
+	defer backend.Close()
+
+	serve := func(cfg config.PathNormalization, path string) (string, string) {
+		p := testProxy(config.Proxy{NormalizePath: cfg}, testResolver{"example.com": {"127.0.0.1"}})
+		var captured string
+		p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+			captured = string(req.RequestURI())
+			return nil
+		}))
+		r := httptest.NewRequest("GET", testURL(backend, "example.com", path), nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		require.Equal(http.StatusOK, w.Code)
+		return w.Body.String(), captured
+	}
+	sent, captured := serve(config.PathNormalization{}, "/a/../b")
+	require.Equal("/a/../b", sent)
+	require.Equal("/a/../b", captured)
+
+	enable := config.PathNormalization{Enable: true}
+	sent, captured = serve(enable, "/a/../b")
+	require.Equal("/b", sent)
+	require.Equal("/a/../b", captured)
+	sent, _ = serve(enable, "/static/../../../etc/passwd?x=1")
+	require.Equal("/etc/passwd?x=1", sent)
+	sent, _ = serve(enable, "/a//./b/")
+	require.Equal("/a/b/", sent)
+	sent, _ = serve(enable, "/a/b%2F..%2Fc")
+	require.Equal("/a/b%2F..%2Fc", sent)
+	// encoded dot segments are only seen as such once decoded
+	sent, _ = serve(enable, "/static/%2e%2e/%2E%2E/etc/passwd")
+	require.Equal("/static/%2e%2e/%2E%2E/etc/passwd", sent)
+	sent, captured = serve(config.PathNormalization{Enable: true, DecodeUnreserved: true}, "/static/%2e%2e/%2E%2E/etc/%70asswd")
+	require.Equal("/etc/passwd", sent)
+	require.Equal("/static/%2e%2e/%2E%2E/etc/%70asswd", captured)
+
+	// the rules of the proxy see the normalized path as well
+	p := testProxy(config.Proxy{
+		NormalizePath: enable,
+		StaticRoutes:  []config.StaticRoute{{Path: "/health", Status: http.StatusOK, Body: "static"}},
+		Faults:        []config.FaultRule{{Name: "admin-down", Path: "/admin/", Probability: 1, Status: http.StatusServiceUnavailable}},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/x/../health"), nil))
+	require.Equal("static", w.Body.String())
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "//admin/./users"), nil))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+}
+
+func TestHttpProxy_CORS(t *testing.T) {
+	require := require.New(t)
+	var forwarded int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&forwarded, 1)
+		w.Header().Set("Access-Control-Allow-Origin", "https://upstream.example")
+		io.WriteString(w, "hello cors")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{CORS: config.CORS{
+		Enable:        true,
+		Origins:       []string{"https://app.example"},
+		Methods:       []string{"GET", "PUT"},
+		Headers:       []string{"Content-Type", "X-Token"},
+		ExposeHeaders: []string{"X-Request-Id"},
+		Credentials:   true,
+		MaxAge:        10 * time.Minute,
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("OPTIONS", testURL(backend, "example.com", "/api"), nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", method)
+		r.Header.Set("Access-Control-Request-Headers", headers)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := preflight("https://app.example", "PUT", "content-type, x-token")
+	require.Equal(http.StatusNoContent, w.Code)
+	require.Equal("https://app.example", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal("GET, PUT", w.Header().Get("Access-Control-Allow-Methods"))
+	require.Equal("Content-Type, X-Token", w.Header().Get("Access-Control-Allow-Headers"))
+	require.Equal("true", w.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal("600", w.Header().Get("Access-Control-Max-Age"))
+	require.Contains(w.Header()["Vary"], "Origin")
+	for _, w := range []*httptest.ResponseRecorder{
+		preflight("https://evil.example", "PUT", ""),
+		preflight("https://app.example", "DELETE", ""),
+		preflight("https://app.example", "PUT", "X-Other"),
+	} {
+		require.Equal(http.StatusNoContent, w.Code)
+		require.Empty(w.Header().Get("Access-Control-Allow-Origin"))
+	}
+	require.Equal(int32(0), atomic.LoadInt32(&forwarded))
+
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/api"), nil)
+	r.Header.Set("Origin", "https://app.example")
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("hello cors", w.Body.String())
+	require.Equal("https://app.example", w.Header().Get("Access-Control-Allow-Origin"))
+	require.Equal("true", w.Header().Get("Access-Control-Allow-Credentials"))
+	require.Equal("X-Request-Id", w.Header().Get("Access-Control-Expose-Headers"))
+	require.Contains(w.Header()["Vary"], "Origin")
+	require.Equal(int32(1), atomic.LoadInt32(&forwarded))
+
+	// an OPTIONS request without a requested method is no preflight
+	r = httptest.NewRequest("OPTIONS", testURL(backend, "example.com", "/api"), nil)
+	r.Header.Set("Origin", "https://app.example")
+	p.ServeHTTP(httptest.NewRecorder(), r)
+	require.Equal(int32(2), atomic.LoadInt32(&forwarded))
+}
+
+func TestHttpProxy_MaxConnsPerIP(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{MaxConnsPerIP: 2}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go p.Serve(ln)
+	defer p.Shutdown(context.Background())
+
+	// get sends a request on conn, kept alive afterwards
+	get := func(conn net.Conn) error {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", testHost(backend, "example.com")); err != nil {
+			return err
+		}
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		_, err = ioutil.ReadAll(res.Body)
+		return err
+	}
+	var conns []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(err)
+		defer conn.Close()
+		require.NoError(get(conn))
+		conns = append(conns, conn)
+	}
+	for i := 0; i < 3; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		require.NoError(err)
+		require.Error(get(conn))
+		conn.Close()
+	}
+	require.Len(logs.FilterMessage("too many connections").AllUntimed(), 3)
+
+	// a closed connection makes room for another one
+	conns[0].Close()
+	require.Eventually(func() bool {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return false
+		}
+		defer conn.Close()
+		return get(conn) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.NoError(get(conns[1]))
+}
+
+func TestHttpProxy_MaxConnsPerIPTunnels(t *testing.T) {
+	require := require.New(t)
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer upstream.Close()
+	go func() {
+		for {
+			conn, err := upstream.Accept()
+			if err != nil {
+				return
+			}
+			// the upstream hangs up once the client did
+			go func() {
+				io.Copy(ioutil.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(upstream.Addr().String())
+	portNum, _ := strconv.Atoi(port)
+
+	p := testProxy(config.Proxy{MaxConnsPerIP: 2, Tunnels: true, TunnelPorts: []int{portNum}},
+		testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	go p.Serve(ln)
+	defer p.Shutdown(context.Background())
+
+	connect := func() (net.Conn, error) {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			return nil, err
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		fmt.Fprintf(conn, "CONNECT example.com:%s HTTP/1.1\r\nHost: example.com:%s\r\n\r\n", port, port)
+		res, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+		if err == nil && res.StatusCode != http.StatusOK {
+			err = errors.New(res.Status)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+	// open tunnels keep their slots, the one beyond the limit is refused
+	var tunnels []net.Conn
+	for i := 0; i < 2; i++ {
+		conn, err := connect()
+		require.NoError(err)
+		defer conn.Close()
+		tunnels = append(tunnels, conn)
+	}
+	_, err = connect()
+	require.Error(err)
+	require.Len(logs.FilterMessage("too many connections").AllUntimed(), 1)
+
+	// a tunnel ending makes room for another one
+	tunnels[0].Close()
+	require.Eventually(func() bool {
+		conn, err := connect()
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHttpProxy_AcceptLanguage(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{AcceptLanguage: "de-DE,de;q=0.9"}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.accessLog = zap.New(obs)
+	var captured string
+	p.execute.Register(testExecutor(func(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+		captured = string(req.AcceptLanguage())
+		return nil
+	}))
+	r := httptest.NewRequest("GET", testURL(backend, "example.com", "/"), nil)
+	r.Header.Set("Accept-Language", "en-US,en;q=0.5")
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	require.Equal("de-DE,de;q=0.9", w.Body.String())
+	require.Equal("en-US,en;q=0.5", captured)
+	entries := logs.FilterMessage("access").AllUntimed()
+	require.Len(entries, 1)
+	require.Equal("en-US,en;q=0.5", entries[0].ContextMap()["accept_language"])
+}
+
+func TestHttpProxy_UpstreamMetrics(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+	// nothing listens on 127.0.0.2, requests fail over to 127.0.0.1
+	p := testProxy(config.Proxy{UpstreamMetrics: config.UpstreamMetrics{Enable: true, MaxSeries: 2}},
+		testResolver{"example.com": {"127.0.0.2", "127.0.0.1"}, "other.com": {"127.0.0.1"}})
+	for _, path := range []string{"/", "/", "/missing"} {
+		p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", testURL(backend, "example.com", path), nil))
+	}
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", testURL(backend, "other.com", "/"), nil))
+	require.Equal(map[[3]string]int64{
+		{"example.com", "127.0.0.1", "200"}: 2,
+		{"example.com", "127.0.0.1", "404"}: 1,
+		{"other", "other", "200"}:           1,
+	}, p.UpstreamRequests())
+
+	w := httptest.NewRecorder()
+	p.MetricsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	require.Contains(w.Body.String(), "# TYPE proxy_upstream_requests_total counter\n")
+	require.Contains(w.Body.String(), `proxy_upstream_requests_total{host="example.com",ip="127.0.0.1",code="200"} 2`+"\n")
+	require.Contains(w.Body.String(), `proxy_upstream_requests_total{host="other",ip="other",code="200"} 1`+"\n")
+}
+
+func TestHttpProxy_Mirror(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fmt.Fprintf(w, "primary %s %s", r.URL.Path, body)
+	}))
+	defer backend.Close()
+	mirrored := make(chan string, 10)
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mirrored <- fmt.Sprintf("%s %s %s %s", r.Method, r.Host, r.URL.Path, body)
+		w.Header().Set("X-Shadow", "1")
+		http.Error(w, "shadow failure", http.StatusInternalServerError)
+	}))
+	defer shadow.Close()
+
+	p := testProxy(config.Proxy{Mirror: config.Mirror{
+		Upstream:    shadow.Listener.Addr().String(),
+		Probability: 1,
+		Rules:       []config.MirrorRule{{Host: "example.com", Path: "/api/"}},
+	}}, testResolver{"example.com": {"127.0.0.1"}})
+	serve := func(method, path, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, testURL(backend, "example.com", path), strings.NewReader(body))
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, r)
+		return w
+	}
+	w := serve("POST", "/api/orders", "order=1")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("primary /api/orders order=1", w.Body.String())
+	require.Empty(w.Header().Get("X-Shadow"))
+	select {
+	case got := <-mirrored:
+		require.Equal("POST "+testHost(backend, "example.com")+" /api/orders order=1", got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not mirrored")
+	}
+
+	w = serve("GET", "/static/app.js", "")
+	require.Equal("primary /static/app.js ", w.Body.String())
+
+	// an unreachable shadow leaves the primary path alone
+	shadow.Close()
+	w = serve("GET", "/api/orders", "")
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("primary /api/orders ", w.Body.String())
+	require.Empty(mirrored)
+}
+
+func TestHttpProxy_EarlyHints(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		io.WriteString(w, "final")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.accessLog = zap.New(obs)
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	var hints []string
+	var codes []int
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			codes = append(codes, code)
+			hints = append(hints, header.Values("Link")...)
+			return nil
+		},
+	}
+	req, _ := http.NewRequest("GET", server.URL+"/", nil)
+	req.Host = testHost(backend, "example.com")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal([]int{http.StatusEarlyHints}, codes)
+	require.Equal([]string{"</style.css>; rel=preload; as=style"}, hints)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("final", string(body))
+	// the backend repeats the hints on its final response, once
+	require.Len(res.Header.Values("Link"), 1)
+	entries := logs.FilterMessage("access").AllUntimed()
+	require.Len(entries, 1)
+	require.Equal(int64(http.StatusOK), entries[0].ContextMap()["status"])
+
+	p.cfg.DropInformational = true
+	codes = nil
+	req, _ = http.NewRequest("GET", server.URL+"/", nil)
+	req.Host = testHost(backend, "example.com")
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+	res, err = http.DefaultClient.Do(req)
+	require.NoError(err)
+	res.Body.Close()
+	require.Empty(codes)
+	require.Equal(http.StatusOK, res.StatusCode)
+}
+
+func TestHttpProxy_MatchedRules(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer backend.Close()
+
+	execute := executor.NewExecutor(context.Background(), config.Executor{
+		Rewrite: config.RewriteExecutor{Enable: true, Rules: []config.RewriteRule{
+			{Name: "api-v2", Path: "/api/", ToPath: "/v2/"},
+		}},
+	})
+	p := newTestProxy(config.Proxy{
+		Timeouts: []config.TimeoutRule{{Name: "slow-api", Path: "/api/", Timeout: 5 * time.Second}},
+	}, testResolver{"example.com": {"127.0.0.1"}}, execute)
+	obs, logs := observer.New(zapcore.InfoLevel)
+	p.accessLog = zap.New(obs)
+	var matched []string
+	p.execute.Register(testObserver(func(c *core.Context) {
+		matched = c.MatchedRules
+	}))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/api/users"), nil))
+	require.Equal("/v2/users", w.Body.String())
+	require.Equal([]string{"slow-api", "api-v2"}, matched)
+	entries := logs.FilterMessage("access").AllUntimed()
+	require.Len(entries, 1)
+	require.Equal([]interface{}{"slow-api", "api-v2"}, entries[0].ContextMap()["rules"])
+
+	matched = nil
+	p.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", testURL(backend, "example.com", "/static/app.js"), nil))
+	require.Empty(matched)
+	entries = logs.FilterMessage("access").AllUntimed()
+	require.Len(entries, 2)
+	require.NotContains(entries[1].ContextMap(), "rules")
+}
+
+func TestHttpProxy_ResponseDelay(t *testing.T) {
+	require := require.New(t)
+	body := strings.Repeat("x", 1000)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		ResponseDelay: config.ResponseDelay{Rules: []config.ResponseDelayRule{
+			{Name: "slow-demo", Path: "/slow", Latency: 500 * time.Millisecond},
+			{Path: "/throttled", BytesPerSecond: 4000},
+		}},
+		Timeouts: []config.TimeoutRule{{Path: "/slow/short", Timeout: 100 * time.Millisecond}},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	var matched []string
+	p.execute.Register(testObserver(func(c *core.Context) {
+		matched = c.MatchedRules
+	}))
+	serve := func(path string) time.Duration {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", path), nil))
+		require.Equal(http.StatusOK, w.Code)
+		require.Equal(body, w.Body.String())
+		return time.Since(start)
+	}
+	require.True(serve("/slow") >= 500*time.Millisecond)
+	require.Equal([]string{"slow-demo"}, matched)
+	// 1000 bytes at 4000 per second, the last 400 byte chunk is due at 200ms
+	require.True(serve("/throttled") >= 200*time.Millisecond)
+	require.True(serve("/fast") < 200*time.Millisecond)
+
+	// the upstream deadline passing while held back is a timeout
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest("GET", testURL(backend, "example.com", "/slow/short"), nil))
+	require.Equal(http.StatusGatewayTimeout, w.Code)
+	require.Empty(w.Header().Get("Content-Length"))
+}
+
+func TestHttpProxy_UpstreamResetMidBody(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		if r.URL.Path == "/chunked" {
+			buf.WriteString("HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n")
+		} else {
+			buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\nhello")
+		}
+		buf.Flush()
+		// a reset rather than a clean close
+		conn.(*net.TCPConn).SetLinger(0)
+		conn.Close()
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	server := httptest.NewServer(p)
+	defer server.Close()
+	for _, path := range []string{"/chunked", "/length"} {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = testHost(backend, "example.com")
+		res, err := http.DefaultClient.Do(req)
+		if err == nil {
+			require.Equal(http.StatusOK, res.StatusCode)
+			_, err = ioutil.ReadAll(res.Body)
+			res.Body.Close()
+			require.Equal(io.ErrUnexpectedEOF, err, path)
+		}
+		// a body of known length isn't flushed, not even its status went out
+		require.Error(err, path)
+	}
+	require.Len(logs.FilterMessage("upstream failed, partial transfer").AllUntimed(), 2)
+}
+
+// failingArchiver archives into a writer failing from the start.
+type failingArchiver struct{}
+
+func (failingArchiver) Writer(req *core.RequestHeader, res *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+func (failingArchiver) ArchiveWriter(req *core.RequestHeader, res *core.ResponseHeader) io.WriteCloser {
+	return failingArchive{}
+}
+
+type failingArchive struct{}
+
+func (failingArchive) Write(b []byte) (int, error) { return 0, errors.New("disk full") }
+func (failingArchive) Close() error                { return nil }
+
+func TestHttpProxy_UpstreamDeadlineMidBody(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello")
+		w.(http.Flusher).Flush()
+		if strings.HasPrefix(r.URL.Path, "/slow") {
+			time.Sleep(300 * time.Millisecond)
+		}
+		if r.URL.Path == "/slow/abort" {
+			panic(http.ErrAbortHandler)
+		}
+		io.WriteString(w, " world")
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{
+		Timeouts: []config.TimeoutRule{{Path: "/slow", Timeout: 100 * time.Millisecond}},
+	}, testResolver{"example.com": {"127.0.0.1"}})
+	p.execute.Register(failingArchiver{})
+	obs, logs := observer.New(zapcore.WarnLevel)
+	p.log = zap.New(obs)
+	server := httptest.NewServer(p)
+	defer server.Close()
+	get := func(path string) (string, error) {
+		req, _ := http.NewRequest("GET", server.URL+path, nil)
+		req.Host = testHost(backend, "example.com")
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer res.Body.Close()
+		body, err := ioutil.ReadAll(res.Body)
+		return string(body), err
+	}
+
+	// an archive failing doesn't fail the transfer
+	body, err := get("/fast")
+	require.NoError(err)
+	require.Equal("hello world", body)
+	require.Len(logs.FilterMessage("archive body").AllUntimed(), 1)
+
+	// the deadline ended with the headers, the body takes its time
+	body, err = get("/slow")
+	require.NoError(err)
+	require.Equal("hello world", body)
+
+	// the upstream failing mid-body is not the client disconnecting
+	_, err = get("/slow/abort")
+	require.Error(err)
+	require.Len(logs.FilterMessage("upstream failed, partial transfer").AllUntimed(), 1)
+	require.Empty(logs.FilterMessage("client disconnected, partial transfer").AllUntimed())
+}
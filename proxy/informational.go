@@ -0,0 +1,54 @@
+package proxy
+
+import (
+	"net/http"
+	"net/textproto"
+	"sync"
+)
+
+// informationalKey carries the informationalRelay of an outbound request.
+const informationalKey contextKey = "informational"
+
+// informationalRelay writes the 1xx responses of the upstream, such as 103
+// Early Hints, to the client ahead of the final response. 100 Continue is
+// left to net/http, which answers Expect itself.
+type informationalRelay struct {
+	w      http.ResponseWriter
+	filter *headerFilter
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (i *informationalRelay) relay(code int, header textproto.MIMEHeader) error {
+	if code == http.StatusContinue {
+		return nil
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	// the final response may be written already once the request failed
+	if i.done {
+		return nil
+	}
+	informational := http.Header(header).Clone()
+	removeHopHeaders(informational)
+	h := i.w.Header()
+	for k, v := range informational {
+		if i.filter.allowed(k) {
+			h[k] = v
+		}
+	}
+	i.w.WriteHeader(code)
+	// net/http keeps the fields of a 1xx for the final response
+	for k := range informational {
+		delete(h, k)
+	}
+	return nil
+}
+
+// finish stops relaying, the final response is about to be written.
+func (i *informationalRelay) finish() {
+	i.mu.Lock()
+	i.done = true
+	i.mu.Unlock()
+}
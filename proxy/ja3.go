@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type ja3Key struct{}
+
+// clientHello holds the JA3 fingerprint of a TLS connection, it is set
+// during the handshake, before the connection serves any request.
+type clientHello struct {
+	ja3 string
+}
+
+// tlsConnContext gives every client connection a holder its ClientHello
+// fingerprint is recorded into.
+func tlsConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, ja3Key{}, &clientHello{})
+}
+
+// recordClientHello records the JA3 fingerprint of the handshake, keeping
+// the listener config.
+func recordClientHello(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	if holder, ok := hello.Context().Value(ja3Key{}).(*clientHello); ok {
+		holder.ja3 = ja3Hash(hello)
+	}
+	return nil, nil
+}
+
+// requestJA3 returns the JA3 fingerprint of the request's connection, empty
+// for plain connections.
+func requestJA3(r *http.Request) string {
+	if holder, ok := r.Context().Value(ja3Key{}).(*clientHello); ok {
+		return holder.ja3
+	}
+	return ""
+}
+
+// ja3Hash returns the JA3 fingerprint of a ClientHello, the md5 of its
+// version, cipher suites, extensions, curves and point formats with GREASE
+// values left out. The handshake doesn't expose the legacy version, it is
+// the highest offered version capped at TLS 1.2 as clients send it.
+func ja3Hash(hello *tls.ClientHelloInfo) string {
+	var version uint16
+	for _, v := range hello.SupportedVersions {
+		if !grease(v) && v > version {
+			version = v
+		}
+	}
+	if version > tls.VersionTLS12 {
+		version = tls.VersionTLS12
+	}
+	curves := make([]uint16, 0, len(hello.SupportedCurves))
+	for _, curve := range hello.SupportedCurves {
+		curves = append(curves, uint16(curve))
+	}
+	points := make([]uint16, 0, len(hello.SupportedPoints))
+	for _, point := range hello.SupportedPoints {
+		points = append(points, uint16(point))
+	}
+	s := strings.Join([]string{
+		strconv.Itoa(int(version)),
+		ja3List(hello.CipherSuites),
+		ja3List(hello.Extensions),
+		ja3List(curves),
+		ja3List(points),
+	}, ",")
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func ja3List(values []uint16) string {
+	parts := make([]string, 0, len(values))
+	for _, v := range values {
+		if !grease(v) {
+			parts = append(parts, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(parts, "-")
+}
+
+// grease reports whether v is a GREASE value of RFC 8701, 0x0a0a to 0xfafa.
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// ja3Blocked returns the blocklist entry matching the client fingerprint.
+func (p *HttpProxy) ja3Blocked(ja3 string) (string, bool) {
+	if ja3 == "" {
+		return "", false
+	}
+	for _, blocked := range p.cfg.BlockedJA3 {
+		if strings.EqualFold(blocked, ja3) {
+			return blocked, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+)
+
+const (
+	// UpstreamSelectionLatency prefers the resolved address with the lowest
+	// recent latency.
+	UpstreamSelectionLatency = "latency"
+
+	defaultLatencyDecay      = 0.3
+	defaultLatencyProbeEvery = 10
+	defaultLatencyRetryAfter = 10 * time.Second
+)
+
+// upstreamLatency is the latency history of one upstream address.
+type upstreamLatency struct {
+	ewma     time.Duration
+	sampled  time.Time
+	failedAt time.Time
+}
+
+// latencyTracker keeps an exponentially weighted moving average of the
+// response latency per upstream address and orders the resolved addresses
+// by it. Every ProbeEvery selections the least recently sampled slower
+// address goes first instead, so a recovered address is noticed.
+type latencyTracker struct {
+	decay      float64
+	probeEvery int
+	retryAfter time.Duration
+
+	mu    sync.Mutex
+	n     int
+	addrs map[string]*upstreamLatency
+}
+
+func newLatencyTracker(cfg config.UpstreamSelection) *latencyTracker {
+	t := &latencyTracker{
+		decay:      cfg.Decay,
+		probeEvery: cfg.ProbeEvery,
+		retryAfter: cfg.RetryAfter,
+		addrs:      make(map[string]*upstreamLatency),
+	}
+	if t.decay <= 0 || t.decay > 1 {
+		t.decay = defaultLatencyDecay
+	}
+	if t.probeEvery <= 0 {
+		t.probeEvery = defaultLatencyProbeEvery
+	}
+	if t.retryAfter <= 0 {
+		t.retryAfter = defaultLatencyRetryAfter
+	}
+	return t
+}
+
+// observe records the latency of a response from addr.
+func (t *latencyTracker) observe(addr string, latency time.Duration) {
+	if addr == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.addrs[addr]
+	if u == nil {
+		u = &upstreamLatency{ewma: latency}
+		t.addrs[addr] = u
+	}
+	u.ewma = time.Duration(t.decay*float64(latency) + (1-t.decay)*float64(u.ewma))
+	u.sampled = time.Now()
+	u.failedAt = time.Time{}
+}
+
+// fail marks addr unhealthy for the retry period.
+func (t *latencyTracker) fail(addr string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	u := t.addrs[addr]
+	if u == nil {
+		u = &upstreamLatency{}
+		t.addrs[addr] = u
+	}
+	u.failedAt = time.Now()
+}
+
+// order returns a copy of addrs, addresses without port completed with
+// port for the lookup, healthy ones first and each group by latency.
+// Addresses never sampled go first to be measured.
+func (t *latencyTracker) order(addrs []string, port string) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	type candidate struct {
+		addr    string
+		healthy bool
+		stats   upstreamLatency
+	}
+	now := time.Now()
+	candidates := make([]candidate, len(addrs))
+	t.mu.Lock()
+	t.n++
+	probe := t.n%t.probeEvery == 0
+	for i, addr := range addrs {
+		key := addr
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			key = net.JoinHostPort(addr, port)
+		}
+		c := candidate{addr: addr, healthy: true}
+		if u := t.addrs[key]; u != nil {
+			c.stats = *u
+			c.healthy = u.failedAt.IsZero() || now.Sub(u.failedAt) > t.retryAfter
+		}
+		candidates[i] = c
+	}
+	t.mu.Unlock()
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if a.healthy != b.healthy {
+			return a.healthy
+		}
+		if a.stats.sampled.IsZero() != b.stats.sampled.IsZero() {
+			return a.stats.sampled.IsZero()
+		}
+		return a.stats.ewma < b.stats.ewma
+	})
+	if probe {
+		// move the least recently sampled healthy slower address first
+		oldest := -1
+		for i := 1; i < len(candidates) && candidates[i].healthy; i++ {
+			if oldest < 0 || candidates[i].stats.sampled.Before(candidates[oldest].stats.sampled) {
+				oldest = i
+			}
+		}
+		if oldest > 0 {
+			c := candidates[oldest]
+			copy(candidates[1:oldest+1], candidates[:oldest])
+			candidates[0] = c
+		}
+	}
+	ordered := make([]string, len(candidates))
+	for i, c := range candidates {
+		ordered[i] = c.addr
+	}
+	return ordered
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// rewriteLocation points an absolute Location of the response back at the
+// proxy, moving it onto the scheme and port the client reached the proxy
+// on and keeping the target host the proxy routes by. Relative Locations
+// already resolve against the proxy and are kept.
+func rewriteLocation(header http.Header, r *http.Request) {
+	location := header.Get("Location")
+	if location == "" {
+		return
+	}
+	target, err := url.Parse(location)
+	if err != nil || !target.IsAbs() || target.Host == "" {
+		return
+	}
+	if r.TLS != nil {
+		target.Scheme = "https"
+	} else {
+		target.Scheme = "http"
+	}
+	host := target.Hostname()
+	if _, port, err := net.SplitHostPort(r.Host); err == nil && port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		host = "[" + host + "]"
+	}
+	target.Host = host
+	header.Set("Location", target.String())
+}
@@ -0,0 +1,157 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// rawCaptureKey carries the rawCapture of an outbound request.
+const rawCaptureKey contextKey = "rawCapture"
+
+// The ConflictingLength modes.
+const (
+	ConflictingLengthNormalize = "normalize"
+	ConflictingLengthReject    = "reject"
+)
+
+// conflictCaptureBytes is the part of a plaintext response looked at for a
+// Content-Length conflicting with Transfer-Encoding, longer headers are
+// normalized.
+const conflictCaptureBytes = 16 << 10
+
+// checkConflictingLength rejects unknown ConflictingLength modes.
+func checkConflictingLength(mode string) error {
+	switch mode {
+	case "", ConflictingLengthNormalize, ConflictingLengthReject:
+		return nil
+	}
+	return fmt.Errorf("unknown mode %q", mode)
+}
+
+// conflictingLength reports whether the final response header among the
+// raw bytes read for an exchange has a Content-Length field, which
+// net/http drops when Transfer-Encoding is set.
+func conflictingLength(raw []byte) bool {
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw)))
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return false
+		}
+		header, err := tp.ReadMIMEHeader()
+		if err != nil {
+			return false
+		}
+		// 1xx responses come ahead of the final one
+		if _, status, _ := strings.Cut(line, " "); strings.HasPrefix(status, "1") {
+			continue
+		}
+		return len(header["Content-Length"]) > 0
+	}
+}
+
+// malformedResponse returns true if err is a failure to parse the upstream
+// response, net/http reports most of them as plain strings.
+func malformedResponse(err error) bool {
+	var protoErr textproto.ProtocolError
+	if errors.As(err, &protoErr) {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "malformed HTTP") || strings.Contains(msg, "malformed MIME header")
+}
+
+// captureConn keeps the first bytes read since the last reset, so the raw
+// bytes of a malformed response can be logged.
+type captureConn struct {
+	net.Conn
+	max int
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if rest := c.max - len(c.buf); rest > 0 {
+		if n < rest {
+			rest = n
+		}
+		c.buf = append(c.buf, b[:rest]...)
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+// reset starts capturing the next response.
+func (c *captureConn) reset() {
+	c.mu.Lock()
+	c.buf = c.buf[:0]
+	c.mu.Unlock()
+}
+
+func (c *captureConn) captured() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf...)
+}
+
+// captureDial wraps dial to capture up to max bytes read per exchange.
+func captureDial(dial dialFunc, max int) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &captureConn{Conn: conn, max: max}, nil
+	}
+}
+
+// captureBytes is how much of each plaintext response is captured, for
+// the malformed ones logged and the conflicting lengths rejected.
+func (p *HttpProxy) captureBytes() int {
+	max := p.cfg.LogMalformedBytes
+	if p.cfg.ConflictingLength == ConflictingLengthReject && max < conflictCaptureBytes {
+		max = conflictCaptureBytes
+	}
+	return max
+}
+
+// rawCapture receives the capturing connection an outbound request is sent
+// over.
+type rawCapture struct {
+	mu   sync.Mutex
+	conn *captureConn
+}
+
+func (r *rawCapture) set(conn net.Conn) {
+	if ordered, ok := conn.(*headerOrderConn); ok {
+		conn = ordered.Conn
+	}
+	capture, ok := conn.(*captureConn)
+	if !ok {
+		return
+	}
+	capture.reset()
+	r.mu.Lock()
+	r.conn = capture
+	r.mu.Unlock()
+}
+
+// captured returns the raw bytes read for the request.
+func (r *rawCapture) captured() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.conn == nil {
+		return nil
+	}
+	return r.conn.captured()
+}
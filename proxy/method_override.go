@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+)
+
+// MethodOverrideHeader carries the method a POST request stands for, from
+// clients whose network only lets GET and POST through.
+const MethodOverrideHeader = "X-HTTP-Method-Override"
+
+var errInvalidOverride = errors.New("invalid method override")
+
+// overrideMethod returns r with the method of its override header, which is
+// removed. Only POST requests are overridden and never into a CONNECT,
+// tunnels are established by the client's own method.
+func overrideMethod(r *http.Request) (*http.Request, error) {
+	method := strings.TrimSpace(r.Header.Get(MethodOverrideHeader))
+	if method == "" || r.Method != http.MethodPost {
+		return r, nil
+	}
+	method = strings.ToUpper(method)
+	if strings.IndexFunc(method, func(c rune) bool { return !httpguts.IsTokenRune(c) }) >= 0 ||
+		method == http.MethodConnect {
+		return nil, errInvalidOverride
+	}
+	r = r.Clone(r.Context())
+	r.Method = method
+	r.Header.Del(MethodOverrideHeader)
+	return r, nil
+}
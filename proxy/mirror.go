@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMirrorBodyBytes   = 1 << 20
+	defaultMirrorTimeout     = 5 * time.Second
+	defaultMirrorConcurrency = 100
+)
+
+// mirror replays the configured share of matching requests to a shadow
+// upstream in the background, its responses are discarded. Requests beyond
+// the shadow requests in flight, or with bodies too large to be copied,
+// aren't mirrored, so the primary path never waits on the shadow.
+type mirror struct {
+	cfg    config.Mirror
+	target *url.URL
+	client *http.Client
+	slots  chan struct{}
+	log    *zap.Logger
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newMirror(cfg config.Mirror, log *zap.Logger) (*mirror, error) {
+	target := cfg.Upstream
+	if !strings.Contains(target, "://") {
+		target = "http://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultMirrorBodyBytes
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = defaultMirrorTimeout
+	}
+	if cfg.MaxConcurrent <= 0 {
+		cfg.MaxConcurrent = defaultMirrorConcurrency
+	}
+	return &mirror{
+		cfg:    cfg,
+		target: u,
+		client: &http.Client{
+			Transport: &http.Transport{MaxIdleConnsPerHost: cfg.MaxConcurrent},
+			// the shadow's redirects are its own business
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+		slots: make(chan struct{}, cfg.MaxConcurrent),
+		log:   log,
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}, nil
+}
+
+func (m *mirror) roll() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.rand.Float64()
+}
+
+// mirror sends a copy of the outbound request req to the shadow when it is
+// matched and sampled. Its body is read ahead to be sent twice, req reads
+// it again.
+func (m *mirror) mirror(req *http.Request) {
+	rule, found := m.match(req)
+	if !found || m.roll() >= m.cfg.Probability {
+		return
+	}
+	core.MatchRule(req.Context(), rule.Name)
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > m.cfg.MaxBodyBytes {
+			return
+		}
+		var err error
+		body, err = ioutil.ReadAll(req.Body)
+		// what was read is put back in front of the rest of the body
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		if err != nil {
+			return
+		}
+	}
+	select {
+	case m.slots <- struct{}{}:
+	default:
+		m.log.Debug("mirror busy, request not mirrored", zap.String("host", req.Host))
+		return
+	}
+	shadow := req.Clone(context.Background())
+	go func() {
+		defer func() { <-m.slots }()
+		m.send(shadow, body)
+	}()
+}
+
+func (m *mirror) send(shadow *http.Request, body []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), m.cfg.Timeout)
+	defer cancel()
+	shadow = shadow.WithContext(ctx)
+	shadow.URL.Scheme, shadow.URL.Host = m.target.Scheme, m.target.Host
+	if body != nil {
+		shadow.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	res, err := m.client.Do(shadow)
+	if err != nil {
+		m.log.Warn("mirror", zap.String("host", shadow.Host), zap.String("shadow", m.target.Host), zap.Error(err))
+		return
+	}
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+// match returns the first rule matching the request, any request matches
+// when there are none. An empty rule host or path matches any.
+func (m *mirror) match(req *http.Request) (config.MirrorRule, bool) {
+	if len(m.cfg.Rules) == 0 {
+		return config.MirrorRule{}, true
+	}
+	host := strings.ToLower(stripPort(req.Host))
+	for _, rule := range m.cfg.Rules {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if !strings.HasPrefix(req.URL.Path, rule.Path) {
+			continue
+		}
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, req.Method) {
+			continue
+		}
+		return rule, true
+	}
+	return config.MirrorRule{}, false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
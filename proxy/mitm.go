@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// LeafExpiration is the validity period of the generated leaf certificates.
+	LeafExpiration time.Duration = time.Hour * 24 * 365
+)
+
+// CertGenerator issues leaf certificates signed by a CA on demand for the
+// SNI sent by the client, allowing the proxy to intercept TLS traffic.
+type CertGenerator struct {
+	sync.RWMutex
+	ca        tls.Certificate
+	caCert    *x509.Certificate
+	wildcards []string
+	cache     map[string]*tls.Certificate
+}
+
+// NewCertGenerator returns a CertGenerator using the PEM encoded CA pair.
+func NewCertGenerator(caCert, caKey []byte) (*CertGenerator, error) {
+	ca, err := tls.X509KeyPair(caCert, caKey)
+	if err != nil {
+		return nil, err
+	}
+	x509Cert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	g := &CertGenerator{
+		ca:     ca,
+		caCert: x509Cert,
+		cache:  make(map[string]*tls.Certificate),
+	}
+	return g, nil
+}
+
+// SetWildcardDomains sets the domains whose subdomains share a single
+// wildcard leaf certificate instead of one certificate per SNI.
+func (g *CertGenerator) SetWildcardDomains(domains []string) {
+	wildcards := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.Trim(strings.ToLower(domain), ".")
+		if domain != "" {
+			wildcards = append(wildcards, domain)
+		}
+	}
+	g.Lock()
+	g.wildcards = wildcards
+	g.Unlock()
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (g *CertGenerator) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	host := strings.ToLower(hello.ServerName)
+	if host == "" {
+		return nil, errors.New("mitm: client hello has no server name")
+	}
+	name := g.leafName(host)
+
+	g.RLock()
+	cert, found := g.cache[name]
+	g.RUnlock()
+	if found {
+		return cert, nil
+	}
+
+	g.Lock()
+	defer g.Unlock()
+	if cert, found = g.cache[name]; found {
+		return cert, nil
+	}
+	cert, err := g.generate(name)
+	if err != nil {
+		return nil, err
+	}
+	g.cache[name] = cert
+	return cert, nil
+}
+
+// leafName returns the certificate name to issue for host, which is a
+// wildcard of its parent domain when host falls under a wildcard domain.
+func (g *CertGenerator) leafName(host string) string {
+	g.RLock()
+	defer g.RUnlock()
+	for _, domain := range g.wildcards {
+		if strings.HasSuffix(host, "."+domain) {
+			// a wildcard only covers a single label
+			return "*" + host[strings.Index(host, "."):]
+		}
+	}
+	return host
+}
+
+func (g *CertGenerator) generate(name string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(LeafExpiration),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(name); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{name}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, g.caCert, &key.PublicKey, g.ca.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, g.ca.Certificate[0]},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testCA(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpctl test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestCertGenerator_Wildcard(t *testing.T) {
+	require := require.New(t)
+	g, err := NewCertGenerator(testCA(t))
+	require.NoError(err)
+	g.SetWildcardDomains([]string{"example.com"})
+
+	a, err := g.GetCertificate(&tls.ClientHelloInfo{ServerName: "a.example.com"})
+	require.NoError(err)
+	b, err := g.GetCertificate(&tls.ClientHelloInfo{ServerName: "b.example.com"})
+	require.NoError(err)
+	require.True(a == b)
+	require.Equal([]string{"*.example.com"}, a.Leaf.DNSNames)
+	require.NoError(a.Leaf.VerifyHostname("b.example.com"))
+
+	c, err := g.GetCertificate(&tls.ClientHelloInfo{ServerName: "www.other.com"})
+	require.NoError(err)
+	require.Equal([]string{"www.other.com"}, c.Leaf.DNSNames)
+	require.Len(g.cache, 2)
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+var (
+	// MuxPeekTimeout bounds the time a client has to send the bytes its
+	// connection is routed by.
+	MuxPeekTimeout time.Duration = time.Second * 5
+
+	errMuxClosed = errors.New("mux closed")
+)
+
+// muxPeekBytes covers the longest request line prefix MatchHTTP looks at.
+const muxPeekBytes = 24
+
+// MuxMatcher reports whether the first bytes of a connection belong to a
+// protocol. It is asked again as more bytes arrive, so it only matches once
+// the prefix is certain.
+type MuxMatcher func(prefix []byte) bool
+
+// MatchTLS matches the record header of a TLS handshake, a ClientHello.
+func MatchTLS(prefix []byte) bool {
+	return len(prefix) >= 3 && prefix[0] == 0x16 && prefix[1] == 0x03
+}
+
+// MatchHTTP matches an HTTP/1.x request line, a method token followed by a
+// space, h2c prior knowledge starts with "PRI " alike.
+func MatchHTTP(prefix []byte) bool {
+	for i, c := range prefix {
+		if c == ' ' {
+			return i > 0
+		}
+		if c < 'A' || c > 'Z' || i >= 16 {
+			return false
+		}
+	}
+	return false
+}
+
+// MatchPrefix matches connections starting with magic.
+func MatchPrefix(magic []byte) MuxMatcher {
+	return func(prefix []byte) bool {
+		return bytes.HasPrefix(prefix, magic)
+	}
+}
+
+// Mux routes the connections accepted by a listener by their first bytes,
+// to listeners or handlers, the bytes peeked are read again by them.
+// Connections matching no route within the peek size are closed.
+type Mux struct {
+	ln     net.Listener
+	peek   int
+	log    *zap.Logger
+	routes []*muxRoute
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type muxRoute struct {
+	match   MuxMatcher
+	ln      *muxListener
+	handler func(net.Conn)
+}
+
+// NewMux routes the connections of ln by their first peek bytes at most.
+func NewMux(ln net.Listener, peek int, log *zap.Logger) *Mux {
+	return &Mux{ln: ln, peek: peek, log: log, closed: make(chan struct{})}
+}
+
+// Listener returns the listener accepting the connections match matches,
+// routes are tried in the order they were added.
+func (m *Mux) Listener(match MuxMatcher) net.Listener {
+	ln := &muxListener{mux: m, conns: make(chan net.Conn), closed: make(chan struct{})}
+	m.routes = append(m.routes, &muxRoute{match: match, ln: ln})
+	return ln
+}
+
+// Handle hands the connections match matches to handler, each in its own
+// goroutine.
+func (m *Mux) Handle(match MuxMatcher, handler func(net.Conn)) {
+	m.routes = append(m.routes, &muxRoute{match: match, handler: handler})
+}
+
+// Serve accepts connections until the listener fails or the mux is closed,
+// the routes are to be added before.
+func (m *Mux) Serve() error {
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			m.Close()
+			return err
+		}
+		go m.route(conn)
+	}
+}
+
+// Close closes the listener, and with it the listeners of the routes.
+func (m *Mux) Close() error {
+	err := m.ln.Close()
+	m.closeOnce.Do(func() { close(m.closed) })
+	return err
+}
+
+func (m *Mux) route(conn net.Conn) {
+	prefix, route, err := m.peekRoute(conn)
+	if route == nil {
+		m.log.Warn("mux, no route", zap.String("remote", conn.RemoteAddr().String()),
+			zap.ByteString("prefix", prefix), zap.Error(err))
+		conn.Close()
+		return
+	}
+	conn = &peekedConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix), conn)}
+	if route.handler != nil {
+		route.handler(conn)
+		return
+	}
+	select {
+	case route.ln.conns <- conn:
+	case <-route.ln.closed:
+		conn.Close()
+	case <-m.closed:
+		conn.Close()
+	}
+}
+
+// peekRoute reads from conn until a route matches, the peek size is read
+// or the client stops sending.
+func (m *Mux) peekRoute(conn net.Conn) ([]byte, *muxRoute, error) {
+	conn.SetReadDeadline(time.Now().Add(MuxPeekTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	prefix := make([]byte, 0, m.peek)
+	for len(prefix) < m.peek {
+		n, err := conn.Read(prefix[len(prefix):m.peek])
+		prefix = prefix[:len(prefix)+n]
+		for _, route := range m.routes {
+			if route.match(prefix) {
+				return prefix, route, nil
+			}
+		}
+		if err != nil {
+			return prefix, nil, err
+		}
+	}
+	return prefix, nil, nil
+}
+
+// muxListener accepts the connections routed to it by its mux.
+type muxListener struct {
+	mux       *Mux
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (l *muxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errMuxClosed
+	case <-l.mux.closed:
+		return nil, errMuxClosed
+	}
+}
+
+// Close stops the listener only, the mux and its other routes go on.
+func (l *muxListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *muxListener) Addr() net.Addr {
+	return l.mux.ln.Addr()
+}
+
+// peekedConn reads the bytes peeked by the mux again before the rest.
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMux_Route(t *testing.T) {
+	require := require.New(t)
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	mux := NewMux(raw, muxPeekBytes, zap.NewNop())
+	defer mux.Close()
+
+	tlsServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tls")
+	}))
+	tlsServer.Listener = mux.Listener(MatchTLS)
+	// "MAGIC " looks like a request line too, the first route matching wins
+	mux.Handle(MatchPrefix([]byte("MAGIC")), func(conn net.Conn) {
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		io.WriteString(conn, "custom "+line)
+	})
+	plainServer := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "plain "+r.Method+" "+r.URL.Path)
+	}))
+	plainServer.Listener = mux.Listener(MatchHTTP)
+	tlsServer.StartTLS()
+	defer tlsServer.Close()
+	plainServer.Start()
+	defer plainServer.Close()
+	go mux.Serve()
+
+	res, err := tlsServer.Client().Get("https://" + raw.Addr().String() + "/")
+	require.NoError(err)
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal("tls", string(body))
+
+	res, err = http.Get("http://" + raw.Addr().String() + "/path")
+	require.NoError(err)
+	body, _ = ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.Equal("plain GET /path", string(body))
+
+	conn, err := net.Dial("tcp", raw.Addr().String())
+	require.NoError(err)
+	fmt.Fprint(conn, "MAGIC hello\n")
+	body, _ = ioutil.ReadAll(conn)
+	conn.Close()
+	require.Equal("custom MAGIC hello\n", string(body))
+
+	// bytes no route matches close the connection
+	conn, err = net.Dial("tcp", raw.Addr().String())
+	require.NoError(err)
+	fmt.Fprint(conn, "\x00\x01\x02 binary garbage beyond the peek size")
+	// unread bytes make it a reset rather than an EOF
+	body, _ = ioutil.ReadAll(conn)
+	conn.Close()
+	require.Empty(body)
+}
@@ -0,0 +1,60 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST of linux/netfilter_ipv4.h, which is
+// IP6T_SO_ORIGINAL_DST for IPv6 too.
+const soOriginalDst = 80
+
+// originalDestination returns the destination a connection had before
+// netfilter redirected it to the listener.
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", errors.New("original destination of a non TCP connection")
+	}
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+	var dst string
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if !ipv6 {
+			// a sockaddr_in fits the ipv6_mreq getsockopt helpers read
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			port := int(mreq.Multiaddr[2])<<8 | int(mreq.Multiaddr[3])
+			dst = net.JoinHostPort(net.IP(mreq.Multiaddr[4:8]).String(), strconv.Itoa(port))
+			return
+		}
+		// a sockaddr_in6 fits the ip6_mtuinfo one
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))
+		dst = net.JoinHostPort(net.IP(info.Addr.Addr[:]).String(), strconv.Itoa(int(port[0])<<8|int(port[1])))
+	})
+	if err != nil {
+		return "", err
+	}
+	return dst, sockErr
+}
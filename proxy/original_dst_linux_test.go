@@ -0,0 +1,37 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	require := require.New(t)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go func() {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := ln.Accept()
+	require.NoError(err)
+	defer conn.Close()
+
+	// a connection nothing redirected has none, or conntrack reports the
+	// listener itself
+	dst, err := originalDestination(conn)
+	if err == nil {
+		require.Equal(conn.LocalAddr().String(), dst)
+	}
+	_, err = originalDestination(&net.UnixConn{})
+	require.Error(err)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+)
+
+// originalDestination needs netfilter, transparent proxying is Linux only.
+func originalDestination(conn net.Conn) (string, error) {
+	return "", errors.New("transparent proxy mode is only supported on linux")
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	// DefaultPACPath is the path the PAC file is served at.
+	DefaultPACPath = "/proxy.pac"
+
+	pacContentType = "application/x-ns-proxy-autoconfig"
+)
+
+// pacRequest returns true if the request asks for the PAC file, an empty
+// PAC host matches any.
+func (p *HttpProxy) pacRequest(r *http.Request) bool {
+	pac := p.cfg.PAC
+	if !pac.Enable {
+		return false
+	}
+	if pac.Host != "" && pac.Host != strings.ToLower(stripPort(r.Host)) {
+		return false
+	}
+	path := pac.Path
+	if path == "" {
+		path = DefaultPACPath
+	}
+	return r.URL.Path == path
+}
+
+// servePAC answers with a FindProxyForURL sending the included hosts, all
+// when none is, through this proxy and the excluded ones direct. The proxy
+// address is the one the client reached unless configured.
+func (p *HttpProxy) servePAC(w http.ResponseWriter, r *http.Request) {
+	pac := p.cfg.PAC
+	addr := pac.Proxy
+	if addr == "" {
+		addr = r.Host
+	}
+	var b bytes.Buffer
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	for _, pattern := range pac.Exclude {
+		fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) return \"DIRECT\";\n", strconv.Quote(pattern))
+	}
+	proxy := strconv.Quote("PROXY " + addr)
+	if len(pac.Include) == 0 {
+		fmt.Fprintf(&b, "\treturn %s;\n", proxy)
+	} else {
+		for _, pattern := range pac.Include {
+			fmt.Fprintf(&b, "\tif (shExpMatch(host, %s)) return %s;\n", strconv.Quote(pattern), proxy)
+		}
+		b.WriteString("\treturn \"DIRECT\";\n")
+	}
+	b.WriteString("}\n")
+
+	w.Header().Set("Content-Type", pacContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		w.Write(b.Bytes())
+	}
+}
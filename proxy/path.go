@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+)
+
+// normalizePath rewrites the path of an outbound request without dot
+// segments and repeated slashes, with DecodeUnreserved also without
+// percent-encoded unreserved characters, so "/a/%2E%2E/b" is "/b" too. It
+// works on the escaped path, an encoded slash stays one.
+func normalizePath(req *http.Request, cfg config.PathNormalization) {
+	if req.URL.Opaque != "" {
+		return
+	}
+	escaped := req.URL.EscapedPath()
+	if cfg.DecodeUnreserved {
+		escaped = decodeUnreserved(escaped)
+	}
+	normalized := removeDotSegments(collapseSlashes(escaped))
+	if normalized == req.URL.EscapedPath() {
+		return
+	}
+	path, err := url.PathUnescape(normalized)
+	if err != nil {
+		return
+	}
+	req.URL.Path, req.URL.RawPath = path, normalized
+}
+
+// normalizedRequest returns a shallow copy of r with its path normalized,
+// so the rules of the proxy match the path the upstream receives.
+func normalizedRequest(r *http.Request, cfg config.PathNormalization) *http.Request {
+	r = r.WithContext(r.Context())
+	u := *r.URL
+	r.URL = &u
+	normalizePath(r, cfg)
+	return r
+}
+
+func collapseSlashes(path string) string {
+	for strings.Contains(path, "//") {
+		path = strings.ReplaceAll(path, "//", "/")
+	}
+	return path
+}
+
+// removeDotSegments is remove_dot_segments of RFC 3986 section 5.2.4, a
+// ".." never climbs above the root.
+func removeDotSegments(path string) string {
+	if path == "" {
+		return path
+	}
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, segment := range segments {
+		last := i == len(segments)-1
+		switch segment {
+		case ".":
+			if last {
+				out = append(out, "")
+			}
+		case "..":
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+			if last {
+				out = append(out, "")
+			}
+		default:
+			out = append(out, segment)
+		}
+	}
+	normalized := strings.Join(out, "/")
+	if strings.HasPrefix(path, "/") && !strings.HasPrefix(normalized, "/") {
+		normalized = "/" + normalized
+	}
+	return normalized
+}
+
+// decodeUnreserved decodes the percent-encoded unreserved characters of
+// RFC 3986 section 2.3, their encoding means nothing.
+func decodeUnreserved(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) {
+			if c, ok := unhex(path[i+1], path[i+2]); ok && unreserved(c) {
+				b.WriteByte(c)
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func unhex(hi, lo byte) (byte, bool) {
+	h, ok1 := hexValue(hi)
+	l, ok2 := hexValue(lo)
+	return h<<4 | l, ok1 && ok2
+}
+
+func hexValue(c byte) (byte, bool) {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0', true
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10, true
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+func unreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/core"
+)
+
+// pooledBody reads a response body held in a pooled buffer. With an idle
+// timeout a watchdog detaches it from the buffer, copying the bytes, once
+// nothing was read for that long, so a stalled handler can't starve the
+// pool.
+type pooledBody struct {
+	mu       sync.Mutex
+	pool     *core.BufferPool
+	buf      *bytes.Buffer
+	data     []byte
+	off      int
+	idle     time.Duration
+	timer    *time.Timer
+	onDetach func()
+}
+
+func newPooledBody(pool *core.BufferPool, buf *bytes.Buffer, idle time.Duration, onDetach func()) *pooledBody {
+	b := &pooledBody{
+		pool:     pool,
+		buf:      buf,
+		data:     buf.Bytes(),
+		idle:     idle,
+		onDetach: onDetach,
+	}
+	if idle > 0 {
+		b.timer = time.AfterFunc(idle, b.detach)
+	}
+	return b
+}
+
+func (b *pooledBody) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil && b.buf != nil {
+		b.timer.Reset(b.idle)
+	}
+	if b.off >= len(b.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, b.data[b.off:])
+	b.off += n
+	return n, nil
+}
+
+// rewind restarts reading the body from its first byte.
+func (b *pooledBody) rewind() {
+	b.mu.Lock()
+	b.off = 0
+	b.mu.Unlock()
+}
+
+func (b *pooledBody) detach() {
+	b.mu.Lock()
+	if b.buf == nil {
+		b.mu.Unlock()
+		return
+	}
+	b.data = append([]byte(nil), b.data...)
+	b.pool.Put(b.buf)
+	b.buf = nil
+	b.mu.Unlock()
+	b.onDetach()
+}
+
+// release returns the buffer to the pool, the body is empty afterwards.
+// Releasing a body again is a no-op.
+func (b *pooledBody) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	b.pool.Put(b.buf)
+	b.buf, b.data = nil, nil
+}
+
+// decodedBody reads the decoded body of a pooled body, closing it releases
+// the pooled body.
+type decodedBody struct {
+	*countingReader
+	body *pooledBody
+}
+
+func (d *decodedBody) Close() error {
+	d.body.release()
+	return nil
+}
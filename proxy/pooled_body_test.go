@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPooledBody_IdleDetach(t *testing.T) {
+	require := require.New(t)
+	pool := core.NewBufferPool(16)
+	buf := pool.Get()
+	content := bytes.Repeat([]byte("0123456789"), 100)
+	buf.Write(content)
+
+	detached := make(chan struct{})
+	body := newPooledBody(pool, buf, 20*time.Millisecond, func() { close(detached) })
+	head := make([]byte, 10)
+	_, err := body.Read(head)
+	require.NoError(err)
+
+	select {
+	case <-detached:
+	case <-time.After(5 * time.Second):
+		t.Fatal("buffer not detached from an idle body")
+	}
+	// recycled buffers are reset by the pool
+	require.Equal(0, buf.Len())
+	rest, err := ioutil.ReadAll(body)
+	require.NoError(err)
+	require.Equal(content, append(head, rest...))
+	body.release()
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// prewarm opens up to Prewarm.Size connections to each hot upstream with
+// HEAD requests, leaving them idle in the transport for the first client
+// requests. Requests go through modifyRequest so their connections are
+// pooled under the key client requests use.
+func (p *HttpProxy) prewarm(ctx context.Context) {
+	size := p.cfg.Prewarm.Size
+	if size <= 0 {
+		size = 1
+	}
+	var wg sync.WaitGroup
+	for _, host := range p.cfg.Prewarm.Hosts {
+		target := host
+		if !strings.Contains(target, "://") {
+			target = "http://" + target
+		}
+		u, err := url.Parse(target)
+		if err != nil {
+			p.log.Error("prewarm", zap.String("host", host), zap.Error(err))
+			continue
+		}
+		for i := 0; i < size; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				p.warm(ctx, u)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+func (p *HttpProxy) warm(ctx context.Context, u *url.URL) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		p.log.Error("prewarm", zap.String("host", u.Host), zap.Error(err))
+		return
+	}
+	// the scheme of proxied requests follows the client connection
+	if u.Scheme == "https" {
+		r.TLS = &tls.ConnectionState{}
+	}
+	req, err := p.modifyRequest(r)
+	if err != nil {
+		p.log.Warn("prewarm", zap.String("host", u.Host), zap.Error(err))
+		return
+	}
+	res, err := p.client.Do(req)
+	if err != nil {
+		p.log.Warn("prewarm", zap.String("host", u.Host), zap.Error(err))
+		return
+	}
+	// a drained body hands the connection back to the idle pool
+	io.Copy(ioutil.Discard, res.Body)
+	res.Body.Close()
+}
+
+// keepWarm prewarms the hot upstreams now and then every Prewarm.Interval,
+// by default half the idle timeout so warm connections never expire, until
+// done is closed.
+func (p *HttpProxy) keepWarm(done <-chan struct{}) {
+	interval := p.cfg.Prewarm.Interval
+	if interval <= 0 {
+		interval = p.transport.IdleConnTimeout / 2
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-done
+		cancel()
+	}()
+	p.prewarm(ctx)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.prewarm(ctx)
+		case <-done:
+			return
+		}
+	}
+}
@@ -11,6 +11,11 @@ type Proxy interface {
 	ListenAndServeTLS(addr string, certFile string, keyFile string) error
 }
 
+// Resolver looks up the upstream addresses of a host.
+type Resolver interface {
+	Get(host string) ([]string, error)
+}
+
 // DuplicateRequest duplicate http request
 func DuplicateRequest(request *http.Request) (dup *http.Request) {
 	var bodyBytes []byte
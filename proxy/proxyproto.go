@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"go.uber.org/zap"
+)
+
+var (
+	// ProxyProtoTimeout bounds the time a trusted peer has to send the
+	// PROXY protocol header.
+	ProxyProtoTimeout time.Duration = time.Second * 5
+
+	proxyProtoV1Prefix = []byte("PROXY ")
+	proxyProtoV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// proxyProtoListener reads the PROXY protocol v1/v2 header sent by trusted
+// L4 peers, so the accepted connections report the original client address.
+// Headers are read off the accept loop, a slow peer doesn't hold others.
+type proxyProtoListener struct {
+	net.Listener
+	trusted []*net.IPNet
+	log     *zap.Logger
+
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+func newProxyProtoListener(ln net.Listener, cfg config.ProxyProtocol, log *zap.Logger) (*proxyProtoListener, error) {
+	l := &proxyProtoListener{
+		Listener: ln,
+		log:      log,
+		conns:    make(chan net.Conn),
+		closed:   make(chan struct{}),
+	}
+	trusted, err := parseTrustedPeers(cfg.TrustedPeers)
+	if err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("proxy protocol %s", err)
+	}
+	l.trusted = trusted
+	go l.acceptLoop()
+	return l, nil
+}
+
+// parseTrustedPeers parses CIDRs, a bare IP is a single address network.
+func parseTrustedPeers(peers []string) ([]*net.IPNet, error) {
+	trusted := make([]*net.IPNet, 0, len(peers))
+	for _, peer := range peers {
+		if !strings.Contains(peer, "/") {
+			if ip := net.ParseIP(peer); ip != nil && ip.To4() != nil {
+				peer += "/32"
+			} else {
+				peer += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(peer)
+		if err != nil {
+			return nil, fmt.Errorf("trusted peer %s: %s", peer, err)
+		}
+		trusted = append(trusted, ipnet)
+	}
+	return trusted, nil
+}
+
+func ipTrusted(trusted []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range trusted {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *proxyProtoListener) acceptLoop() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(5 * time.Millisecond)
+				continue
+			}
+			l.closeOnce.Do(func() {
+				l.err = err
+				close(l.closed)
+			})
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *proxyProtoListener) handshake(conn net.Conn) {
+	if l.isTrusted(conn.RemoteAddr()) {
+		pc, err := readProxyHeader(conn)
+		if err != nil {
+			l.log.Warn("invalid proxy protocol header", zap.String("peer", conn.RemoteAddr().String()), zap.Error(err))
+			conn.Close()
+			return
+		}
+		conn = pc
+	}
+	select {
+	case l.conns <- conn:
+	case <-l.closed:
+		conn.Close()
+	}
+}
+
+func (l *proxyProtoListener) isTrusted(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return ipTrusted(l.trusted, tcpAddr.IP)
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, l.err
+	}
+}
+
+// Close makes Accept fail with net.ErrClosed, not with the error the
+// accept loop gets from the closed listener.
+func (l *proxyProtoListener) Close() error {
+	l.closeOnce.Do(func() {
+		l.err = net.ErrClosed
+		close(l.closed)
+	})
+	return l.Listener.Close()
+}
+
+// proxyConn is a connection whose remote address comes from the PROXY
+// protocol header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func readProxyHeader(conn net.Conn) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(ProxyProtoTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, err
+	}
+	var remote net.Addr
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		remote, err = readProxyHeaderV2(r)
+	case bytes.HasPrefix(sig, proxyProtoV1Prefix):
+		remote, err = readProxyHeaderV1(r)
+	default:
+		err = errors.New("missing proxy protocol header")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		remote = conn.RemoteAddr()
+	}
+	return &proxyConn{Conn: conn, r: r, remote: remote}, nil
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("proxy protocol v1 header too long")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("malformed proxy protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("malformed proxy protocol v1 address %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 parses the binary header following the signature.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported proxy protocol version %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	// LOCAL command, the connection is from the peer itself
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	switch hdr[13] >> 4 {
+	case 1:
+		if len(payload) < 12 {
+			return nil, errors.New("short proxy protocol v2 inet address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:10]))}, nil
+	case 2:
+		if len(payload) < 36 {
+			return nil, errors.New("short proxy protocol v2 inet6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:34]))}, nil
+	default:
+		return nil, nil
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestProxyProtoListener_ClientAddr(t *testing.T) {
+	require := require.New(t)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	p := testProxy(config.Proxy{}, testResolver{"example.com": {"127.0.0.1"}})
+	core, logs := observer.New(zapcore.InfoLevel)
+	p.accessLog = zap.New(core)
+
+	raw, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	ln, err := newProxyProtoListener(raw, config.ProxyProtocol{Enable: true, TrustedPeers: []string{"127.0.0.1"}}, zap.NewNop())
+	require.NoError(err)
+	defer ln.Close()
+	go http.Serve(ln, p)
+
+	v2 := append([]byte{}, proxyProtoV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 198, 51, 100, 9, 127, 0, 0, 1, 0, 0, 0, 80)
+	binary.BigEndian.PutUint16(v2[len(v2)-4:], 40000)
+
+	for header, remote := range map[string]string{
+		"PROXY TCP4 203.0.113.7 127.0.0.1 51234 80\r\n": "203.0.113.7:51234",
+		string(v2): "198.51.100.9:40000",
+	} {
+		conn, err := net.Dial("tcp", raw.Addr().String())
+		require.NoError(err)
+		fmt.Fprintf(conn, "%sGET / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", header, testHost(backend, "example.com"))
+		res, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(err)
+		require.Equal(http.StatusOK, res.StatusCode)
+		res.Body.Close()
+		conn.Close()
+
+		entries := logs.TakeAll()
+		require.Len(entries, 1)
+		require.Equal(remote, entries[0].ContextMap()["remote"])
+	}
+}
+
+func TestProxyProtoListener_AcceptAfterClose(t *testing.T) {
+	require := require.New(t)
+	for i := 0; i < 100; i++ {
+		raw, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(err)
+		ln, err := newProxyProtoListener(raw, config.ProxyProtocol{Enable: true}, zap.NewNop())
+		require.NoError(err)
+		require.NoError(ln.Close())
+		conn, err := ln.Accept()
+		require.Nil(conn)
+		require.True(errors.Is(err, net.ErrClosed), "%v", err)
+	}
+}
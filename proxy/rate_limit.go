@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+)
+
+// tokenBucket holds the tokens of one client.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client IP refilled at rate tokens a
+// second up to burst. Buckets refilled to full are no different from new
+// ones and are evicted once idle that long.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg config.RateLimit) *rateLimiter {
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = math.Max(1, math.Ceil(cfg.RequestsPerSecond))
+	}
+	return &rateLimiter{
+		rate:    cfg.RequestsPerSecond,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token of client, when none is left it returns the wait
+// until the next one.
+func (l *rateLimiter) allow(client string) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.lastSweep) > full {
+		for ip, bucket := range l.buckets {
+			if now.Sub(bucket.last) > full {
+				delete(l.buckets, ip)
+			}
+		}
+		l.lastSweep = now
+	}
+	bucket, found := l.buckets[client]
+	if !found {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second)), false
+	}
+	bucket.tokens--
+	return 0, true
+}
@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+const (
+	defaultGzipLevel   = gzip.DefaultCompression
+	defaultBrotliLevel = 5
+)
+
+// recompress encodes a modified body with the content encoding its upstream
+// response came in, at the configured level. Only gzip and br are encoded.
+func (p *HttpProxy) recompress(encoding string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch strings.ToLower(encoding) {
+	case "gzip":
+		level := p.cfg.Recompress.GzipLevel
+		if level == 0 {
+			level = defaultGzipLevel
+		}
+		zw, err := gzip.NewWriterLevel(&buf, level)
+		if err != nil {
+			return nil, err
+		}
+		zw.Write(body)
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	case "br":
+		level := p.cfg.Recompress.BrotliLevel
+		if level == 0 {
+			level = defaultBrotliLevel
+		}
+		if level < brotli.BestSpeed || level > brotli.BestCompression {
+			return nil, fmt.Errorf("brotli: invalid compression level: %d", level)
+		}
+		bw := brotli.NewWriterLevel(&buf, level)
+		bw.Write(body)
+		if err := bw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("no encoder of content encoding %q", encoding)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/millken/httpctl/config"
+)
+
+// Referer policy modes.
+const (
+	RefererStrip   = "strip"
+	RefererOrigin  = "origin"
+	RefererRewrite = "rewrite"
+)
+
+// applyRefererPolicy rewrites the Referer of an outbound request header.
+// Referers which aren't absolute URLs are stripped by the origin policy, the
+// rewrite one sets Value on every request.
+func applyRefererPolicy(header http.Header, policy config.RefererPolicy) {
+	referer := header.Get("Referer")
+	switch policy.Mode {
+	case RefererStrip:
+		header.Del("Referer")
+	case RefererOrigin:
+		if referer == "" {
+			return
+		}
+		u, err := url.Parse(referer)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			header.Del("Referer")
+			return
+		}
+		header.Set("Referer", u.Scheme+"://"+u.Host+"/")
+	case RefererRewrite:
+		header.Set("Referer", policy.Value)
+	}
+}
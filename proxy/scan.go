@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"go.uber.org/zap"
+)
+
+// bodyScan streams the response body to the scanners while it is being
+// downloaded, each scanner reads its own decoded copy through a pipe.
+type bodyScan struct {
+	pipes    []*io.PipeWriter
+	verdicts chan executor.Verdict
+}
+
+func (p *HttpProxy) startScan(ctx context.Context, scanners []executor.Scanner, contentType, encoding string) *bodyScan {
+	s := &bodyScan{verdicts: make(chan executor.Verdict, len(scanners))}
+	for _, scanner := range scanners {
+		pr, pw := io.Pipe()
+		s.pipes = append(s.pipes, pw)
+		go func(scanner executor.Scanner) {
+			// a scanner may stop early, drain so the download goes on
+			defer io.Copy(ioutil.Discard, pr)
+			body, err := decodeBody(encoding, pr)
+			if err != nil {
+				p.log.Error("scan body", zap.String("encoding", encoding), zap.Error(err))
+				s.verdicts <- executor.VerdictAllow
+				return
+			}
+			verdict, err := scanner.Scan(ctx, contentType, body)
+			if err != nil {
+				p.log.Error("scan body", zap.Error(err))
+				verdict = executor.VerdictAllow
+			}
+			s.verdicts <- verdict
+		}(scanner)
+	}
+	return s
+}
+
+func (s *bodyScan) writers() []io.Writer {
+	writers := make([]io.Writer, 0, len(s.pipes))
+	for _, pw := range s.pipes {
+		writers = append(writers, pw)
+	}
+	return writers
+}
+
+// wait ends the body streams with err, nil is a complete body, and returns
+// VerdictBlock when any scanner blocked it.
+func (s *bodyScan) wait(err error) executor.Verdict {
+	for _, pw := range s.pipes {
+		pw.CloseWithError(err)
+	}
+	verdict := executor.VerdictAllow
+	for range s.pipes {
+		if v := <-s.verdicts; v == executor.VerdictBlock {
+			verdict = v
+		}
+	}
+	return verdict
+}
+
+// block replaces the client response with the configured blocked response.
+func (p *HttpProxy) block(w http.ResponseWriter, c *core.Context) {
+	p.log.Warn("response blocked by scanner",
+		zap.ByteString("host", c.RequestHeader.Host()),
+		zap.ByteString("uri", c.RequestHeader.RequestURI()))
+	status, contentType, body := p.cfg.Blocked.Status, p.cfg.Blocked.ContentType, p.cfg.Blocked.Body
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	if contentType == "" {
+		contentType = "text/plain; charset=utf-8"
+	}
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	header := w.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	header.Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	io.WriteString(w, body)
+}
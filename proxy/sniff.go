@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+
+	"github.com/millken/httpctl/core"
+)
+
+// sniffLen is how much of the decoded body http.DetectContentType looks at.
+const sniffLen = 512
+
+// sniffContentType sets the content type of resHeader to the one sniffed
+// from the start of the decoded body when the SniffContentType policy lets
+// it replace declared. The returned reader still yields the whole body.
+func (p *HttpProxy) sniffContentType(decoded io.Reader, declared string, resHeader *core.ResponseHeader) io.Reader {
+	if !sniffAllowed(p.cfg.SniffContentType, declared) {
+		return decoded
+	}
+	prefix := make([]byte, sniffLen)
+	n, err := io.ReadFull(decoded, prefix)
+	prefix = prefix[:n]
+	rest := io.MultiReader(bytes.NewReader(prefix), decoded)
+	if n == 0 || (err != nil && err != io.EOF && err != io.ErrUnexpectedEOF) {
+		return rest
+	}
+	sniffed := http.DetectContentType(prefix)
+	// a generic guess, such as text/plain for JSON, says less than the
+	// declared type
+	if declared != "" && genericType(sniffed) {
+		return rest
+	}
+	if mediaType(sniffed) != mediaType(declared) {
+		resHeader.SetContentType(sniffed)
+	}
+	return rest
+}
+
+func sniffAllowed(policy, declared string) bool {
+	switch policy {
+	case "missing":
+		return declared == ""
+	case "generic":
+		return declared == "" || genericType(declared)
+	case "always":
+		return true
+	}
+	return false
+}
+
+func mediaType(contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func genericType(contentType string) bool {
+	switch mediaType(contentType) {
+	case "text/plain", "application/octet-stream":
+		return true
+	}
+	return false
+}
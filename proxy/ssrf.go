@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultBlockedRanges are the private, loopback, link-local and metadata
+// ranges upstreams may not resolve to when none are configured.
+var DefaultBlockedRanges = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"::/128",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// blockedAddrError is returned when every resolved address of a host lies
+// in a blocked range.
+type blockedAddrError struct {
+	host string
+	addr string
+}
+
+func (e *blockedAddrError) Error() string {
+	return fmt.Sprintf("upstream %s resolves to blocked address %s", e.host, e.addr)
+}
+
+// allowedAddrs drops the resolved addresses in blocked ranges, unless they
+// are in an allowed one. It runs on the resolved addresses, the ones dialed,
+// so a host rebinding its name to an internal address is caught too.
+func (p *HttpProxy) allowedAddrs(host string, addrs []string) ([]string, error) {
+	if len(p.ssrfBlock) == 0 {
+		return addrs, nil
+	}
+	allowed := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		ip := addr
+		if h, _, err := net.SplitHostPort(addr); err == nil {
+			ip = h
+		}
+		parsed := net.ParseIP(strings.Trim(ip, "[]"))
+		if parsed == nil || (ipTrusted(p.ssrfBlock, parsed) && !ipTrusted(p.ssrfAllow, parsed)) {
+			continue
+		}
+		allowed = append(allowed, addr)
+	}
+	if len(allowed) == 0 && len(addrs) > 0 {
+		return nil, &blockedAddrError{host: host, addr: addrs[0]}
+	}
+	return allowed, nil
+}
@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+)
+
+const (
+	defaultStaleMaxEntries   = 1000
+	defaultStaleMaxBodyBytes = 1 << 20
+)
+
+// staleEntry is the last good response of a request.
+type staleEntry struct {
+	status int
+	header http.Header
+	body   []byte
+	stored time.Time
+	window time.Duration
+}
+
+// staleCache keeps the last good response of GETs so it can be served,
+// marked stale, when the upstream fails afterwards (RFC 5861
+// stale-if-error). It never serves fresh responses, it is no cache.
+type staleCache struct {
+	cfg config.StaleIfError
+
+	mu      sync.Mutex
+	entries map[string]*staleEntry
+}
+
+func newStaleCache(cfg config.StaleIfError) *staleCache {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultStaleMaxEntries
+	}
+	if cfg.MaxBodyBytes <= 0 {
+		cfg.MaxBodyBytes = defaultStaleMaxBodyBytes
+	}
+	return &staleCache{cfg: cfg, entries: make(map[string]*staleEntry)}
+}
+
+// staleKey keys responses alike coalesced fetches, responses varying on
+// other fields aren't kept.
+func staleKey(req *http.Request) string {
+	key := req.URL.Scheme + "://" + req.Host + req.URL.RequestURI()
+	for _, name := range coalesceKeyHeaders {
+		key += "\x00" + req.Header.Get(name)
+	}
+	return key
+}
+
+// staleWindow returns how long a response may be served stale, its
+// stale-if-error directive overriding the configured window. no-store and
+// private responses are never kept.
+func (s *staleCache) staleWindow(header http.Header) (time.Duration, bool) {
+	window := s.cfg.Window
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store", directive == "private":
+			return 0, false
+		case strings.HasPrefix(directive, "stale-if-error="):
+			if seconds, err := strconv.Atoi(directive[len("stale-if-error="):]); err == nil {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return window, window > 0
+}
+
+// store keeps the response of req, header being the upstream fields sent
+// to the client, before those the proxy adds for it.
+func (s *staleCache) store(req *http.Request, status int, header http.Header, body []byte) {
+	if status != http.StatusOK || !coalescable(req) || int64(len(body)) > s.cfg.MaxBodyBytes ||
+		header.Get("Set-Cookie") != "" || !varyWithin(header, coalesceKeyHeaders) {
+		return
+	}
+	window, ok := s.staleWindow(header)
+	if !ok {
+		return
+	}
+	entry := &staleEntry{
+		status: status,
+		header: header.Clone(),
+		body:   append([]byte(nil), body...),
+		stored: time.Now(),
+		window: window,
+	}
+	key := staleKey(req)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, found := s.entries[key]; !found && len(s.entries) >= s.cfg.MaxEntries {
+		// make room dropping any entry, expired ones first
+		var victim string
+		for k, e := range s.entries {
+			victim = k
+			if time.Since(e.stored) > e.window {
+				break
+			}
+		}
+		delete(s.entries, victim)
+	}
+	s.entries[key] = entry
+}
+
+// serve answers req with its stale response still within its window and
+// reports whether it did, decorate adds the fields of the client.
+func (s *staleCache) serve(w http.ResponseWriter, req *http.Request, decorate func(http.Header)) bool {
+	if !coalescable(req) {
+		return false
+	}
+	key := staleKey(req)
+	s.mu.Lock()
+	entry, found := s.entries[key]
+	if found && time.Since(entry.stored) > entry.window {
+		delete(s.entries, key)
+		found = false
+	}
+	s.mu.Unlock()
+	if !found {
+		return false
+	}
+	header := w.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, v := range entry.header {
+		header[k] = append([]string(nil), v...)
+	}
+	decorate(header)
+	header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	header.Add("Warning", `110 - "Response is Stale"`)
+	header.Add("Warning", `111 - "Revalidation Failed"`)
+	header.Set("Content-Length", strconv.Itoa(len(entry.body)))
+	w.WriteHeader(entry.status)
+	w.Write(entry.body)
+	return true
+}
+
+// serveStale answers req with its stale response, with the CORS fields of
+// the client request r.
+func (p *HttpProxy) serveStale(w http.ResponseWriter, r, req *http.Request) bool {
+	return p.stale.serve(w, req, func(header http.Header) {
+		if p.cfg.CORS.Enable {
+			p.setCORSHeaders(header, r)
+		}
+	})
+}
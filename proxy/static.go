@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+	"go.uber.org/zap"
+)
+
+// staticRoute returns the static route of the request host and path, an
+// empty route host matches any.
+func (p *HttpProxy) staticRoute(r *http.Request) (config.StaticRoute, bool) {
+	host := strings.ToLower(stripPort(r.Host))
+	for _, route := range p.cfg.StaticRoutes {
+		if route.Host != "" && route.Host != host {
+			continue
+		}
+		if route.Path == r.URL.Path {
+			return route, true
+		}
+	}
+	return config.StaticRoute{}, false
+}
+
+// serveStatic answers the request with the static route, a file body gets
+// its content type from the extension or the content itself.
+func (p *HttpProxy) serveStatic(w http.ResponseWriter, r *http.Request, route config.StaticRoute) {
+	body := []byte(route.Body)
+	contentType := ""
+	if route.File != "" {
+		var err error
+		if body, err = ioutil.ReadFile(route.File); err != nil {
+			p.log.Error("static route", zap.String("file", route.File), zap.Error(err))
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		if contentType = mime.TypeByExtension(filepath.Ext(route.File)); contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+	}
+	header := w.Header()
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	for k, v := range route.Headers {
+		header.Set(k, v)
+	}
+	if header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	status := route.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
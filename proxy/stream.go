@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// DefaultStreamContentTypes are the streamed media types when none are
+// configured.
+var DefaultStreamContentTypes = []string{"text/event-stream"}
+
+// streaming reports whether the response is relayed as a stream.
+func (p *HttpProxy) streaming(response *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	types := p.cfg.StreamContentTypes
+	if len(types) == 0 {
+		types = DefaultStreamContentTypes
+	}
+	for _, t := range types {
+		if strings.EqualFold(t, mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// handlerWriter shields the stream from a failing handler, its writes are
+// dropped after the first error.
+type handlerWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (h *handlerWriter) Write(b []byte) (int, error) {
+	if h.err == nil {
+		_, h.err = h.w.Write(b)
+	}
+	return len(b), nil
+}
+
+// filtersStream reports whether the stream filters see the response, they
+// only apply to bodies sent without content encoding.
+func (p *HttpProxy) filtersStream(response *http.Response) bool {
+	return p.execute.HasStreamFilters() && response.Header.Get("Content-Encoding") == ""
+}
+
+// DefaultStreamUnitBytes bounds the line or event a stream filter sees, a
+// longer one is relayed unfiltered as it arrives rather than held back.
+var DefaultStreamUnitBytes = 1 << 20
+
+// lineWriter splits a stream into lines, or events for server-sent events,
+// writing each through filter as soon as it is complete. Units growing
+// beyond max bytes are passed through unfiltered.
+type lineWriter struct {
+	w      io.Writer
+	events bool
+	filter func(unit []byte) []byte
+	max    int
+	buf    []byte
+	// text is set once the line being received has more than its end
+	text bool
+	// raw is set while the rest of an oversized unit is passed through
+	raw bool
+}
+
+func (l *lineWriter) Write(b []byte) (int, error) {
+	for _, c := range b {
+		l.buf = append(l.buf, c)
+		if c != '\n' {
+			l.text = l.text || c != '\r'
+		} else {
+			blank := !l.text
+			l.text = false
+			if !l.events || blank {
+				if err := l.emit(); err != nil {
+					return 0, err
+				}
+				continue
+			}
+		}
+		if l.max > 0 && len(l.buf) >= l.max {
+			l.raw = true
+			if err := l.pass(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	// the rest of an oversized unit isn't held back either
+	if l.raw {
+		if err := l.pass(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// emit writes the buffered unit through the filter, or as is when the
+// unit was too long to be filtered.
+func (l *lineWriter) emit() error {
+	if l.raw {
+		l.raw = false
+		return l.pass()
+	}
+	unit := l.buf
+	l.buf = nil
+	if unit = l.filter(unit); len(unit) > 0 {
+		_, err := l.w.Write(unit)
+		return err
+	}
+	return nil
+}
+
+// pass writes the buffered bytes unfiltered.
+func (l *lineWriter) pass() error {
+	unit := l.buf
+	l.buf = nil
+	if len(unit) == 0 {
+		return nil
+	}
+	_, err := l.w.Write(unit)
+	return err
+}
+
+// Close emits the trailing unit the stream ended without delimiter.
+func (l *lineWriter) Close() error {
+	if len(l.buf) == 0 {
+		return nil
+	}
+	return l.emit()
+}
+
+// stream relays a streaming response, each chunk is flushed to the client
+// and fed to the handlers as it arrives instead of the body after EOF.
+// ctx is the context of the client request, the upstream deadline ended
+// with the headers, start is the start of the exchange, for the total timing.
+// Streams are neither buffered nor scanned, stream filters hold back the
+// client's copy only up to the end of the current line or event.
+func (p *HttpProxy) stream(ctx context.Context, c *core.Context, client *clientWriter, response *http.Response, start time.Time) {
+	writers := []io.Writer{client}
+	// the filters only change what the client receives
+	var lines *lineWriter
+	if p.filtersStream(response) {
+		mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+		lines = &lineWriter{w: client, events: mediaType == "text/event-stream", max: DefaultStreamUnitBytes,
+			filter: func(unit []byte) []byte {
+				return p.execute.FilterStream(c.RequestHeader, c.ResponseHeader, unit)
+			}}
+		writers[0] = lines
+	}
+	archives := newArchiveWriters(p.execute.ArchiveWriters(c.RequestHeader, c.ResponseHeader))
+	for _, archive := range archives {
+		writers = append(writers, archive)
+	}
+	var decoded *io.PipeWriter
+	// counted is set when the handlers see the raw body
+	var counted bool
+	done := make(chan struct{})
+	handlers := p.execute.Writer(c.RequestHeader, c.ResponseHeader)
+	consumers := p.execute.BodyConsumers(c.RequestHeader, c.ResponseHeader)
+	for _, consumer := range consumers {
+		handlers = append(handlers, consumer)
+	}
+	if len(handlers) > 0 {
+		for i, handler := range handlers {
+			handlers[i] = &handlerWriter{w: handler}
+		}
+		encoding := p.contentEncoding(response)
+		if encoding == "" {
+			writers = append(writers, handlers...)
+			counted = true
+			close(done)
+		} else {
+			var pr *io.PipeReader
+			pr, decoded = io.Pipe()
+			writers = append(writers, decoded)
+			go func() {
+				defer close(done)
+				defer io.Copy(ioutil.Discard, pr)
+				reader, err := decodeBody(encoding, pr)
+				if _, unavailable := err.(*decoderInitError); unavailable {
+					p.logDecodeError("decompress stream", encoding, err)
+					reader = pr
+				} else if err != nil {
+					p.logDecodeError("decompress stream", encoding, err)
+					return
+				}
+				n, _ := io.Copy(io.MultiWriter(handlers...), reader)
+				c.DecodedBytes = n
+			}()
+		}
+	} else {
+		close(done)
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), response.Body)
+	if lines != nil && err == nil {
+		err = lines.Close()
+	}
+	c.Timings.Total = time.Since(start)
+	p.closeArchives(c, archives)
+	if decoded != nil {
+		decoded.CloseWithError(err)
+	}
+	<-done
+	c.ResponseBytes = n
+	if counted {
+		c.DecodedBytes = n
+	}
+	for _, consumer := range consumers {
+		consumer.Close()
+	}
+	if err != nil && (client.err != nil || ctx.Err() != nil) {
+		p.log.Warn("client disconnected, partial stream",
+			zap.ByteString("host", c.RequestHeader.Host()),
+			zap.ByteString("uri", c.RequestHeader.RequestURI()),
+			zap.Int64("bytes", n), zap.Error(err))
+	} else if err != nil {
+		p.upstreamTruncated(client.w, c, n, err, true)
+	}
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+// checkDecoding decodes body, up to MaxDecompressedBytes, and returns the
+// error its decoder failed with.
+func (p *HttpProxy) checkDecoding(encoding string, body []byte) error {
+	reader, err := decodeBody(encoding, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if max := p.cfg.MaxDecompressedBytes; max > 0 {
+		reader = io.LimitReader(reader, max)
+	}
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err
+}
+
+// decodingFailed answers a response whose body failed to decode with the
+// StrictDecompressionStatus instead of the corrupt body.
+func (p *HttpProxy) decodingFailed(w http.ResponseWriter, c *core.Context, err error) {
+	p.log.Error("decompress body, response rejected",
+		zap.ByteString("host", c.RequestHeader.Host()),
+		zap.ByteString("uri", c.RequestHeader.RequestURI()),
+		zap.Error(err))
+	status := p.cfg.StrictDecompressionStatus
+	header := w.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	text := http.StatusText(status)
+	if text == "" {
+		text = "upstream response failed to decompress"
+	}
+	http.Error(w, text, status)
+}
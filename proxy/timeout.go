@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/core"
+)
+
+// upstreamTimeout returns the timeout of the first rule matching the request
+// host and path prefix, the global RequestTimeout otherwise. An empty rule
+// host or path matches any.
+func (p *HttpProxy) upstreamTimeout(r *http.Request) time.Duration {
+	host := strings.ToLower(stripPort(r.Host))
+	for _, rule := range p.cfg.Timeouts {
+		if rule.Host != "" && rule.Host != host {
+			continue
+		}
+		if strings.HasPrefix(r.URL.Path, rule.Path) {
+			core.MatchRule(r.Context(), rule.Name)
+			return rule.Timeout
+		}
+	}
+	return p.cfg.RequestTimeout
+}
+
+// headerDeadline is the upstream deadline of an exchange. It ends with
+// context.DeadlineExceeded once its timeout passes, unless stopped before:
+// the deadline bounds the exchange up to the response headers, the body
+// streams on for as long as it takes.
+type headerDeadline struct {
+	context.Context
+	timer *time.Timer
+}
+
+// withHeaderDeadline returns a context of parent ending after timeout, or
+// when cancel is called.
+func withHeaderDeadline(parent context.Context, timeout time.Duration) (*headerDeadline, context.CancelFunc) {
+	ctx, cancel := context.WithCancelCause(parent)
+	d := &headerDeadline{Context: ctx}
+	d.timer = time.AfterFunc(timeout, func() { cancel(context.DeadlineExceeded) })
+	return d, func() {
+		d.timer.Stop()
+		cancel(context.Canceled)
+	}
+}
+
+// Err tells the deadline passing apart from a cancellation, as the
+// lookups and the error pages do with deadlines.
+func (d *headerDeadline) Err() error {
+	err := d.Context.Err()
+	if err != nil && context.Cause(d.Context) == context.DeadlineExceeded {
+		return context.DeadlineExceeded
+	}
+	return err
+}
+
+// stop keeps the deadline from passing, it is a no-op on a nil deadline.
+func (d *headerDeadline) stop() {
+	if d != nil {
+		d.timer.Stop()
+	}
+}
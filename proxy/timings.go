@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+const (
+	// resolveDurationKey carries how long resolving the upstream took.
+	resolveDurationKey contextKey = "resolveDuration"
+	// phaseTimerKey carries the phaseTimer of the outbound request.
+	phaseTimerKey contextKey = "phaseTimer"
+)
+
+// phaseTimer collects the phases of an upstream exchange from the trace
+// hooks, which dials may call from their own goroutine.
+type phaseTimer struct {
+	start time.Time
+
+	mu                           sync.Mutex
+	connectStart, connectDone    time.Time
+	tlsStart, tlsDone, firstByte time.Time
+}
+
+// mark sets at to now, unless first is set and at already marked.
+func (t *phaseTimer) mark(at *time.Time, first bool) {
+	t.mu.Lock()
+	if !first || at.IsZero() {
+		*at = time.Now()
+	}
+	t.mu.Unlock()
+}
+
+// hook adds the phase hooks to trace. Failover dials span from the first
+// connect to the last.
+func (t *phaseTimer) hook(trace *httptrace.ClientTrace) {
+	trace.ConnectStart = func(network, addr string) { t.mark(&t.connectStart, true) }
+	trace.ConnectDone = func(network, addr string, err error) { t.mark(&t.connectDone, false) }
+	trace.TLSHandshakeStart = func() { t.mark(&t.tlsStart, true) }
+	trace.TLSHandshakeDone = func(tls.ConnectionState, error) { t.mark(&t.tlsDone, false) }
+	trace.GotFirstResponseByte = func() { t.mark(&t.firstByte, true) }
+}
+
+// timings returns the phases so far, those not run, like the connect of a
+// reused connection, are zero.
+func (t *phaseTimer) timings(resolve time.Duration) core.Timings {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	timings := core.Timings{DNS: resolve}
+	if !t.connectStart.IsZero() && !t.connectDone.IsZero() {
+		timings.Connect = t.connectDone.Sub(t.connectStart)
+	}
+	if !t.tlsStart.IsZero() && !t.tlsDone.IsZero() {
+		timings.TLS = t.tlsDone.Sub(t.tlsStart)
+	}
+	if !t.firstByte.IsZero() {
+		timings.TTFB = t.firstByte.Sub(t.start)
+	}
+	return timings
+}
+
+// logSlow warns about transactions whose upstream exchange took longer than
+// the SlowRequestThreshold, with the phases it spent the time in.
+func (p *HttpProxy) logSlow(c *core.Context) {
+	threshold := p.cfg.SlowRequestThreshold
+	if threshold <= 0 || c.Timings.Total <= threshold {
+		return
+	}
+	path := c.RequestHeader.RequestURI()
+	if i := bytes.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	p.log.Warn("slow upstream request",
+		zap.ByteString("host", c.RequestHeader.Host()),
+		zap.ByteString("path", path),
+		zap.String("addr", c.UpstreamAddr),
+		zap.Duration("duration", c.Timings.Total),
+		zap.Duration("threshold", threshold),
+		zap.Duration("ttfb", c.Timings.TTFB))
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// tlsVersions are the accepted MinTLSVersion values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, found := tlsVersions[version]; found {
+		return v, nil
+	}
+	return 0, fmt.Errorf("unknown tls version %q", version)
+}
+
+// parseCipherSuites returns the ids of the named cipher suites, as named by
+// crypto/tls, insecure ones included.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	known := map[string]uint16{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		known[suite.Name] = suite.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, found := known[name]
+		if !found {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// serverTLSConfig returns the config of the client facing TLS listeners.
+// Cipher suites only apply up to TLS 1.2, TLS 1.3 ones aren't configurable.
+// Servers using it record client fingerprints with tlsConnContext.
+func (p *HttpProxy) serverTLSConfig(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)) *tls.Config {
+	return &tls.Config{
+		GetCertificate:     getCertificate,
+		GetConfigForClient: recordClientHello,
+		MinVersion:         p.minTLSVersion,
+		CipherSuites:       p.cipherSuites,
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// Transformer converts a decoded response body from one media type to
+// another.
+type Transformer func(body []byte) ([]byte, error)
+
+type transformerKey struct {
+	from, to string
+}
+
+// DefaultTransformMaxBytes bounds the bodies read for a transformation when
+// MaxDecompressedBytes isn't configured.
+var DefaultTransformMaxBytes int64 = 8 << 20
+
+// transformersMu guards transformers against registrations while serving.
+var transformersMu sync.RWMutex
+
+var transformers = map[transformerKey]Transformer{}
+
+// RegisterTransformer registers the transformer of response bodies of media
+// type from to media type to, used for clients preferring the latter in
+// their Accept header.
+func RegisterTransformer(from, to string, transformer Transformer) {
+	transformersMu.Lock()
+	transformers[transformerKey{strings.ToLower(from), strings.ToLower(to)}] = transformer
+	transformersMu.Unlock()
+}
+
+// negotiateTransformer returns the transformer of the response media type
+// to the one the client prefers most, none when the client accepts the
+// response as is at least as much.
+func negotiateTransformer(accept, contentType string) (string, Transformer) {
+	if accept == "" {
+		return "", nil
+	}
+	from, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", nil
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := "", acceptQuality(ranges, from)
+	var transformer Transformer
+	transformersMu.RLock()
+	defer transformersMu.RUnlock()
+	for key, t := range transformers {
+		if key.from != from {
+			continue
+		}
+		if q := acceptQuality(ranges, key.to); q > bestQ {
+			best, bestQ, transformer = key.to, q, t
+		}
+	}
+	return best, transformer
+}
+
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType: mediaType, q: q})
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the most specific range matching
+// mediaType, 0 when none does.
+func acceptQuality(ranges []acceptRange, mediaType string) float64 {
+	q, specificity := 0.0, -1
+	major := mediaType
+	if i := strings.IndexByte(mediaType, '/'); i >= 0 {
+		major = mediaType[:i]
+	}
+	for _, r := range ranges {
+		s := -1
+		switch r.mediaType {
+		case mediaType:
+			s = 2
+		case major + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// transformResponse replaces the body of the response with the one of the
+// media type negotiated with the client, decoded or with Recompress encoded
+// again. The response is left alone when the transformation fails or the
+// body exceeds MaxDecompressedBytes, by default DefaultTransformMaxBytes.
+func (p *HttpProxy) transformResponse(r *http.Request, response *http.Response) {
+	if !hasBody(response) {
+		return
+	}
+	to, transformer := negotiateTransformer(r.Header.Get("Accept"), response.Header.Get("Content-Type"))
+	if transformer == nil {
+		return
+	}
+	max := p.cfg.MaxDecompressedBytes
+	if max <= 0 {
+		max = DefaultTransformMaxBytes
+	}
+	raw, err := ioutil.ReadAll(io.LimitReader(response.Body, max+1))
+	// what was read is put back in front of the rest of the body
+	restore := func() {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), response.Body), response.Body}
+	}
+	if err != nil || int64(len(raw)) > max {
+		restore()
+		return
+	}
+	body := raw
+	encoding := response.Header.Get("Content-Encoding")
+	if encoding != "" {
+		decoded, err := decodeBody(encoding, bytes.NewReader(raw))
+		if err == nil {
+			body, err = ioutil.ReadAll(io.LimitReader(decoded, max+1))
+		}
+		if err != nil || int64(len(body)) > max {
+			p.log.Warn("transform response, body not decoded", zap.String("encoding", encoding), zap.Error(err))
+			restore()
+			return
+		}
+	}
+	transformed, err := transformer(body)
+	if err != nil {
+		p.log.Warn("transform response", zap.String("host", r.Host), zap.String("to", to), zap.Error(err))
+		restore()
+		return
+	}
+	response.Header.Del("Content-Encoding")
+	if encoding != "" && p.cfg.Recompress.Enable {
+		if encoded, err := p.recompress(encoding, transformed); err != nil {
+			p.log.Warn("transform response, body sent decoded", zap.String("encoding", encoding), zap.Error(err))
+		} else {
+			transformed = encoded
+			response.Header.Set("Content-Encoding", encoding)
+		}
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(transformed))
+	response.ContentLength = int64(len(transformed))
+	response.TransferEncoding = nil
+	response.Header.Set("Content-Type", to)
+	response.Header.Set("Content-Length", strconv.Itoa(len(transformed)))
+	response.Header.Add("Vary", "Accept")
+}
@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"context"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// originalDstKey carries the ip:port a transparently redirected client
+// connection was headed to.
+const originalDstKey contextKey = "originalDst"
+
+// transparentConnContext records the original destination of connections
+// redirected to the listener, by iptables REDIRECT for one. Connections made
+// to the listener itself are proxied by their Host.
+func (p *HttpProxy) transparentConnContext(ctx context.Context, conn net.Conn) context.Context {
+	dst, err := p.originalDst(conn)
+	if err != nil {
+		p.log.Warn("transparent proxy, no original destination",
+			zap.String("remote", conn.RemoteAddr().String()), zap.Error(err))
+		return ctx
+	}
+	if dst == conn.LocalAddr().String() {
+		return ctx
+	}
+	return context.WithValue(ctx, originalDstKey, dst)
+}
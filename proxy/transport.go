@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+
+	"github.com/millken/httpctl/core"
+	"go.uber.org/zap"
+)
+
+type contextKey string
+
+// upstreamHostKey carries the requested host name along the outbound
+// request, the name the upstream is asked for in the TLS handshake.
+const upstreamHostKey contextKey = "upstreamHost"
+
+// upstreamAddrsKey carries the resolved addresses of the requested host,
+// dialed in order until one of them accepts the connection.
+const upstreamAddrsKey contextKey = "upstreamAddrs"
+
+// upstreamAddr returns the address req is dialed at first.
+func upstreamAddr(req *http.Request) string {
+	addrs, ok := req.Context().Value(upstreamAddrsKey).([]string)
+	if !ok || len(addrs) == 0 {
+		return req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(addrs[0]); err == nil {
+		return addrs[0]
+	}
+	return net.JoinHostPort(addrs[0], req.URL.Port())
+}
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (p *HttpProxy) newTransport() *http.Transport {
+	transport := core.CreateHTTPTransport(nil)
+	if p.cfg.UpstreamKeepAlive != 0 {
+		transport.DialContext = core.CreateDialer(nil, p.cfg.UpstreamKeepAlive).DialContext
+	}
+	if p.cfg.UpstreamIdleTimeout > 0 {
+		transport.IdleConnTimeout = p.cfg.UpstreamIdleTimeout
+	}
+	// the warm connections of a host are all kept idle
+	if size := p.cfg.Prewarm.Size; size > transport.MaxIdleConnsPerHost {
+		transport.MaxIdleConnsPerHost = size
+	}
+	p.dial = p.countDial(p.failoverDial(transport.DialContext))
+	transport.DialContext = p.dial
+	// only plaintext responses are captured, the transport needs TLS
+	// connections unwrapped
+	if max := p.captureBytes(); max > 0 {
+		transport.DialContext = captureDial(p.dial, max)
+	}
+	if len(p.cfg.HeaderOrder) > 0 {
+		transport.DialContext = headerOrderDial(transport.DialContext, p.cfg.HeaderOrder)
+	}
+	transport.TLSClientConfig.ClientSessionCache = tls.NewLRUClientSessionCache(p.cfg.TLSSessionCacheSize)
+	transport.DialTLSContext = p.dialTLSContext
+	// the transport then also sends "Connection: close" upstream
+	transport.DisableKeepAlives = p.cfg.DisableKeepAlives
+	// the transport would otherwise ask for gzip and decode it transparently
+	transport.DisableCompression = p.cfg.RawBody
+	if len(p.cfg.UpstreamNextProtos) > 0 {
+		transport.TLSClientConfig.NextProtos = p.cfg.UpstreamNextProtos
+		for _, proto := range p.cfg.UpstreamNextProtos {
+			if proto == "h2" {
+				transport.ForceAttemptHTTP2 = true
+			}
+		}
+	}
+	return transport
+}
+
+// dialTLSContext dials the resolved address and handshakes using the
+// requested host name as SNI, so sessions are cached per host name.
+func (p *HttpProxy) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := p.transport.TLSClientConfig.Clone()
+	if host, ok := ctx.Value(upstreamHostKey).(string); ok && host != "" {
+		cfg.ServerName = host
+	} else if host, _, err := net.SplitHostPort(addr); err == nil {
+		cfg.ServerName = host
+	}
+	cfg.VerifyConnection = p.verifyPins(cfg.ServerName)
+	// fields are only reordered on HTTP/1.1 connections
+	if len(p.cfg.HeaderOrder) > 0 {
+		cfg.NextProtos = []string{"http/1.1"}
+	}
+	tlsConn := tls.Client(conn, cfg)
+	// the transport leaves the handshake hooks to custom TLS dials
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	err = tlsConn.HandshakeContext(ctx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(tlsConn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(p.cfg.HeaderOrder) > 0 {
+		return newHeaderOrderConn(tlsConn, p.cfg.HeaderOrder), nil
+	}
+	return tlsConn, nil
+}
+
+// failoverDial wraps dial to try each resolved address of the request in
+// turn, addresses without port use the port of the dialed address.
+func (p *HttpProxy) failoverDial(dial dialFunc) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		addrs, ok := ctx.Value(upstreamAddrsKey).([]string)
+		if !ok || len(addrs) == 0 {
+			return dial(ctx, network, addr)
+		}
+		_, port, _ := net.SplitHostPort(addr)
+		var err error
+		for _, upstream := range addrs {
+			if _, _, e := net.SplitHostPort(upstream); e != nil {
+				upstream = net.JoinHostPort(upstream, port)
+			}
+			var conn net.Conn
+			if conn, err = dial(ctx, network, upstream); err == nil {
+				return conn, nil
+			}
+			p.log.Debug("dial upstream failed", zap.String("addr", upstream), zap.Error(err))
+			// the address is tried last until the retry period passed
+			if p.latency != nil && ctx.Err() == nil {
+				p.latency.fail(upstream)
+			}
+		}
+		return nil, err
+	}
+}
+
+// traceRequest records the upstream connection used by req on c, and the
+// phases of the exchange on the phaseTimer of its context. 1xx responses
+// go to its informationalRelay.
+func (p *HttpProxy) traceRequest(c *core.Context, req *http.Request) *http.Request {
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c.UpstreamAddr = info.Conn.RemoteAddr().String()
+			if capture, ok := req.Context().Value(rawCaptureKey).(*rawCapture); ok {
+				capture.set(info.Conn)
+			}
+		},
+	}
+	if timer, ok := req.Context().Value(phaseTimerKey).(*phaseTimer); ok {
+		timer.hook(trace)
+	}
+	if informational, ok := req.Context().Value(informationalKey).(*informationalRelay); ok {
+		trace.Got1xxResponse = informational.relay
+	}
+	p.countTrace(trace)
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultTunnelPorts are the ports tunnels may open when none are
+// configured.
+var DefaultTunnelPorts = []int{443}
+
+// tunnelPortAllowed reports whether CONNECT requests may open port.
+func (p *HttpProxy) tunnelPortAllowed(port string) bool {
+	ports := p.cfg.TunnelPorts
+	if len(ports) == 0 {
+		ports = DefaultTunnelPorts
+	}
+	for _, allowed := range ports {
+		if strconv.Itoa(allowed) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// trackTunnel keeps the client connection and the upstream one of a tunnel
+// to be closed on shutdown until the tunnel ends, which releases the per-IP
+// slot the hijacked client connection still holds.
+func (p *HttpProxy) trackTunnel(conn, upstream net.Conn) func() {
+	p.tunnelsMu.Lock()
+	if p.tunnels == nil {
+		p.tunnels = make(map[net.Conn]net.Conn)
+	}
+	p.tunnels[conn] = upstream
+	p.tunnelsMu.Unlock()
+	return func() {
+		p.tunnelsMu.Lock()
+		delete(p.tunnels, conn)
+		p.tunnelsMu.Unlock()
+		if p.connLimit != nil {
+			p.connLimit.release(conn)
+		}
+	}
+}
+
+// closeTunnels closes the connections of the open tunnels and returns how
+// many there were.
+func (p *HttpProxy) closeTunnels() int {
+	p.tunnelsMu.Lock()
+	defer p.tunnelsMu.Unlock()
+	for conn, upstream := range p.tunnels {
+		conn.Close()
+		upstream.Close()
+	}
+	n := len(p.tunnels)
+	p.tunnels = nil
+	return n
+}
+
+// tunnel relays a CONNECT request as an opaque byte stream to the
+// requested authority. Nothing is inspected, only the bytes of each
+// direction are counted for the access log and the host stats.
+func (p *HttpProxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	// an open relay to any port would reach mail and internal services
+	if _, port, _ := net.SplitHostPort(host); !p.tunnelPortAllowed(port) {
+		p.audit(r, AuditTunnelPort, port)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	ips, err := p.resolver.Get(host)
+	if err == nil {
+		ips, err = p.allowedAddrs(host, ips)
+	}
+	var blocked *blockedAddrError
+	if errors.As(err, &blocked) {
+		p.audit(r, AuditAddrBlocked, blocked.addr)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		p.log.Warn("tunnel", zap.String("host", host), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "tunnels need HTTP/1.x", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	ctx := context.WithValue(r.Context(), upstreamAddrsKey, ips)
+	upstream, err := p.dial(ctx, "tcp", host)
+	if err != nil {
+		p.log.Warn("tunnel", zap.String("host", host), zap.Error(err))
+		http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		p.log.Warn("tunnel", zap.String("host", host), zap.Error(err))
+		return
+	}
+	defer conn.Close()
+	defer p.trackTunnel(conn, upstream)()
+	// the server deadlines were meant for the request
+	conn.SetDeadline(time.Time{})
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+
+	start := time.Now()
+	var up, down int64
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		// buffered holds what the client sent right after the request
+		up, _ = io.Copy(upstream, buffered.Reader)
+		closeWrite(upstream)
+	}()
+	go func() {
+		defer wg.Done()
+		down, _ = io.Copy(conn, upstream)
+		// the upstream is done, clients waiting on it are let go
+		conn.Close()
+	}()
+	wg.Wait()
+	duration := time.Since(start)
+	if sw, ok := w.(*statusWriter); ok {
+		sw.tunneled(up, down)
+	}
+	if p.cfg.HostStats {
+		p.hostStats.addTunnel(strings.ToLower(stripPort(host)), up, down, duration)
+	}
+}
+
+// closeWrite half closes conn so the upstream sees EOF while its reply is
+// still relayed.
+func closeWrite(conn net.Conn) {
+	if c, ok := conn.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// defaultMaxUpstreamSeries caps the series of the upstream metric unless
+// configured otherwise.
+const defaultMaxUpstreamSeries = 1000
+
+// upstreamOther labels the requests of the series beyond the cap.
+const upstreamOther = "other"
+
+type upstreamSeries struct {
+	host, ip string
+	code     int
+}
+
+// upstreamMetrics counts the requests served by each upstream IP, the IP
+// connected to after any failover. Series beyond max are folded into one
+// per code with host and ip "other".
+type upstreamMetrics struct {
+	max int
+
+	mu     sync.Mutex
+	series map[upstreamSeries]int64
+}
+
+func newUpstreamMetrics(max int) *upstreamMetrics {
+	if max <= 0 {
+		max = defaultMaxUpstreamSeries
+	}
+	return &upstreamMetrics{max: max, series: map[upstreamSeries]int64{}}
+}
+
+func (m *upstreamMetrics) add(host, addr string, code int) {
+	key := upstreamSeries{host: strings.ToLower(stripPort(host)), ip: stripPort(addr), code: code}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.series[key]; !ok && len(m.series) >= m.max {
+		key.host, key.ip = upstreamOther, upstreamOther
+	}
+	m.series[key]++
+}
+
+// UpstreamRequests returns the request counts by host, upstream IP and
+// status code, empty unless UpstreamMetrics is enabled.
+func (p *HttpProxy) UpstreamRequests() map[[3]string]int64 {
+	requests := map[[3]string]int64{}
+	if p.metrics == nil {
+		return requests
+	}
+	p.metrics.mu.Lock()
+	defer p.metrics.mu.Unlock()
+	for key, n := range p.metrics.series {
+		requests[[3]string{key.host, key.ip, strconv.Itoa(key.code)}] = n
+	}
+	return requests
+}
+
+// MetricsHandler serves the upstream metric in the Prometheus text format,
+// as proxy_upstream_requests_total{host,ip,code}.
+func (p *HttpProxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		p.writeMetrics(w)
+	})
+}
+
+func (p *HttpProxy) writeMetrics(w io.Writer) {
+	requests := p.UpstreamRequests()
+	keys := make([][3]string, 0, len(requests))
+	for key := range requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		for k := range keys[i] {
+			if keys[i][k] != keys[j][k] {
+				return keys[i][k] < keys[j][k]
+			}
+		}
+		return false
+	})
+	io.WriteString(w, "# HELP proxy_upstream_requests_total Requests served by each upstream IP.\n")
+	io.WriteString(w, "# TYPE proxy_upstream_requests_total counter\n")
+	for _, key := range keys {
+		fmt.Fprintf(w, "proxy_upstream_requests_total{host=\"%s\",ip=\"%s\",code=\"%s\"} %d\n",
+			escapeLabel(key[0]), escapeLabel(key[1]), key[2], requests[key])
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
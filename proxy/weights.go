@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/millken/httpctl/config"
+)
+
+// UpstreamSelectionWeighted picks the first resolved address at random by
+// the configured weights.
+const UpstreamSelectionWeighted = "weighted"
+
+type upstreamWeights struct {
+	weights map[string]int
+	canary  map[string]bool
+	percent float64
+}
+
+// weightedSelector orders the resolved addresses of a host with one picked
+// by weight first, the others follow in the resolver order for failover.
+// Its weights are swapped on reloads while serving.
+type weightedSelector struct {
+	weights atomic.Value
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newWeightedSelector(cfg config.UpstreamSelection) *weightedSelector {
+	s := &weightedSelector{rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	s.set(cfg)
+	return s
+}
+
+func (s *weightedSelector) set(cfg config.UpstreamSelection) {
+	w := &upstreamWeights{weights: cfg.Weights, canary: make(map[string]bool, len(cfg.Canary)), percent: cfg.CanaryPercent}
+	for _, addr := range cfg.Canary {
+		w.canary[addr] = true
+	}
+	s.weights.Store(w)
+}
+
+// lookupAddr calls lookup with addr as ip:port, then as ip unless the first
+// call found it.
+func lookupAddr(addr, port string, lookup func(string) bool) bool {
+	key := addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		key = net.JoinHostPort(addr, port)
+	}
+	if lookup(key) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(key)
+	return err == nil && lookup(host)
+}
+
+func (w *upstreamWeights) weight(addr, port string) float64 {
+	weight := 1
+	lookupAddr(addr, port, func(key string) bool {
+		v, ok := w.weights[key]
+		if ok {
+			weight = v
+		}
+		return ok
+	})
+	if weight < 0 {
+		weight = 0
+	}
+	return float64(weight)
+}
+
+func (w *upstreamWeights) isCanary(addr, port string) bool {
+	return lookupAddr(addr, port, func(key string) bool { return w.canary[key] })
+}
+
+// order returns a copy of addrs with the picked address first.
+func (s *weightedSelector) order(addrs []string, port string) []string {
+	if len(addrs) < 2 {
+		return addrs
+	}
+	w := s.weights.Load().(*upstreamWeights)
+	shares := make([]float64, len(addrs))
+	var canary, stable float64
+	for i, addr := range addrs {
+		shares[i] = w.weight(addr, port)
+		if w.isCanary(addr, port) {
+			canary += shares[i]
+		} else {
+			stable += shares[i]
+		}
+	}
+	// with both groups present, the canary group gets its percentage
+	if w.percent > 0 && canary > 0 && stable > 0 {
+		for i, addr := range addrs {
+			if w.isCanary(addr, port) {
+				shares[i] *= w.percent / 100 / canary
+			} else {
+				shares[i] *= (1 - w.percent/100) / stable
+			}
+		}
+	}
+	var total float64
+	for _, share := range shares {
+		total += share
+	}
+	if total <= 0 {
+		return addrs
+	}
+	s.mu.Lock()
+	pick := s.rand.Float64() * total
+	s.mu.Unlock()
+	first := len(addrs) - 1
+	for i, share := range shares {
+		if pick < share {
+			first = i
+			break
+		}
+		pick -= share
+	}
+	ordered := make([]string, 0, len(addrs))
+	ordered = append(ordered, addrs[first])
+	ordered = append(ordered, addrs[:first]...)
+	return append(ordered, addrs[first+1:]...)
+}
+
+// SetUpstreamWeights replaces the weights and the canary of the weighted
+// upstream selection, in effect for the next requests. It does nothing in
+// other selection modes.
+func (p *HttpProxy) SetUpstreamWeights(cfg config.UpstreamSelection) {
+	if p.weights != nil {
+		p.weights.set(cfg)
+	}
+}
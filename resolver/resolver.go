@@ -13,12 +13,25 @@ import (
 )
 
 var (
-	DefaultExpiration time.Duration = time.Minute * 10
-	ResolverTimeout   time.Duration = time.Second * 7
+	DefaultExpiration  time.Duration = time.Minute * 10
+	NegativeExpiration time.Duration = time.Second * 5
+	ResolverTimeout    time.Duration = time.Second * 7
 )
 
+// RcodeError is returned when a lookup is answered with a failure rcode
+// such as NXDOMAIN or SERVFAIL.
+type RcodeError struct {
+	Host  string
+	Rcode int
+}
+
+func (e *RcodeError) Error() string {
+	return fmt.Sprintf("lookup %s: %s", e.Host, dns.RcodeToString[e.Rcode])
+}
+
 type Item struct {
 	Object     []string
+	Err        error
 	Expiration int64
 }
 
@@ -32,30 +45,90 @@ func (item Item) Expired() bool {
 
 type Resolver struct {
 	sync.RWMutex
-	resolver string
-	cache    map[string]Item
+	servers     []string
+	negativeTTL time.Duration
+	retries     int
+	backoff     time.Duration
+	timeout     time.Duration
+	cache       map[string]Item
 }
 
 func NewResolver(resolver string) *Resolver {
 	r := &Resolver{
-		resolver: resolver,
-		cache:    make(map[string]Item),
+		servers:     []string{serverAddr(resolver)},
+		negativeTTL: NegativeExpiration,
+		cache:       make(map[string]Item),
 	}
 	return r
 }
 
+// SetNegativeTTL sets how long NXDOMAIN and SERVFAIL answers are cached,
+// SERVFAIL once the retries are used up. Zero disables negative caching.
+func (r *Resolver) SetNegativeTTL(ttl time.Duration) {
+	r.Lock()
+	r.negativeTTL = ttl
+	r.Unlock()
+}
+
+// SetRetry sets how many times a lookup failing with a transient error,
+// such as a timeout, is retried. The wait before each retry starts at
+// backoff and doubles, definitive answers like NXDOMAIN are never retried.
+func (r *Resolver) SetRetry(retries int, backoff time.Duration) {
+	r.Lock()
+	r.retries = retries
+	r.backoff = backoff
+	r.Unlock()
+}
+
+// SetLookupTimeout bounds a whole lookup, servers, CNAMEs and retries
+// included, zero leaves only ResolverTimeout per query. A lookup running
+// out of time returns an error wrapping context.DeadlineExceeded.
+func (r *Resolver) SetLookupTimeout(timeout time.Duration) {
+	r.Lock()
+	r.timeout = timeout
+	r.Unlock()
+}
+
+// SetServers sets the DNS servers used for lookups, they are queried in
+// order until one of them answers. A server without port uses port 53.
+func (r *Resolver) SetServers(servers []string) {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addrs = append(addrs, serverAddr(server))
+	}
+	r.Lock()
+	r.servers = addrs
+	r.cache = make(map[string]Item)
+	r.Unlock()
+}
+
+func serverAddr(server string) string {
+	if _, _, err := net.SplitHostPort(server); err == nil {
+		return server
+	}
+	return net.JoinHostPort(server, "53")
+}
+
 func (r *Resolver) Get(host string) ([]string, error) {
+	host = stripPort(host)
 	r.RLock()
 	item, found := r.cache[host]
 	if found && !item.Expired() {
 		r.RUnlock()
-		return item.Object, nil
+		return item.Object, item.Err
 	}
 	r.RUnlock()
 
 	return r.lookupHost(host)
 }
 
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
 func (r *Resolver) deleteExpired() {
 	r.Lock()
 	for k, v := range r.cache {
@@ -66,51 +139,130 @@ func (r *Resolver) deleteExpired() {
 	r.Unlock()
 }
 
-func (r *Resolver) lookupHost(host string) ([]string, error) {
-	idx := strings.Index(host, ":")
-	if idx > -1 {
-		host = host[:idx]
-	}
+// exchange sends the question to the servers in order and returns the first
+// answer received.
+func (r *Resolver) exchange(ctx context.Context, host string) (*dns.Msg, error) {
 	m1 := new(dns.Msg)
 	m1.Id = dns.Id()
 	m1.RecursionDesired = true
-	m1.Question = make([]dns.Question, 1)
-	m1.Question[0] = dns.Question{dns.Fqdn(host), dns.TypeA, dns.ClassINET}
+	m1.Question = []dns.Question{{Name: dns.Fqdn(host), Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+
+	r.RLock()
+	servers := r.servers
+	r.RUnlock()
 
 	c := new(dns.Client)
-	ctx, _ := context.WithTimeout(context.Background(), ResolverTimeout)
-	in, _, err := c.ExchangeContext(ctx, m1, r.resolver+":53")
+	err := errors.New("no dns servers")
+	for _, server := range servers {
+		var in *dns.Msg
+		qctx, cancel := context.WithTimeout(ctx, ResolverTimeout)
+		in, _, err = c.ExchangeContext(qctx, m1, server)
+		cancel()
+		if err == nil {
+			return in, nil
+		}
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("lookup %s: %w", host, ctx.Err())
+		}
+	}
+	return nil, err
+}
+
+func (r *Resolver) lookupHost(host string) ([]string, error) {
+	ips, err := r.resolveRetry(host)
+	if err != nil {
+		if _, ok := err.(*RcodeError); ok {
+			r.Lock()
+			if r.negativeTTL > 0 {
+				r.cache[host] = Item{Err: err, Expiration: time.Now().Add(r.negativeTTL).UnixNano()}
+			}
+			r.Unlock()
+		}
+		return nil, err
+	}
+	r.Lock()
+	r.cache[host] = Item{Object: ips, Expiration: time.Now().Add(DefaultExpiration).UnixNano()}
+	r.Unlock()
+	return ips, nil
+}
+
+// resolveRetry resolves the host, retrying transient failures with
+// backoff.
+func (r *Resolver) resolveRetry(host string) ([]string, error) {
+	r.RLock()
+	retries, backoff, timeout := r.retries, r.backoff, r.timeout
+	r.RUnlock()
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	ips, err := r.resolve(ctx, host, maxCNAMEDepth)
+	for i := 0; i < retries && err != nil && isTransient(err); i++ {
+		select {
+		case <-time.After(backoff << uint(i)):
+		case <-ctx.Done():
+			return nil, fmt.Errorf("lookup %s: %w", host, ctx.Err())
+		}
+		ips, err = r.resolve(ctx, host, maxCNAMEDepth)
+	}
+	return ips, err
+}
+
+// isTransient reports whether the lookup error is worth retrying. Of the
+// failure rcodes only NXDOMAIN is definitive, SERVFAIL is retried.
+func isTransient(err error) bool {
+	var rcodeErr *RcodeError
+	if errors.As(err, &rcodeErr) {
+		return rcodeErr.Rcode == dns.RcodeServerFailure
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return netErr.Timeout() || netErr.Temporary()
+	}
+	return false
+}
+
+const maxCNAMEDepth = 8
 
+func (r *Resolver) resolve(ctx context.Context, host string, depth int) ([]string, error) {
+	in, err := r.exchange(ctx, host)
 	if err != nil {
 		return nil, err
 	}
+	if in.Rcode == dns.RcodeNameError || in.Rcode == dns.RcodeServerFailure {
+		return nil, &RcodeError{Host: host, Rcode: in.Rcode}
+	}
 
 	l := len(in.Answer)
 	if l == 0 {
 		return nil, errors.New(" answer has empty")
 	}
 	ips := []string{}
+	cname := ""
 	for i := 0; i < l; i++ {
-		switch in.Answer[i].(type) {
+		switch rr := in.Answer[i].(type) {
 		case *dns.A:
-			a := in.Answer[i].(*dns.A)
-			ips = append(ips, a.A.String())
+			ips = append(ips, rr.A.String())
 		case *dns.CNAME:
-			cname := in.Answer[i].(*dns.CNAME)
-			ipa, _ := net.LookupIP(cname.Target)
-			for _, ip := range ipa {
-				if ipv4 := ip.To4(); ipv4 != nil {
-					ips = append(ips, ipv4.String())
-				}
+			if cname == "" {
+				cname = rr.Target
 			}
 		}
 	}
+	// follow the cname through the same servers when the answer
+	// carries no address for it
+	if len(ips) == 0 && cname != "" && depth > 0 {
+		return r.resolve(ctx, strings.TrimSuffix(cname, "."), depth-1)
+	}
 
 	if len(ips) == 0 {
 		return nil, fmt.Errorf("in.Answer : %v", in.Answer)
 	}
-	r.Lock()
-	r.cache[host] = Item{ips, time.Now().Add(DefaultExpiration).UnixNano()}
-	r.Unlock()
 	return ips, nil
 }
@@ -1,8 +1,15 @@
 package resolver
 
 import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/miekg/dns"
 	"github.com/stretchr/testify/require"
 )
 
@@ -32,3 +39,189 @@ func TestResolver_NoFresh(t *testing.T) {
 		}
 	}
 }
+
+type testDNSServer struct {
+	sync.Mutex
+	server  *dns.Server
+	records map[string]string
+	queries   int32
+	drops     int32
+	servfails int32
+}
+
+func newTestDNSServer(t *testing.T, records map[string]string) *testDNSServer {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := &testDNSServer{records: records}
+	s.server = &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		atomic.AddInt32(&s.queries, 1)
+		if atomic.AddInt32(&s.drops, -1) >= 0 {
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(req)
+		if atomic.AddInt32(&s.servfails, -1) >= 0 {
+			m.Rcode = dns.RcodeServerFailure
+			w.WriteMsg(m)
+			return
+		}
+		q := req.Question[0]
+		s.Lock()
+		ip, found := s.records[q.Name]
+		s.Unlock()
+		if found {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+				A:   net.ParseIP(ip),
+			})
+		} else {
+			m.Rcode = dns.RcodeNameError
+		}
+		w.WriteMsg(m)
+	})}
+	go s.server.ActivateAndServe()
+	t.Cleanup(func() { s.server.Shutdown() })
+	return s
+}
+
+func (s *testDNSServer) Set(name, ip string) {
+	s.Lock()
+	s.records[name] = ip
+	s.Unlock()
+}
+
+// Drop makes the server ignore the next n queries.
+func (s *testDNSServer) Drop(n int32) {
+	atomic.StoreInt32(&s.drops, n)
+}
+
+// ServFail makes the server answer the next n queries with SERVFAIL.
+func (s *testDNSServer) ServFail(n int32) {
+	atomic.StoreInt32(&s.servfails, n)
+}
+
+func (s *testDNSServer) Addr() string {
+	return s.server.PacketConn.LocalAddr().String()
+}
+
+func (s *testDNSServer) Queries() int32 {
+	return atomic.LoadInt32(&s.queries)
+}
+
+func TestResolver_SetServers(t *testing.T) {
+	require := require.New(t)
+	s := newTestDNSServer(t, map[string]string{"split.example.": "10.1.2.3"})
+
+	// nothing listens on the first server, lookups fall through to the mock
+	dead, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	deadAddr := dead.LocalAddr().String()
+	dead.Close()
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{deadAddr, s.Addr()})
+	ips, err := r.Get("split.example:8080")
+	require.NoError(err)
+	require.Equal([]string{"10.1.2.3"}, ips)
+	require.Equal(int32(1), s.Queries())
+}
+
+func TestResolver_NegativeCache(t *testing.T) {
+	require := require.New(t)
+	s := newTestDNSServer(t, map[string]string{})
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	r.SetNegativeTTL(50 * time.Millisecond)
+
+	_, err := r.Get("missing.example")
+	require.IsType(&RcodeError{}, err)
+	_, err = r.Get("missing.example")
+	require.IsType(&RcodeError{}, err)
+	require.Equal(int32(1), s.Queries())
+
+	s.Set("missing.example.", "10.0.0.1")
+	time.Sleep(60 * time.Millisecond)
+	ips, err := r.Get("missing.example")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.1"}, ips)
+	require.Equal(int32(2), s.Queries())
+}
+
+func TestResolver_RetryTransient(t *testing.T) {
+	require := require.New(t)
+	timeout := ResolverTimeout
+	ResolverTimeout = 100 * time.Millisecond
+	defer func() { ResolverTimeout = timeout }()
+
+	s := newTestDNSServer(t, map[string]string{"flaky.example.": "10.0.0.2"})
+	s.Drop(1)
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	r.SetRetry(2, 10*time.Millisecond)
+	ips, err := r.Get("flaky.example")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.2"}, ips)
+	require.Equal(int32(2), s.Queries())
+
+	// without retries the timeout surfaces
+	s.Drop(1)
+	r = NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	_, err = r.Get("flaky.example")
+	require.Error(err)
+	require.True(isTransient(err))
+}
+
+func TestResolver_RetryNXDomain(t *testing.T) {
+	require := require.New(t)
+	s := newTestDNSServer(t, map[string]string{})
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	r.SetRetry(3, time.Second)
+	start := time.Now()
+	_, err := r.Get("missing.example")
+	require.IsType(&RcodeError{}, err)
+	require.Equal(int32(1), s.Queries())
+	require.True(time.Since(start) < time.Second)
+}
+
+func TestResolver_RetryServFail(t *testing.T) {
+	require := require.New(t)
+	s := newTestDNSServer(t, map[string]string{"flaky.example.": "10.0.0.3"})
+	s.ServFail(1)
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	r.SetRetry(2, 10*time.Millisecond)
+	ips, err := r.Get("flaky.example")
+	require.NoError(err)
+	require.Equal([]string{"10.0.0.3"}, ips)
+	require.Equal(int32(2), s.Queries())
+
+	// a server failing every retry is cached as any failure rcode
+	s.ServFail(3)
+	_, err = r.Get("failing.example")
+	require.IsType(&RcodeError{}, err)
+	require.Equal(int32(5), s.Queries())
+	_, err = r.Get("failing.example")
+	require.IsType(&RcodeError{}, err)
+	require.Equal(int32(5), s.Queries())
+}
+
+func TestResolver_LookupTimeout(t *testing.T) {
+	require := require.New(t)
+	s := newTestDNSServer(t, map[string]string{"slow.example.": "10.0.0.3"})
+	s.Drop(100)
+
+	r := NewResolver("127.0.0.1")
+	r.SetServers([]string{s.Addr()})
+	r.SetRetry(5, 10*time.Millisecond)
+	r.SetLookupTimeout(100 * time.Millisecond)
+	start := time.Now()
+	_, err := r.Get("slow.example")
+	require.True(errors.Is(err, context.DeadlineExceeded), "%v", err)
+	require.True(time.Since(start) < time.Second)
+}